@@ -0,0 +1,55 @@
+package jorb
+
+import "time"
+
+// JobEvent describes a single job finishing an Exec, as delivered by Processor.Events
+type JobEvent[JC any] struct {
+	JobId     string        // JobId is the id of the job that was executed
+	C         JC            // C is the job context after the Exec
+	FromState string        // FromState is the state the job was executed in
+	ToState   string        // ToState is the state the job moved to
+	Err       error         // Err is the error the Exec returned, if any
+	Duration  time.Duration // Duration is how long the Exec took, including any PreExec and PostExec hooks
+	Kicks     int           // Kicks is how many new jobs the Exec kicked
+
+	// Annotations are all of the job's annotations after the Exec, see Annotate
+	Annotations map[string]string
+}
+
+// eventBufferSize is how many job events can queue up for a slow consumer of Processor.Events before
+// new events are dropped
+const eventBufferSize = 1024
+
+// Events returns a channel that receives an event for every Exec the processor completes, eg to forward
+// each job's progress to another system. Call it before Exec. The channel is closed once Exec returns,
+// and a new one has to be requested for the next Exec.
+//
+// The processor never waits on the channel. If the consumer falls more than eventBufferSize events
+// behind, new events are dropped (and logged) rather than holding up processing.
+func (p *Processor[AC, OC, JC]) Events() <-chan JobEvent[JC] {
+	if p.events == nil {
+		p.events = make(chan JobEvent[JC], eventBufferSize)
+	}
+	return p.events
+}
+
+// emitEvent offers the event to the Events channel if anyone has asked for it, without blocking
+func (p *Processor[AC, OC, JC]) emitEvent(event JobEvent[JC]) {
+	if p.events == nil {
+		return
+	}
+	select {
+	case p.events <- event:
+	default:
+		p.logger.Warn("DroppedJobEvent", "job", event.JobId, "fromState", event.FromState, "toState", event.ToState)
+	}
+}
+
+// closeEvents closes the Events channel, if there is one, once Exec is done with it
+func (p *Processor[AC, OC, JC]) closeEvents() {
+	if p.events == nil {
+		return
+	}
+	close(p.events)
+	p.events = nil
+}
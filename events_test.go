@@ -0,0 +1,106 @@
+package jorb
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessor_Events(t *testing.T) {
+	t.Parallel()
+	oc := MyOverallContext{}
+	ac := MyAppContext{}
+	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
+	for i := 0; i < 10; i++ {
+		r.AddJob(MyJobContext{Count: i})
+	}
+	errOdd := errors.New("odd")
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				if jc.Count%2 == 1 {
+					return jc, STATE_FAILED, nil, errOdd
+				}
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 3,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+		{
+			TriggerState: STATE_FAILED,
+			Terminal:     true,
+		},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, nil, nil)
+	require.NoError(t, err)
+
+	events := p.Events()
+	received := make(chan []JobEvent[MyJobContext])
+	go func() {
+		all := []JobEvent[MyJobContext]{}
+		// The channel is closed when Exec finishes
+		for event := range events {
+			all = append(all, event)
+		}
+		received <- all
+	}()
+
+	require.NoError(t, p.Exec(context.Background(), r))
+	all := <-received
+
+	require.Len(t, all, 10)
+	for _, event := range all {
+		assert.Equal(t, TRIGGER_STATE_NEW, event.FromState)
+		if event.C.Count%2 == 1 {
+			assert.Equal(t, STATE_FAILED, event.ToState)
+			assert.ErrorIs(t, event.Err, errOdd)
+		} else {
+			assert.Equal(t, STATE_DONE, event.ToState)
+			assert.NoError(t, event.Err)
+		}
+	}
+}
+
+func TestProcessor_EventsWithoutConsumerDoesNotBlock(t *testing.T) {
+	t.Parallel()
+	oc := MyOverallContext{}
+	ac := MyAppContext{}
+	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
+	for i := 0; i < eventBufferSize*2; i++ {
+		r.AddJob(MyJobContext{})
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 10,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, nil, nil)
+	require.NoError(t, err)
+
+	// Nobody reads the events, so once the buffer fills up they're dropped
+	events := p.Events()
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	count := 0
+	for range events {
+		count++
+	}
+	assert.Equal(t, eventBufferSize, count)
+}
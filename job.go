@@ -1,6 +1,13 @@
 package jorb
 
-import "time"
+import (
+	"cmp"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
 
 // Job represents the current processing state of any job
 type Job[JC any] struct {
@@ -9,6 +16,21 @@ type Job[JC any] struct {
 	State       string              // State represents the current processing state of the job
 	StateErrors map[string][]string // StateErrors is a map of errors that occurred in the current state
 	LastUpdate  *time.Time          // The last time this job was fetched
+	Timeouts    int                 // Timeouts counts how many times Exec has timed out for the job in its current state
+	Depth       int                 // Depth is how many kicks away the job is from a job added to the run, which has depth 0
+
+	// StateEnteredAt is when the job moved into its current state. Retrying in the same state doesn't change it.
+	StateEnteredAt *time.Time
+
+	// Annotations are the diagnostics its Execs have attached to the job with Annotate
+	Annotations map[string]string
+
+	// Tags label the job for reporting, eg with the customer it's for, see Run.AddJobWithTags
+	Tags []string
+
+	// History is every state the job has entered, oldest first, if the processor has RecordHistory set.
+	// Retrying in the same state doesn't add to it.
+	History []string
 }
 
 // UpdateLastEvent updates the LastUpdate field of the Job struct to the current time.
@@ -22,3 +44,112 @@ func (j Job[JC]) UpdateLastEvent() Job[JC] {
 	j.LastUpdate = &t
 	return j
 }
+
+// HasTag reports whether the job is tagged with the tag
+func (j Job[JC]) HasTag(tag string) bool {
+	return slices.Contains(j.Tags, tag)
+}
+
+// attempt is which attempt at the job its next Exec in its current state is, see Attempt
+func (j Job[JC]) attempt() int {
+	return len(j.StateErrors[j.State]) + 1
+}
+
+// enterState records that the job has just moved into its current state
+func (j Job[JC]) enterState() Job[JC] {
+	// Truncated for the same reason as in UpdateLastEvent
+	t := time.Now().Truncate(time.Millisecond)
+	j.StateEnteredAt = &t
+	return j
+}
+
+// recordHistory adds the job's current state to its History, unless it's already the latest entry
+//
+// Like annotate, the slice is copied rather than appended to in place, as other copies of the job share it
+func (j Job[JC]) recordHistory() Job[JC] {
+	if len(j.History) > 0 && j.History[len(j.History)-1] == j.State {
+		return j
+	}
+	j.History = append(slices.Clip(j.History), j.State)
+	return j
+}
+
+// restart clears the job's history for it to start over, see ReentryAsNew
+func (j Job[JC]) restart() Job[JC] {
+	j.StateErrors = map[string][]string{}
+	j.Timeouts = 0
+	return j
+}
+
+// ParentId returns the id of the job that kicked this one, or "" if it wasn't kicked by another job
+//
+// Kicked jobs are given the id "${parent_id}->${n}", where n is the index of the kick request in the
+// parent's Exec result, so a job's whole lineage can be read from its id, eg "3->0->2". If a parent kicks
+// again and the id is already taken, a "#m" suffix is added, eg "3->0#1".
+func (j Job[JC]) ParentId() string {
+	idx := strings.LastIndex(j.Id, "->")
+	if idx == -1 {
+		return ""
+	}
+	return j.Id[:idx]
+}
+
+// compareJobIds orders job ids by when the jobs were added to the run: ids given out by the run are
+// compared as numbers rather than strings, so "2" comes before "10", and kicked jobs come straight after the
+// job that kicked them, eg "2", "2->0", "2->1", "10".
+func compareJobIds(a, b string) int {
+	for a != "" && b != "" {
+		aChunk, aRest := nextIdChunk(a)
+		bChunk, bRest := nextIdChunk(b)
+		aNum, aErr := strconv.Atoi(aChunk)
+		bNum, bErr := strconv.Atoi(bChunk)
+		var c int
+		if aErr == nil && bErr == nil {
+			c = cmp.Compare(aNum, bNum)
+		} else {
+			c = strings.Compare(aChunk, bChunk)
+		}
+		if c != 0 {
+			return c
+		}
+		a, b = aRest, bRest
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+// nextIdChunk splits the leading run of digits, or of anything else, off the id
+func nextIdChunk(id string) (string, string) {
+	digits := id[0] >= '0' && id[0] <= '9'
+	i := 1
+	for i < len(id) && (id[i] >= '0' && id[i] <= '9') == digits {
+		i++
+	}
+	return id[:i], id[i:]
+}
+
+// annotate adds the annotations to the job's, replacing any with the same key
+//
+// Like recordError, the map is copied rather than modified in place
+func (j *Job[JC]) annotate(values map[string]string) {
+	if len(values) == 0 {
+		return
+	}
+	annotations := maps.Clone(j.Annotations)
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	maps.Copy(annotations, values)
+	j.Annotations = annotations
+}
+
+// recordError appends err to the errors recorded against the given state
+//
+// The map is copied rather than modified in place, as it is shared with the copy of the job held by the run
+func (j *Job[JC]) recordError(state string, err error) {
+	stateErrors := maps.Clone(j.StateErrors)
+	if stateErrors == nil {
+		stateErrors = map[string][]string{}
+	}
+	stateErrors[state] = append(slices.Clone(stateErrors[state]), err.Error())
+	j.StateErrors = stateErrors
+}
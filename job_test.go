@@ -3,6 +3,7 @@ package jorb
 import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"slices"
 	"testing"
 	"time"
 )
@@ -18,3 +19,18 @@ func TestJob_UpdateLastEvent_UpdatesLastFetchToNow(t *testing.T) {
 	require.NotNil(t, j2.LastUpdate)
 	assert.WithinDuration(t, now, *j2.LastUpdate, time.Second)
 }
+
+func TestJob_ParentId(t *testing.T) {
+	assert.Equal(t, "", Job[MyJobContext]{Id: "3"}.ParentId())
+	assert.Equal(t, "3", Job[MyJobContext]{Id: "3->0"}.ParentId())
+	assert.Equal(t, "3->0", Job[MyJobContext]{Id: "3->0->12"}.ParentId())
+	assert.Equal(t, "3->0#1", Job[MyJobContext]{Id: "3->0#1->2"}.ParentId())
+}
+
+func TestCompareJobIds(t *testing.T) {
+	ids := []string{"10", "2->1", "2", "2->0#1", "1", "2->10", "2->0", "0"}
+	slices.SortFunc(ids, compareJobIds)
+	assert.Equal(t, []string{"0", "1", "2", "2->0", "2->0#1", "2->1", "2->10", "10"}, ids)
+	assert.Equal(t, 0, compareJobIds("3->0", "3->0"))
+	assert.Equal(t, -1, compareJobIds("a", "b"))
+}
@@ -0,0 +1,120 @@
+// Package jorbtest has helpers for testing state machines built with jorb, so tests can check what a
+// processor did without depending on the exact timing of status updates.
+package jorbtest
+
+import (
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/gaffo/jorb"
+)
+
+// RecordingListener is a StatusListener that keeps every status update it receives
+type RecordingListener struct {
+	m       sync.Mutex
+	updates [][]jorb.StatusCount
+}
+
+// StatusUpdate records the status
+func (l *RecordingListener) StatusUpdate(status []jorb.StatusCount) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.updates = append(l.updates, status)
+}
+
+// Updates returns every status update received so far, oldest first
+func (l *RecordingListener) Updates() [][]jorb.StatusCount {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return slices.Clone(l.updates)
+}
+
+// Final returns the latest status update, which once Exec has returned is the final status of the run
+func (l *RecordingListener) Final() []jorb.StatusCount {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if len(l.updates) == 0 {
+		return nil
+	}
+	return l.updates[len(l.updates)-1]
+}
+
+// FinalCount returns the state's count from the latest status update, and whether the state was in it
+func (l *RecordingListener) FinalCount(state string) (jorb.StatusCount, bool) {
+	for _, count := range l.Final() {
+		if count.State == state {
+			return count, true
+		}
+	}
+	return jorb.StatusCount{}, false
+}
+
+var _ jorb.StatusListener = &RecordingListener{}
+
+// TransitionRecorder records the states each job moves through from a processor's Events, eg
+//
+//	rec := jorbtest.NewTransitionRecorder(p.Events())
+//	err := p.Exec(ctx, r)
+//	rec.AssertPath(t, "0", "new", "middle", "done")
+//
+// A job's path is the state it was first executed in followed by the state each Exec moved it to. Moves
+// that don't involve an Exec, eg through delay states or skipped idempotent transitions, aren't seen.
+type TransitionRecorder[JC any] struct {
+	m      sync.Mutex
+	events []jorb.JobEvent[JC]
+	paths  map[string][]string
+	done   chan struct{}
+}
+
+// NewTransitionRecorder starts recording the events, which should come from Processor.Events called before
+// Exec. Recording finishes when Exec returns and closes the channel.
+func NewTransitionRecorder[JC any](events <-chan jorb.JobEvent[JC]) *TransitionRecorder[JC] {
+	r := &TransitionRecorder[JC]{
+		paths: map[string][]string{},
+		done:  make(chan struct{}),
+	}
+	go func() {
+		defer close(r.done)
+		for event := range events {
+			r.m.Lock()
+			r.events = append(r.events, event)
+			if _, ok := r.paths[event.JobId]; !ok {
+				r.paths[event.JobId] = []string{event.FromState}
+			}
+			r.paths[event.JobId] = append(r.paths[event.JobId], event.ToState)
+			r.m.Unlock()
+		}
+	}()
+	return r
+}
+
+// Wait blocks until every event has been recorded, ie until Exec has returned
+func (r *TransitionRecorder[JC]) Wait() {
+	<-r.done
+}
+
+// Events returns every recorded event in the order they happened. It waits for Exec to return.
+func (r *TransitionRecorder[JC]) Events() []jorb.JobEvent[JC] {
+	r.Wait()
+	return slices.Clone(r.events)
+}
+
+// Path returns the states the job moved through, or nil if it was never executed. It waits for Exec to
+// return.
+func (r *TransitionRecorder[JC]) Path(id string) []string {
+	r.Wait()
+	return slices.Clone(r.paths[id])
+}
+
+// AssertPath fails the test unless the job moved through exactly the given states, in order. It waits
+// for Exec to return.
+func (r *TransitionRecorder[JC]) AssertPath(t testing.TB, id string, states ...string) bool {
+	t.Helper()
+	path := r.Path(id)
+	if !slices.Equal(path, states) {
+		t.Errorf("job %s moved through %v, expected %v", id, path, states)
+		return false
+	}
+	return true
+}
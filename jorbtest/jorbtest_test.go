@@ -0,0 +1,68 @@
+package jorbtest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/gaffo/jorb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type overall struct{}
+type app struct{}
+type job struct {
+	Tries int
+}
+
+func TestTransitionRecorder(t *testing.T) {
+	t.Parallel()
+	r := jorb.NewRun[overall, job]("test", overall{})
+	r.AddJob(job{})
+	states := []jorb.State[app, overall, job]{
+		{
+			TriggerState: jorb.TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, a app, o overall, j job) (job, string, []jorb.KickRequest[job], error) {
+				return j, "middle", []jorb.KickRequest[job]{{C: j, State: "middle"}}, nil
+			},
+			Concurrency: 1,
+		},
+		{
+			TriggerState: "middle",
+			// Fails the first time through
+			Exec: func(ctx context.Context, a app, o overall, j job) (job, string, []jorb.KickRequest[job], error) {
+				j.Tries++
+				if j.Tries == 1 {
+					return j, "middle", nil, errors.New("try again")
+				}
+				return j, "done", nil, nil
+			},
+			Concurrency: 1,
+		},
+		{
+			TriggerState: "done",
+			Terminal:     true,
+		},
+	}
+
+	listener := &RecordingListener{}
+	p, err := jorb.NewProcessor[app, overall, job](app{}, states, nil, listener)
+	require.NoError(t, err)
+	rec := NewTransitionRecorder(p.Events())
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	assert.True(t, rec.AssertPath(t, "0", jorb.TRIGGER_STATE_NEW, "middle", "middle", "done"))
+	// A fake t, so the failing assertion doesn't fail this test
+	assert.False(t, rec.AssertPath(&testing.T{}, "0", jorb.TRIGGER_STATE_NEW, "done"))
+	rec.AssertPath(t, "0->0", "middle", "middle", "done")
+	assert.Nil(t, rec.Path("missing"))
+	assert.Len(t, rec.Events(), 5)
+
+	done, ok := listener.FinalCount("done")
+	require.True(t, ok)
+	assert.Equal(t, 2, done.Completed)
+	_, ok = listener.FinalCount("missing")
+	assert.False(t, ok)
+	assert.NotEmpty(t, listener.Updates())
+}
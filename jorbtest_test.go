@@ -0,0 +1,85 @@
+// Tests of the processor that use the jorbtest helpers. They're in package jorb_test, as jorbtest imports jorb.
+package jorb_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gaffo/jorb"
+	"github.com/gaffo/jorb/jorbtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type overall struct{}
+type app struct{}
+type job struct {
+	Count int
+}
+
+func TestProcessor_StateCallback(t *testing.T) {
+	t.Parallel()
+	r := jorb.NewRun[overall, job]("job", overall{})
+	for i := 0; i < 11; i++ {
+		r.AddJob(job{})
+	}
+
+	states := []jorb.State[app, overall, job]{
+		{
+			TriggerState: jorb.TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, a app, o overall, j job) (job, string, []jorb.KickRequest[job], error) {
+				j.Count += 1
+				time.Sleep(time.Second)
+				return j, "done", nil, nil
+			},
+			Concurrency: 10,
+		},
+		{
+			TriggerState: "done",
+			Terminal:     true,
+		},
+	}
+
+	listener := &jorbtest.RecordingListener{}
+	p, err := jorb.NewProcessor[app, overall, job](app{}, states, nil, listener)
+	require.NoError(t, err)
+	rec := jorbtest.NewTransitionRecorder(p.Events())
+
+	start := time.Now()
+	require.NoError(t, p.Exec(context.Background(), r))
+	// Two rounds of a second when run in parallel, rather than eleven one after another
+	assert.Less(t, time.Since(start), 3*time.Second, "Should take two rounds of 10 when run in parallel")
+
+	for id, j := range r.Jobs {
+		assert.Equal(t, 1, j.C.Count, "Job Count should be 1")
+		rec.AssertPath(t, id, jorb.TRIGGER_STATE_NEW, "done")
+	}
+
+	// Which updates get sent depends on timing, but every one of them should account for all of the jobs,
+	// and jobs only ever move towards done
+	completed := 0
+	maxExecuting := 0
+	for _, status := range listener.Updates() {
+		require.Len(t, status, 2)
+		done, running := status[0], status[1]
+		require.Equal(t, "done", done.State)
+		require.Equal(t, jorb.TRIGGER_STATE_NEW, running.State)
+
+		assert.Equal(t, 11, running.Waiting+running.Executing+done.Completed)
+		assert.LessOrEqual(t, running.Executing, 10)
+		assert.GreaterOrEqual(t, done.Completed, completed)
+		completed = done.Completed
+		maxExecuting = max(maxExecuting, running.Executing)
+	}
+	assert.Equal(t, 10, maxExecuting, "the first round should run all at once")
+
+	final, ok := listener.FinalCount("done")
+	require.True(t, ok)
+	assert.Equal(t, jorb.StatusCount{State: "done", Completed: 11, Terminal: true}, final)
+	running, ok := listener.FinalCount(jorb.TRIGGER_STATE_NEW)
+	require.True(t, ok)
+	assert.Equal(t, 0, running.Waiting+running.Executing)
+	assert.Equal(t, 11, running.Executed)
+	assert.Len(t, rec.Events(), 11, "one transition per job")
+}
@@ -0,0 +1,71 @@
+package jorb
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// RateObserver is optionally implemented by a RateWaiter that wants to know how the Execs it let through
+// went, eg to slow down when an api starts failing. See AdaptiveLimiter.
+type RateObserver interface {
+	// ObserveExec is called after each Exec of the state with the error it returned, nil if it succeeded.
+	// Timeouts are errors. It isn't called for jobs that didn't get as far as Exec, or once processing has
+	// been cancelled. It's called concurrently from each of the state's workers.
+	ObserveExec(err error)
+}
+
+// AdaptiveLimiter is a RateWaiter that backs off when Execs fail and ramps back up while they succeed,
+// additive increase and multiplicative decrease like TCP congestion control. It starts at Max, each error
+// multiplies the rate by Backoff, down to no lower than Min, and each success adds Increase to it, up to no
+// higher than Max. It's safe for concurrent use, but change the settings before using it.
+type AdaptiveLimiter struct {
+	Max      rate.Limit // Max is the fastest the limiter allows, in events per second, and where it starts
+	Min      rate.Limit // Min is the slowest the limiter backs off to
+	Increase rate.Limit // Increase is how much each success raises the rate
+	Backoff  float64    // Backoff is what each error multiplies the rate by, between 0 and 1
+
+	m       sync.Mutex
+	limiter *rate.Limiter
+}
+
+// NewAdaptiveLimiter creates an AdaptiveLimiter that runs at up to max events per second with the given
+// burst. It backs off by half on each error, to no slower than a hundredth of max, and climbs back by a
+// hundredth of max on each success.
+func NewAdaptiveLimiter(max rate.Limit, burst int) *AdaptiveLimiter {
+	return &AdaptiveLimiter{
+		Max:      max,
+		Min:      max / 100,
+		Increase: max / 100,
+		Backoff:  0.5,
+		limiter:  rate.NewLimiter(max, burst),
+	}
+}
+
+var _ RateWaiter = (*AdaptiveLimiter)(nil)
+var _ RateObserver = (*AdaptiveLimiter)(nil)
+
+// Wait blocks until the limiter allows another event at its current rate, or ctx is done
+func (l *AdaptiveLimiter) Wait(ctx context.Context) error {
+	return l.limiter.Wait(ctx)
+}
+
+// ObserveExec backs the rate off if err is set and raises it otherwise
+func (l *AdaptiveLimiter) ObserveExec(err error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	limit := l.limiter.Limit()
+	if err != nil {
+		limit = max(rate.Limit(float64(limit)*l.Backoff), l.Min)
+	} else {
+		limit = min(limit+l.Increase, l.Max)
+	}
+	l.limiter.SetLimit(limit)
+}
+
+// Limit returns the rate the limiter is currently allowing, in events per second
+func (l *AdaptiveLimiter) Limit() rate.Limit {
+	return l.limiter.Limit()
+}
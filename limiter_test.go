@@ -0,0 +1,95 @@
+package jorb
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func TestAdaptiveLimiter(t *testing.T) {
+	t.Parallel()
+	l := NewAdaptiveLimiter(100, 1)
+	assert.Equal(t, rate.Limit(100), l.Limit())
+
+	// Successes can't take it past Max
+	l.ObserveExec(nil)
+	assert.Equal(t, rate.Limit(100), l.Limit())
+
+	l.ObserveExec(errors.New("overloaded"))
+	l.ObserveExec(errors.New("overloaded"))
+	assert.Equal(t, rate.Limit(25), l.Limit())
+	l.ObserveExec(nil)
+	assert.Equal(t, rate.Limit(26), l.Limit())
+
+	// Errors can't take it below Min
+	for i := 0; i < 20; i++ {
+		l.ObserveExec(errors.New("overloaded"))
+	}
+	assert.Equal(t, rate.Limit(1), l.Limit())
+	require.NoError(t, l.Wait(context.Background()))
+}
+
+// observingWaiter is a RateWaiter that counts the outcomes it's told about
+type observingWaiter struct {
+	successes atomic.Int32
+	errors    atomic.Int32
+}
+
+func (w *observingWaiter) Wait(ctx context.Context) error {
+	return nil
+}
+
+func (w *observingWaiter) ObserveExec(err error) {
+	if err != nil {
+		w.errors.Add(1)
+	} else {
+		w.successes.Add(1)
+	}
+}
+
+func TestProcessor_RateObserver(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 4; i++ {
+		r.AddJob(MyJobContext{Count: i})
+	}
+	exec := func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+		if jc.Name == "" {
+			jc.Name = "retried"
+			return jc, TRIGGER_STATE_NEW, nil, errors.New("overloaded")
+		}
+		return jc, STATE_DONE, nil, nil
+	}
+	waiter := &observingWaiter{}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{TriggerState: TRIGGER_STATE_NEW, Exec: exec, Concurrency: 2, RateWaiter: waiter},
+		{TriggerState: STATE_DONE, Terminal: true},
+		{TriggerState: STATE_FAILED, Terminal: true},
+	}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+	assert.Equal(t, int32(4), waiter.errors.Load())
+	assert.Equal(t, int32(4), waiter.successes.Load())
+
+	// An AdaptiveLimiter backs off for every failure
+	for _, j := range r.Jobs {
+		j.State = TRIGGER_STATE_NEW
+		j.C.Name = ""
+		r.Jobs[j.Id] = j
+	}
+	limiter := NewAdaptiveLimiter(1000, 10)
+	states[0].RateWaiter = limiter
+	states[0].FailureState = STATE_FAILED
+	states[0].IsRetryable = func(err error) bool { return false }
+	p, err = NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+	assert.Equal(t, map[string]int{STATE_DONE: 0, STATE_FAILED: 4}, r.TerminalCounts())
+	assert.Equal(t, rate.Limit(1000.0/16), limiter.Limit())
+}
@@ -0,0 +1,214 @@
+package jorb
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProcessorMetrics counts how often jobs had to wait on the processor's channels, for tuning concurrency.
+// The channels are unbuffered, so a send only goes straight through when the other side is already waiting.
+//
+// Lots of blocked dispatches mean the process goroutine is waiting on workers that have been handed a job
+// but haven't got round to receiving it yet. Lots of blocked returns mean workers are finishing faster
+// than the process goroutine can handle their results, so it's the bottleneck rather than Exec.
+type ProcessorMetrics struct {
+	Dispatches          int64         // Dispatches is how many jobs were handed to a state's workers
+	DispatchesBlocked   int64         // DispatchesBlocked is how many of those had to wait for a worker to receive them
+	DispatchBlockedTime time.Duration // DispatchBlockedTime is how long the process goroutine spent waiting on them
+
+	Returns           int64         // Returns is how many finished jobs workers sent back to the process goroutine
+	ReturnsBlocked    int64         // ReturnsBlocked is how many of those had to wait for it to receive them
+	ReturnBlockedTime time.Duration // ReturnBlockedTime is the total time workers spent waiting on them
+}
+
+// channelMetrics is the atomically updated counters behind ProcessorMetrics
+type channelMetrics struct {
+	dispatches sendCounter
+	returns    sendCounter
+}
+
+// sendCounter counts the sends on a channel and how many of them had to wait
+type sendCounter struct {
+	sends       atomic.Int64
+	blocked     atomic.Int64
+	blockedTime atomic.Int64
+}
+
+// Metrics returns how often jobs have waited on the processor's channels over every Exec so far. It's safe
+// to call while Exec is running.
+func (p *Processor[AC, OC, JC]) Metrics() ProcessorMetrics {
+	m := p.metrics
+	return ProcessorMetrics{
+		Dispatches:          m.dispatches.sends.Load(),
+		DispatchesBlocked:   m.dispatches.blocked.Load(),
+		DispatchBlockedTime: time.Duration(m.dispatches.blockedTime.Load()),
+		Returns:             m.returns.sends.Load(),
+		ReturnsBlocked:      m.returns.blocked.Load(),
+		ReturnBlockedTime:   time.Duration(m.returns.blockedTime.Load()),
+	}
+}
+
+// countedSend sends v on ch and counts it on c, along with how long it waited if the receiver wasn't ready.
+// It only looks at the clock when it has to wait, so a send that goes straight through costs an atomic add.
+// It gives up and reports false if stop is closed first. A nil stop never is.
+func countedSend[T any](c *sendCounter, ch chan<- T, v T, stop <-chan struct{}) bool {
+	c.sends.Add(1)
+	select {
+	case ch <- v:
+		return true
+	default:
+	}
+	start := time.Now()
+	defer func() {
+		c.blocked.Add(1)
+		c.blockedTime.Add(int64(time.Since(start)))
+	}()
+	select {
+	case ch <- v:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// MetricsSink receives a call for every transition and completed job, to feed counters and timings to a
+// metrics backend such as StatsD or OpenTelemetry, see Processor.MetricsSink. Unlike a StatusListener, which
+// gets snapshots of the totals, it hears about each event as it happens. Its methods are called from the
+// goroutine that schedules every job, so they must be quick and mustn't block, or they hold up the run.
+type MetricsSink interface {
+	// JobTransitioned is called once each Exec has finished, with the state the job was executed in, the
+	// state it moved to, which is the same state if it's being retried, how long the Exec took and the
+	// error it returned, if any
+	JobTransitioned(from string, to string, dur time.Duration, err error)
+	// JobCompleted is called when a job moves into a terminal state, with that state
+	JobCompleted(state string)
+}
+
+// NilMetricsSink is a MetricsSink that ignores everything, the default when Processor.MetricsSink isn't set
+type NilMetricsSink struct{}
+
+var _ MetricsSink = NilMetricsSink{}
+
+// JobTransitioned does nothing
+func (NilMetricsSink) JobTransitioned(from string, to string, dur time.Duration, err error) {}
+
+// JobCompleted does nothing
+func (NilMetricsSink) JobCompleted(state string) {}
+
+// PrometheusMetricsSink is a MetricsSink that keeps its counts in memory and serves them over HTTP in the
+// Prometheus text format, so Prometheus can scrape them without the processor depending on a client
+// library. Register it with an http.ServeMux, eg at /metrics. It exposes
+//
+//   - jorb_transitions_total{from, to, result}: Execs by the states they moved the job between, with a
+//     result of "ok" or "error"
+//   - jorb_exec_duration_seconds{state}: a summary, without quantiles, of how long Execs took by state
+//   - jorb_jobs_completed_total{state}: jobs that moved into each terminal state
+//
+// It's safe to scrape while the processor is running. Use NewPrometheusMetricsSink to create one.
+type PrometheusMetricsSink struct {
+	m           sync.Mutex
+	transitions map[transitionLabels]int64
+	durations   map[string]durationSummary
+	completed   map[string]int64
+}
+
+// transitionLabels are the labels of a jorb_transitions_total series
+type transitionLabels struct {
+	from, to, result string
+}
+
+// durationSummary is the sum and count of a jorb_exec_duration_seconds series
+type durationSummary struct {
+	sum   time.Duration
+	count int64
+}
+
+// NewPrometheusMetricsSink creates a PrometheusMetricsSink with no counts yet
+func NewPrometheusMetricsSink() *PrometheusMetricsSink {
+	return &PrometheusMetricsSink{
+		transitions: map[transitionLabels]int64{},
+		durations:   map[string]durationSummary{},
+		completed:   map[string]int64{},
+	}
+}
+
+var _ MetricsSink = (*PrometheusMetricsSink)(nil)
+var _ http.Handler = (*PrometheusMetricsSink)(nil)
+
+// JobTransitioned counts the transition and adds the Exec's duration to its state's summary
+func (s *PrometheusMetricsSink) JobTransitioned(from string, to string, dur time.Duration, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.transitions[transitionLabels{from: from, to: to, result: result}] += 1
+	summary := s.durations[from]
+	summary.sum += dur
+	summary.count += 1
+	s.durations[from] = summary
+}
+
+// JobCompleted counts the job against the terminal state
+func (s *PrometheusMetricsSink) JobCompleted(state string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.completed[state] += 1
+}
+
+// ServeHTTP writes the counts in the Prometheus text format, with each metric's series sorted by label
+func (s *PrometheusMetricsSink) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.WriteTo(w)
+}
+
+// WriteTo writes the counts to w in the Prometheus text format, like ServeHTTP
+func (s *PrometheusMetricsSink) WriteTo(w io.Writer) (int64, error) {
+	s.m.Lock()
+	var lines []string
+	transitions := make([]string, 0, len(s.transitions))
+	for labels, count := range s.transitions {
+		transitions = append(transitions, fmt.Sprintf("jorb_transitions_total{from=%s,to=%s,result=%s} %d",
+			promLabel(labels.from), promLabel(labels.to), promLabel(labels.result), count))
+	}
+	durations := make([]string, 0, 2*len(s.durations))
+	for state, summary := range s.durations {
+		durations = append(durations,
+			fmt.Sprintf("jorb_exec_duration_seconds_sum{state=%s} %v", promLabel(state), summary.sum.Seconds()),
+			fmt.Sprintf("jorb_exec_duration_seconds_count{state=%s} %d", promLabel(state), summary.count))
+	}
+	completed := make([]string, 0, len(s.completed))
+	for state, count := range s.completed {
+		completed = append(completed, fmt.Sprintf("jorb_jobs_completed_total{state=%s} %d", promLabel(state), count))
+	}
+	s.m.Unlock()
+
+	for _, metric := range []struct {
+		name, help, kind string
+		series           []string
+	}{
+		{"jorb_transitions_total", "Execs by the states they moved jobs between and whether they errored.", "counter", transitions},
+		{"jorb_exec_duration_seconds", "How long Execs took by the state they ran in.", "summary", durations},
+		{"jorb_jobs_completed_total", "Jobs that moved into each terminal state.", "counter", completed},
+	} {
+		slices.Sort(metric.series)
+		lines = append(lines, fmt.Sprintf("# HELP %s %s", metric.name, metric.help), fmt.Sprintf("# TYPE %s %s", metric.name, metric.kind))
+		lines = append(lines, metric.series...)
+	}
+
+	n, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return int64(n), err
+}
+
+// promLabel quotes a label value for the Prometheus text format
+func promLabel(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
@@ -0,0 +1,45 @@
+package jorb
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheusMetricsSink(t *testing.T) {
+	t.Parallel()
+	s := NewPrometheusMetricsSink()
+	s.JobTransitioned(TRIGGER_STATE_NEW, STATE_DONE, 2*time.Second, nil)
+	s.JobTransitioned(TRIGGER_STATE_NEW, STATE_DONE, time.Second, nil)
+	s.JobTransitioned(TRIGGER_STATE_NEW, TRIGGER_STATE_NEW, 500*time.Millisecond, errors.New("flaked"))
+	s.JobTransitioned(`we"ird`, STATE_DONE, 0, nil)
+	s.JobCompleted(STATE_DONE)
+	s.JobCompleted(STATE_DONE)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	res := rec.Result()
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", res.Header.Get("Content-Type"))
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `# HELP jorb_transitions_total Execs by the states they moved jobs between and whether they errored.
+# TYPE jorb_transitions_total counter
+jorb_transitions_total{from="new",to="done",result="ok"} 2
+jorb_transitions_total{from="new",to="new",result="error"} 1
+jorb_transitions_total{from="we\"ird",to="done",result="ok"} 1
+# HELP jorb_exec_duration_seconds How long Execs took by the state they ran in.
+# TYPE jorb_exec_duration_seconds summary
+jorb_exec_duration_seconds_count{state="new"} 3
+jorb_exec_duration_seconds_count{state="we\"ird"} 1
+jorb_exec_duration_seconds_sum{state="new"} 3.5
+jorb_exec_duration_seconds_sum{state="we\"ird"} 0
+# HELP jorb_jobs_completed_total Jobs that moved into each terminal state.
+# TYPE jorb_jobs_completed_total counter
+jorb_jobs_completed_total{state="done"} 2
+`, string(body))
+}
@@ -0,0 +1,81 @@
+package jorb
+
+import (
+	"log/slog"
+	"maps"
+)
+
+// Option configures a Processor created with NewProcessorWithOptions. Options that set one of the
+// Processor's exported fields are equivalent to setting the field before calling Exec.
+type Option[AC any, OC any, JC any] func(p *Processor[AC, OC, JC])
+
+// WithSerializer saves the run with serializer as it's processed. Without it, or with a nil serializer,
+// the run isn't saved.
+func WithSerializer[AC any, OC any, JC any](serializer Serializer[OC, JC]) Option[AC, OC, JC] {
+	return func(p *Processor[AC, OC, JC]) {
+		p.serializer = serializer
+	}
+}
+
+// WithStatusListener sends status updates to listener as the run is processed
+func WithStatusListener[AC any, OC any, JC any](listener StatusListener) Option[AC, OC, JC] {
+	return func(p *Processor[AC, OC, JC]) {
+		p.statusListener = listener
+	}
+}
+
+// WithLogger sets Processor.Logger
+func WithLogger[AC any, OC any, JC any](logger *slog.Logger) Option[AC, OC, JC] {
+	return func(p *Processor[AC, OC, JC]) {
+		p.Logger = logger
+	}
+}
+
+// WithMetricsSink sets Processor.MetricsSink
+func WithMetricsSink[AC any, OC any, JC any](sink MetricsSink) Option[AC, OC, JC] {
+	return func(p *Processor[AC, OC, JC]) {
+		p.MetricsSink = sink
+	}
+}
+
+// WithMaxConcurrency sets Processor.MaxConcurrency
+func WithMaxConcurrency[AC any, OC any, JC any](n int) Option[AC, OC, JC] {
+	return func(p *Processor[AC, OC, JC]) {
+		p.MaxConcurrency = n
+	}
+}
+
+// WithConcurrency overrides the Concurrency of the named states, eg to run the same states with more workers
+// in production than in tests, without copying the states. The overrides are validated like the states'
+// own Concurrency, and naming a state that isn't declared is an ErrUnknownState. Later overrides of the same
+// state win.
+func WithConcurrency[AC any, OC any, JC any](concurrency map[string]int) Option[AC, OC, JC] {
+	return func(p *Processor[AC, OC, JC]) {
+		if p.concurrency == nil {
+			p.concurrency = map[string]int{}
+		}
+		maps.Copy(p.concurrency, concurrency)
+	}
+}
+
+// WithConcurrencyWeights shares a budget of workers out between the weighted states in proportion to their
+// weights, eg {"fetch": 3, "parse": 2} of 100 gives fetch 60 and parse 40, instead of setting each state's
+// Concurrency by hand. It also sets MaxConcurrency to budget. States that aren't weighted keep their own
+// Concurrency, and WithConcurrency overrides still win. Weights must be positive, and naming a state that
+// isn't declared is an ErrUnknownState.
+func WithConcurrencyWeights[AC any, OC any, JC any](budget int, weights map[string]float64) Option[AC, OC, JC] {
+	return func(p *Processor[AC, OC, JC]) {
+		p.MaxConcurrency = budget
+		p.concurrencyBudget = budget
+		p.concurrencyWeights = maps.Clone(weights)
+	}
+}
+
+// WithTerminalStates adds a terminal state for each of names, so states that just mark an outcome, eg done
+// or failed, don't each need a State declared for them. Naming a state that is also declared is an
+// ErrDuplicateState.
+func WithTerminalStates[AC any, OC any, JC any](names ...string) Option[AC, OC, JC] {
+	return func(p *Processor[AC, OC, JC]) {
+		p.terminalStates = append(p.terminalStates, names...)
+	}
+}
@@ -0,0 +1,233 @@
+package jorb
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"math"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewProcessorWithOptions(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 12; i++ {
+		r.AddJob(MyJobContext{})
+	}
+
+	m := sync.Mutex{}
+	executing, maxExecuting := 0, 0
+	exec := func(next string) func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+		return func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+			m.Lock()
+			executing++
+			maxExecuting = max(maxExecuting, executing)
+			m.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			m.Lock()
+			executing--
+			m.Unlock()
+			return jc, next, nil, nil
+		}
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{TriggerState: TRIGGER_STATE_NEW, Exec: exec(STATE_MIDDLE), Concurrency: 5},
+		{TriggerState: STATE_MIDDLE, Exec: exec(STATE_DONE), Concurrency: 5},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	logs := &bytes.Buffer{}
+	serializer := NewJsonSerializer[MyOverallContext, MyJobContext](filepath.Join(t.TempDir(), "state.json"))
+	listener := &recordingStatusListener{}
+	p, err := NewProcessorWithOptions(MyAppContext{}, states,
+		WithSerializer[MyAppContext](serializer),
+		WithStatusListener[MyAppContext, MyOverallContext, MyJobContext](listener),
+		WithLogger[MyAppContext, MyOverallContext, MyJobContext](slog.New(slog.NewTextHandler(logs, nil))),
+		WithMaxConcurrency[MyAppContext, MyOverallContext, MyJobContext](3),
+	)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	for _, j := range r.Jobs {
+		assert.Equal(t, STATE_DONE, j.State)
+	}
+	// The two states could run 10 jobs between them, but only 3 are allowed at once
+	assert.Equal(t, 3, maxExecuting)
+
+	saved, err := serializer.Deserialize()
+	require.NoError(t, err)
+	assert.True(t, r.Equal(saved))
+	assert.NotEmpty(t, listener.Updates())
+	assert.Contains(t, logs.String(), "Starting worker")
+}
+
+func TestNewProcessorWithOptions_InvalidStates(t *testing.T) {
+	t.Parallel()
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{TriggerState: TRIGGER_STATE_NEW, Concurrency: 1},
+	}
+	_, err := NewProcessorWithOptions(MyAppContext{}, states)
+	assert.ErrorIs(t, err, ErrMissingExec)
+}
+
+func TestNewProcessorWithOptions_TerminalStates(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 10; i++ {
+		r.AddJob(MyJobContext{Count: i})
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				if jc.Count%2 == 0 {
+					return jc, STATE_DONE, nil, nil
+				}
+				return jc, STATE_DONE_TWO, nil, nil
+			},
+			Concurrency:     2,
+			MaxKicksPerExec: 1,
+			FailureState:    STATE_FAILED,
+		},
+	}
+
+	p, err := NewProcessorWithOptions(MyAppContext{}, states,
+		WithTerminalStates[MyAppContext, MyOverallContext, MyJobContext](STATE_DONE, STATE_DONE_TWO, STATE_FAILED),
+	)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	stateCount := map[string]int{}
+	for _, j := range r.Jobs {
+		stateCount[j.State]++
+	}
+	assert.Equal(t, map[string]int{STATE_DONE: 5, STATE_DONE_TWO: 5}, stateCount)
+
+	// A terminal state can't be declared both ways
+	states = append(states, State[MyAppContext, MyOverallContext, MyJobContext]{TriggerState: STATE_DONE, Terminal: true})
+	_, err = NewProcessorWithOptions(MyAppContext{}, states,
+		WithTerminalStates[MyAppContext, MyOverallContext, MyJobContext](STATE_DONE, STATE_DONE_TWO, STATE_FAILED),
+	)
+	assert.ErrorIs(t, err, ErrDuplicateState)
+}
+
+func TestWithConcurrency(t *testing.T) {
+	t.Parallel()
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 2,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	p, err := NewProcessorWithOptions(MyAppContext{}, states,
+		WithConcurrency[MyAppContext, MyOverallContext, MyJobContext](map[string]int{TRIGGER_STATE_NEW: 8}),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, 8, p.Plan().States[0].Concurrency)
+	assert.Equal(t, 2, states[0].Concurrency, "the states passed in are left alone")
+
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 10; i++ {
+		r.AddJob(MyJobContext{})
+	}
+	require.NoError(t, p.Exec(context.Background(), r))
+	assert.Equal(t, map[string]int{STATE_DONE: 10}, r.TerminalCounts())
+
+	// Overrides are validated like the states themselves
+	_, err = NewProcessorWithOptions(MyAppContext{}, states,
+		WithConcurrency[MyAppContext, MyOverallContext, MyJobContext](map[string]int{TRIGGER_STATE_NEW: 0}),
+	)
+	assert.ErrorIs(t, err, ErrNoConcurrency)
+	_, err = NewProcessorWithOptions(MyAppContext{}, states,
+		WithConcurrency[MyAppContext, MyOverallContext, MyJobContext](map[string]int{"missing": 1}),
+	)
+	assert.ErrorIs(t, err, ErrUnknownState)
+}
+
+func TestWithConcurrencyWeights(t *testing.T) {
+	t.Parallel()
+	exec := func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+		return jc, STATE_DONE, nil, nil
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{TriggerState: TRIGGER_STATE_NEW, Exec: exec, Concurrency: 1},
+		{TriggerState: STATE_MIDDLE, Exec: exec, Concurrency: 1},
+		{TriggerState: STATE_DONE_TWO, Exec: exec, Concurrency: 5},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+	concurrency := func(p *Processor[MyAppContext, MyOverallContext, MyJobContext]) []int {
+		var concurrency []int
+		for _, state := range p.Plan().States[:3] {
+			concurrency = append(concurrency, state.Concurrency)
+		}
+		return concurrency
+	}
+
+	p, err := NewProcessorWithOptions(MyAppContext{}, states,
+		WithConcurrencyWeights[MyAppContext, MyOverallContext, MyJobContext](100, map[string]float64{TRIGGER_STATE_NEW: 0.6, STATE_MIDDLE: 0.4}),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []int{60, 40, 5}, concurrency(p), "states that aren't weighted keep their own")
+	assert.Equal(t, 100, p.MaxConcurrency)
+	assert.Equal(t, 1, states[0].Concurrency, "the states passed in are left alone")
+
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 10; i++ {
+		r.AddJob(MyJobContext{})
+	}
+	require.NoError(t, p.Exec(context.Background(), r))
+	assert.Equal(t, map[string]int{STATE_DONE: 10}, r.TerminalCounts())
+
+	// What's lost to rounding is handed out so the shares add up to the budget, and nobody gets nothing
+	p, err = NewProcessorWithOptions(MyAppContext{}, states,
+		WithConcurrencyWeights[MyAppContext, MyOverallContext, MyJobContext](10, map[string]float64{TRIGGER_STATE_NEW: 1, STATE_MIDDLE: 1, STATE_DONE_TWO: 1}),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []int{4, 3, 3}, concurrency(p))
+	p, err = NewProcessorWithOptions(MyAppContext{}, states,
+		WithConcurrencyWeights[MyAppContext, MyOverallContext, MyJobContext](10, map[string]float64{TRIGGER_STATE_NEW: 1000, STATE_MIDDLE: 1}),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []int{9, 1, 5}, concurrency(p))
+
+	// Explicit overrides still win
+	p, err = NewProcessorWithOptions(MyAppContext{}, states,
+		WithConcurrencyWeights[MyAppContext, MyOverallContext, MyJobContext](10, map[string]float64{TRIGGER_STATE_NEW: 1, STATE_MIDDLE: 1}),
+		WithConcurrency[MyAppContext, MyOverallContext, MyJobContext](map[string]int{STATE_MIDDLE: 2}),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []int{5, 2, 5}, concurrency(p))
+
+	for _, weights := range []map[string]float64{
+		{TRIGGER_STATE_NEW: 0},
+		{TRIGGER_STATE_NEW: -1},
+		{TRIGGER_STATE_NEW: math.NaN()},
+		{STATE_DONE: 1},
+	} {
+		_, err = NewProcessorWithOptions(MyAppContext{}, states,
+			WithConcurrencyWeights[MyAppContext, MyOverallContext, MyJobContext](10, weights),
+		)
+		assert.ErrorIs(t, err, ErrInvalidWeight, weights)
+	}
+	_, err = NewProcessorWithOptions(MyAppContext{}, states,
+		WithConcurrencyWeights[MyAppContext, MyOverallContext, MyJobContext](10, map[string]float64{"missing": 1}),
+	)
+	assert.ErrorIs(t, err, ErrUnknownState)
+	_, err = NewProcessorWithOptions(MyAppContext{}, states,
+		WithConcurrencyWeights[MyAppContext, MyOverallContext, MyJobContext](0, map[string]float64{TRIGGER_STATE_NEW: 1}),
+	)
+	assert.ErrorIs(t, err, ErrNoConcurrency)
+}
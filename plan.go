@@ -0,0 +1,199 @@
+package jorb
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// PlanReport describes a processor's state machine without running any jobs, see Processor.Plan
+type PlanReport struct {
+	States []StatePlan // States in the order they were declared
+	Edges  []PlanEdge  // Edges are the moves between states the states declare, in the order of States
+
+	// Complete is whether every state with an Exec declares its NextStates, ie whether Edges covers every
+	// move a job can make. Execs that don't declare them can move jobs anywhere.
+	Complete bool
+
+	// Unreachable is the states no job seeded into TRIGGER_STATE_NEW can ever get to. It's only worked out
+	// when the plan is Complete. Jobs seeded straight into other states, eg with AddJobWithState, may reach
+	// more, so Exec only warns about the states that are unreachable from the jobs actually in the run.
+	Unreachable []string
+
+	MaxConcurrency int // MaxConcurrency is the processor's cap on jobs executing across all states, if any
+}
+
+// StatePlan is the configuration of a single state in a PlanReport
+type StatePlan struct {
+	Name        string
+	Terminal    bool
+	Inline      bool
+	Delay       time.Duration // Delay is how long a delay state holds jobs, zero for states that execute
+	Concurrency int
+	RateLimit   rate.Limit // RateLimit is the state's events per second, zero if it has no RateLimit
+	RateBurst   int
+	RateWaiter  bool // RateWaiter is whether the state is paced by a RateWaiter, which can't be described
+	Timeout     time.Duration
+	MaxWaiting  int
+	Breaker     int // Breaker is the state's BreakerThreshold, zero if it has no circuit breaker
+}
+
+// PlanEdge is a move between states that a state declares
+type PlanEdge struct {
+	From string
+	To   string
+	Kind string // Kind is what declares the move: "next", "failure", "timeout" or "delay"
+}
+
+// Plan describes the processor's state machine, eg to check a configuration in CI or print it before
+// kicking off an expensive run. It doesn't run anything, and the states have already been validated by
+// NewProcessor, so it can be called at any time.
+func (p *Processor[AC, OC, JC]) Plan() PlanReport {
+	report := PlanReport{
+		Complete:       true,
+		MaxConcurrency: p.MaxConcurrency,
+	}
+	for _, s := range p.stateStorage.states {
+		plan := StatePlan{
+			Name:        s.TriggerState,
+			Terminal:    s.Terminal,
+			Inline:      s.Inline,
+			Delay:       s.Delay,
+			Concurrency: s.Concurrency,
+			Timeout:     s.Timeout,
+			MaxWaiting:  s.MaxWaiting,
+			Breaker:     s.BreakerThreshold,
+			RateWaiter:  s.RateWaiter != nil,
+		}
+		if s.RateLimit != nil {
+			plan.RateLimit = s.RateLimit.Limit()
+			plan.RateBurst = s.RateLimit.Burst()
+		}
+		report.States = append(report.States, plan)
+
+		if s.Exec != nil && s.NextStates == nil {
+			report.Complete = false
+		}
+		for _, next := range s.NextStates {
+			report.Edges = append(report.Edges, PlanEdge{From: s.TriggerState, To: next, Kind: "next"})
+		}
+		if s.isDelay() {
+			report.Edges = append(report.Edges, PlanEdge{From: s.TriggerState, To: s.NextState, Kind: "delay"})
+		}
+		if s.FailureState != "" {
+			report.Edges = append(report.Edges, PlanEdge{From: s.TriggerState, To: s.FailureState, Kind: "failure"})
+		}
+		if s.TimeoutState != "" {
+			report.Edges = append(report.Edges, PlanEdge{From: s.TriggerState, To: s.TimeoutState, Kind: "timeout"})
+		}
+	}
+	if report.Complete {
+		report.Unreachable = p.stateStorage.unreachableStates(nil)
+	}
+	return report
+}
+
+// String renders the plan as text, one state per line followed by where its jobs can go
+func (r PlanReport) String() string {
+	sb := strings.Builder{}
+	for _, s := range r.States {
+		sb.WriteString(s.Name)
+		sb.WriteString(": ")
+		sb.WriteString(s.describe())
+
+		targets := []string{}
+		for _, e := range r.Edges {
+			if e.From != s.Name {
+				continue
+			}
+			if e.Kind == "next" {
+				targets = append(targets, e.To)
+			} else {
+				targets = append(targets, fmt.Sprintf("%s (%s)", e.To, e.Kind))
+			}
+		}
+		if len(targets) > 0 {
+			sb.WriteString(" -> ")
+			sb.WriteString(strings.Join(targets, ", "))
+		}
+		sb.WriteString("\n")
+	}
+	if !r.Complete {
+		sb.WriteString("not every state declares its next states\n")
+	}
+	if len(r.Unreachable) > 0 {
+		fmt.Fprintf(&sb, "unreachable: %s\n", strings.Join(r.Unreachable, ", "))
+	}
+	return sb.String()
+}
+
+// describe summarises the state's settings, eg "concurrency 10, rate limit 5/s burst 1"
+func (s StatePlan) describe() string {
+	switch {
+	case s.Terminal:
+		return "terminal"
+	case s.Delay > 0:
+		return fmt.Sprintf("delay %s", s.Delay)
+	}
+	parts := []string{fmt.Sprintf("concurrency %d", s.Concurrency)}
+	if s.Inline {
+		parts = append(parts, "inline")
+	}
+	if s.RateLimit > 0 {
+		parts = append(parts, fmt.Sprintf("rate limit %g/s burst %d", float64(s.RateLimit), s.RateBurst))
+	}
+	if s.RateWaiter {
+		parts = append(parts, "custom rate limit")
+	}
+	if s.Timeout > 0 {
+		parts = append(parts, fmt.Sprintf("timeout %s", s.Timeout))
+	}
+	if s.MaxWaiting > 0 {
+		parts = append(parts, fmt.Sprintf("max waiting %d", s.MaxWaiting))
+	}
+	if s.Breaker > 0 {
+		parts = append(parts, fmt.Sprintf("breaker after %d errors", s.Breaker))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ToDOT renders the processor's state machine as a Graphviz DOT graph, see PlanReport.DOT
+func (p *Processor[AC, OC, JC]) ToDOT() string {
+	return p.Plan().DOT()
+}
+
+// DOT renders the plan as a Graphviz DOT graph, eg to pipe into `dot -Tsvg`. States are nodes labelled
+// with their concurrency and rate limit, with terminal states drawn as double circles. Declared moves are
+// edges, with failure and timeout moves dashed and delays dotted. A plan without any declared moves is
+// just the nodes.
+func (r PlanReport) DOT() string {
+	sb := strings.Builder{}
+	sb.WriteString("digraph jorb {\n")
+	sb.WriteString("\trankdir=LR;\n")
+	for _, s := range r.States {
+		shape := "box"
+		if s.Terminal {
+			shape = "doublecircle"
+		}
+		label := s.Name
+		if !s.Terminal {
+			// %q turns the newline into the \n DOT puts line breaks in labels with
+			label += "\n" + s.describe()
+		}
+		fmt.Fprintf(&sb, "\t%q [shape=%s, label=%q];\n", s.Name, shape, label)
+	}
+	for _, e := range r.Edges {
+		attrs := ""
+		switch e.Kind {
+		case "failure", "timeout":
+			attrs = fmt.Sprintf(" [style=dashed, label=%q]", e.Kind)
+		case "delay":
+			attrs = " [style=dotted]"
+		}
+		fmt.Fprintf(&sb, "\t%q -> %q%s;\n", e.From, e.To, attrs)
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
@@ -0,0 +1,138 @@
+package jorb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func TestProcessor_Plan(t *testing.T) {
+	t.Parallel()
+	exec := func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+		panic("plan shouldn't execute anything")
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec:         exec,
+			NextStates:   []string{"fetch"},
+			Concurrency:  2,
+			RateLimit:    rate.NewLimiter(5, 1),
+		},
+		{
+			TriggerState: "fetch",
+			Exec:         exec,
+			NextStates:   []string{"wait", STATE_DONE},
+			Concurrency:  10,
+			Timeout:      time.Second,
+			FailureState: "failed",
+		},
+		DelayState[MyAppContext, MyOverallContext, MyJobContext]("wait", time.Minute, "fetch"),
+		{
+			TriggerState: "orphan",
+			Exec:         exec,
+			NextStates:   []string{STATE_DONE},
+			Concurrency:  1,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+		{TriggerState: "failed", Terminal: true},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	plan := p.Plan()
+
+	require.Len(t, plan.States, 6)
+	assert.Equal(t, StatePlan{Name: TRIGGER_STATE_NEW, Concurrency: 2, RateLimit: 5, RateBurst: 1}, plan.States[0])
+	assert.Equal(t, time.Minute, plan.States[2].Delay)
+	assert.True(t, plan.States[4].Terminal)
+	assert.Equal(t, []PlanEdge{
+		{From: TRIGGER_STATE_NEW, To: "fetch", Kind: "next"},
+		{From: "fetch", To: "wait", Kind: "next"},
+		{From: "fetch", To: STATE_DONE, Kind: "next"},
+		{From: "fetch", To: "failed", Kind: "failure"},
+		{From: "wait", To: "fetch", Kind: "delay"},
+		{From: "orphan", To: STATE_DONE, Kind: "next"},
+	}, plan.Edges)
+	assert.True(t, plan.Complete)
+	assert.Equal(t, []string{"orphan"}, plan.Unreachable)
+
+	assert.Equal(t, "new: concurrency 2, rate limit 5/s burst 1 -> fetch\n"+
+		"fetch: concurrency 10, timeout 1s -> wait, done, failed (failure)\n"+
+		"wait: delay 1m0s -> fetch (delay)\n"+
+		"orphan: concurrency 1 -> done\n"+
+		"done: terminal\n"+
+		"failed: terminal\n"+
+		"unreachable: orphan\n", plan.String())
+}
+
+func TestProcessor_PlanIncomplete(t *testing.T) {
+	t.Parallel()
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	plan := p.Plan()
+	assert.False(t, plan.Complete)
+	assert.Empty(t, plan.Edges)
+	assert.Nil(t, plan.Unreachable, "without declared next states anything could be reachable")
+	assert.Contains(t, plan.String(), "not every state declares its next states")
+}
+
+func TestProcessor_ToDOT(t *testing.T) {
+	t.Parallel()
+	exec := func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+		return jc, STATE_DONE, nil, nil
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec:         exec,
+			NextStates:   []string{"wait", STATE_DONE},
+			Concurrency:  2,
+			RateLimit:    rate.NewLimiter(5, 1),
+			FailureState: "failed",
+		},
+		DelayState[MyAppContext, MyOverallContext, MyJobContext]("wait", time.Minute, TRIGGER_STATE_NEW),
+		{TriggerState: STATE_DONE, Terminal: true},
+		{TriggerState: "failed", Terminal: true},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, `digraph jorb {
+	rankdir=LR;
+	"new" [shape=box, label="new\nconcurrency 2, rate limit 5/s burst 1"];
+	"wait" [shape=box, label="wait\ndelay 1m0s"];
+	"done" [shape=doublecircle, label="done"];
+	"failed" [shape=doublecircle, label="failed"];
+	"new" -> "wait";
+	"new" -> "done";
+	"new" -> "failed" [style=dashed, label="failure"];
+	"wait" -> "new" [style=dotted];
+}
+`, p.ToDOT())
+
+	// Without declared moves it's just the nodes
+	states[0].NextStates = nil
+	states[0].FailureState = ""
+	states = states[:1]
+	states = append(states, State[MyAppContext, MyOverallContext, MyJobContext]{TriggerState: STATE_DONE, Terminal: true})
+	p, err = NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	assert.NotContains(t, p.ToDOT(), "->")
+	assert.Contains(t, p.ToDOT(), `"done" [shape=doublecircle, label="done"];`)
+}
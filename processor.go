@@ -1,23 +1,88 @@
 package jorb
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"hash/fnv"
+	"io"
 	"log/slog"
+	"math"
+	"math/rand"
+	"net"
+	"os"
 	"runtime/pprof"
+	"slices"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/time/rate"
 )
 
 const (
+	// TRIGGER_STATE_NEW is the state jobs start in when they're added with AddJob, Submit or a Source.
+	// Otherwise it's a state like any other: jobs can move back into it, where they queue behind the jobs
+	// already waiting, fresh or not, and it can even be terminal. See Processor.Reentry for what happens
+	// to a job's history when it comes back.
 	TRIGGER_STATE_NEW = "new"
+
+	// STATE_SKIPPED is where Exec sends a job, without an error, that turns out not to apply, eg because a
+	// precondition doesn't hold, so it ends without doing any work but stays in the run. Declare it as a
+	// terminal state, eg with WithTerminalStates(STATE_SKIPPED), and the jobs that end in it are counted
+	// as Skipped rather than Completed in its StatusCount, so reports can tell no-ops from finished work.
+	STATE_SKIPPED = "skipped"
+)
+
+// ReentryPolicy is what happens to a job that moves back into TRIGGER_STATE_NEW from another state, see
+// Processor.Reentry. A job that stays in TRIGGER_STATE_NEW, eg to retry, isn't reentering it.
+type ReentryPolicy int
+
+const (
+	// ReentryKeepHistory leaves the job as it is, so errors recorded against TRIGGER_STATE_NEW on earlier
+	// visits still count, like they do for any other state a job comes back to
+	ReentryKeepHistory ReentryPolicy = iota
+	// ReentryAsNew starts the job over as if it had just been added: its StateErrors and Timeouts are
+	// cleared. Its id, context, tags and annotations are kept.
+	ReentryAsNew
+)
+
+// CheckpointPolicy is which changes to a run get it saved by the processor's serializer as it's processed,
+// see Processor.CheckpointPolicy. Whatever the policy, the run is saved when Exec returns.
+type CheckpointPolicy int
+
+const (
+	// CheckpointEveryTransition saves the run whenever a job changes state, so a resumed run loses as little
+	// as possible
+	CheckpointEveryTransition CheckpointPolicy = iota
+	// CheckpointOnTerminal only saves the run when jobs finish, ie move into a terminal state, or are
+	// drained, which is far fewer saves for runs whose jobs go through lots of states. A resumed run picks
+	// up the other jobs from the states they were in at the last save, so their Execs since then are
+	// repeated, which is only safe if those states are idempotent.
+	CheckpointOnTerminal
+)
+
+// RetryPlacement is where in its state's queue a job goes when it's retried after Exec returns an error,
+// see State.RetryPlacement
+type RetryPlacement int
+
+const (
+	// RetryBack queues the job behind the jobs already waiting, so they get their turn before it's retried
+	RetryBack RetryPlacement = iota
+	// RetryFront queues the job ahead of the jobs already waiting, so it's retried as soon as there's room
+	RetryFront
 )
 
 // State represents a state in a state machine for job processing.
 // It defines the behavior and configuration for a particular state.
+//
+// A job is only retried in a state when Exec returns an error. Exec returning its own state without one,
+// eg to poll until something is ready, is a loop rather than a retry, so it isn't counted or delayed by any
+// of the retry settings: RetryDelay, MaxStateAge, the circuit breaker and StatusCount.Retries all go by
+// errors alone. Use RequeueAfter or MinInterval to wait between loops.
 type State[AC any, OC any, JC any] struct {
 	// TriggerState is the string identifier for this state.
 	TriggerState string
@@ -29,30 +94,365 @@ type State[AC any, OC any, JC any] struct {
 	// and an error (if any).
 	Exec func(ctx context.Context, ac AC, oc OC, jc JC) (JC, string, []KickRequest[JC], error)
 
+	// ExecC is an alternative to Exec that takes everything in a single ExecContext, so the contexts can't
+	// be mixed up by position. Set one or the other, not both.
+	ExecC func(ec ExecContext[AC, OC, JC]) (JC, string, []KickRequest[JC], error)
+
+	// NextStates optionally declares the states Exec can move jobs to or kick jobs into, besides this state
+	// itself, FailureState and TimeoutState. They're checked to exist when the processor is created, and if
+	// every state with an Exec declares them, Exec warns about states that no job can ever reach. They
+	// aren't enforced while jobs are processed.
+	NextStates []string
+
+	// Router optionally decides the next state from the job context Exec returned, overriding the state
+	// Exec returned. This keeps Exec focused on the work for states that branch to many next states.
+	// It isn't consulted when Exec returns an error, so the error handling in Exec still picks the state.
+	Router func(jc JC) string
+
+	// ErrorRouter optionally decides what happens to a job when Exec returns an error, overriding the state
+	// Exec returned. Returning retry sends the job back to this state to try again. Otherwise the job moves
+	// to nextState, or to FailureState if nextState is empty, eg to stop retrying permanent errors like bad input.
+	// If neither is set the job goes to the state Exec returned.
+	ErrorRouter func(err error, jc JC) (nextState string, retry bool)
+
+	// IsRetryable optionally decides from the error alone whether a job whose Exec returned an error is retried
+	// in this state or moved straight to FailureState, overriding the state Exec returned. RetryOn and
+	// IsTransient build common ones. It isn't consulted if ErrorRouter is set.
+	IsRetryable func(err error) bool
+
 	// Terminal indicates whether this state is a terminal state,
 	// meaning that no further state transitions should occur after reaching this state.
 	Terminal bool
 
 	// Concurrency specifies the maximum number of concurrent executions allowed for this state.
+	// If Weight is set it's instead the total weight of the jobs executing at once.
 	Concurrency int
 
+	// Weight optionally says how much of the state's Concurrency a job uses while it executes, eg 3 for a
+	// big job that should count as three small ones. Weights below 1 count as 1 and weights above
+	// Concurrency count as Concurrency, so a heavy job runs on its own rather than never. The oldest
+	// waiting job runs first, so a heavy job waits for enough room rather than being overtaken by
+	// lighter ones. It's called on the goroutine scheduling jobs, so keep it quick. Defaults to 1 per job.
+	Weight func(jc JC) int
+
 	// RateLimit is an optional rate limiter for controlling the execution rate of this state. Useful when calling rate limited apis.
 	RateLimit *rate.Limiter
+
+	// RateWaiter optionally paces the state with a limiter of your own instead of RateLimit, eg one that
+	// adapts to the rate limit headers of the api's responses. Each job waits on it before it executes. An
+	// error from Wait is handled like an error from Exec, without Exec being run, except that jobs stopped
+	// by processing being cancelled are left to run again. Jobs waiting on it aren't counted as RateLimited,
+	// as there's no telling whether Wait will block. If it's a RateObserver it's told how each Exec went,
+	// see AdaptiveLimiter. A state can't have both.
+	RateWaiter RateWaiter
+
+	// MaxKicksPerExec optionally bounds how many kick requests a single Exec of this state may return.
+	// If Exec returns more than this, none of them are expanded, an error is recorded against the job
+	// and the job is moved to FailureState. Zero means unlimited.
+	MaxKicksPerExec int
+
+	// MaxKickDepth optionally bounds how deep chains of kicked jobs from this state can go, as a safety valve
+	// for recursive fan outs. If a job would kick jobs deeper than this, see Job.Depth, none of them are
+	// expanded, an error is recorded against the job and the job is moved to FailureState. Zero means unlimited.
+	MaxKickDepth int
+
+	// FailureState is the state a job is moved to when it fails in a way that shouldn't be retried,
+	// such as exceeding MaxKicksPerExec or MaxKickDepth. It must name one of the processor's states.
+	FailureState string
+
+	// IdempotencyKey optionally derives a key from a job's context before Exec runs. When set, every
+	// successful transition out of this state is recorded in the run under the state and key, and a job
+	// entering this state with an already recorded key is moved straight to the recorded outcome instead
+	// of running Exec again. Use it for states with side effects that must not be repeated on resume or redrive.
+	IdempotencyKey func(jc JC) string
+
+	// HighWaterMark optionally applies backpressure to the states that feed this one. While more than this
+	// many jobs are waiting in this state, the states that have moved or kicked jobs into it don't start any
+	// of their own waiting jobs. Jobs already executing upstream still finish. To avoid deadlocking cycles,
+	// upstream states are only held back while this state is actively executing jobs. Zero means unbounded.
+	HighWaterMark int
+
+	// MaxStateAge optionally bounds how long a job keeps being retried in this state, going by when it
+	// entered the state (see Job.StateEnteredAt) rather than by how many times it has been tried. A job
+	// whose Exec fails once it has been in the state longer than this goes to FailureState with
+	// ErrMaxStateAge instead of being retried. Zero means no limit.
+	MaxStateAge time.Duration
+
+	// MaxWaiting optionally caps how many jobs can wait in this state. An Exec in another state whose kicks,
+	// or move into this state, would take it over the cap has its result thrown away and gets ErrQueueFull
+	// instead, so the job is retried from where it was before that Exec, after its state's RetryDelay. This
+	// never blocks, and jobs retrying after ErrQueueFull aren't held against the cap, so it can't deadlock a
+	// state that kicks into itself. A state with no jobs held against the cap always takes a whole batch, so
+	// an Exec that kicks more than MaxWaiting jobs can't be turned away forever. Zero means unbounded.
+	MaxWaiting int
+
+	// BreakerThreshold optionally enables a circuit breaker for this state. After this many consecutive Exec
+	// errors the breaker opens and the state's jobs wait without executing until BreakerCooldown has passed.
+	// Then a single trial job is let through: if it succeeds the breaker closes, if it fails it opens again.
+	// Zero disables the breaker.
+	BreakerThreshold int
+
+	// BreakerCooldown is how long the circuit breaker stays open before letting a trial job through
+	BreakerCooldown time.Duration
+
+	// Timeout optionally limits how long a single Exec may run. The context passed to Exec is cancelled once
+	// it expires and the job is retried in this state. Exec can call SaveProgress to keep the partial job
+	// context it has built up in case it doesn't return in time. The context passed to Exec is derived from
+	// the one passed to Processor.Exec, so if that has an earlier deadline, that's the one Exec sees, and
+	// running into it cancels the run rather than timing out the job. An Exec that returns without an error
+	// shortly after the deadline, before it is given up on, hasn't timed out, and keeps its result and kicks.
+	// Zero means no timeout.
+	Timeout time.Duration
+
+	// MaxTimeouts is how many times a job may time out in this state before it is moved to TimeoutState,
+	// keeping the partial job context of its last attempt. Zero retries timed out jobs indefinitely.
+	MaxTimeouts int
+
+	// TimeoutState is the state jobs are moved to once they exceed MaxTimeouts. Defaults to FailureState.
+	TimeoutState string
+
+	// RetryDelay optionally makes jobs wait before being retried when Exec returns an error and the job stays
+	// in this state, rather than being retried straight away. Errors implementing RetryAfterError, eg built
+	// from a Retry-After header, set the delay for their job instead. Zero retries immediately.
+	RetryDelay time.Duration
+
+	// MinInterval optionally paces each job in this state, rather than the whole state like RateLimit: a job
+	// coming back into this state, whether by looping in it, retrying or moving back from another state,
+	// waits until at least MinInterval has passed since its last Exec here finished. The wait doesn't use a
+	// worker, and a longer RetryDelay or RequeueAfter still applies. Zero means no minimum.
+	MinInterval time.Duration
+
+	// RetryPlacement is where a job that's retried in this state after Exec returns an error goes in the
+	// state's queue, once any RetryDelay is over. Defaults to RetryBack, behind the jobs already waiting.
+	RetryPlacement RetryPlacement
+
+	// FairByParent optionally round-robins this state's waiting jobs across the jobs that kicked them
+	// (see Job.ParentId) rather than running them strictly in the order they arrived. This stops one
+	// parent that fans out into many children from holding up the children of other parents.
+	// Seed jobs that weren't kicked by another job are grouped together.
+	FairByParent bool
+
+	// Delay optionally makes this a delay state. Jobs entering it wait for Delay without using a worker and
+	// then move to NextState, eg to wait between polls of a slow api. Delay states have no Exec and don't
+	// need any Concurrency. Delays aren't persisted, so jobs in a delay state wait the full Delay on resume.
+	Delay time.Duration
+
+	// NextState is the state jobs in a delay state move to once their Delay has passed
+	NextState string
+
+	// Setup is optionally called once per Exec, before any jobs are processed, eg to open a connection pool
+	// for the state's Execs to share. If it returns an error Exec returns it without processing anything.
+	Setup func(ctx context.Context, ac AC, oc OC) error
+
+	// Teardown is optionally called once Exec has finished with the state's workers, if Setup succeeded or
+	// there's no Setup, eg to close what Setup opened. States are torn down in the reverse of the order
+	// they were declared. Its context isn't cancelled when Exec's is. As a cancelled Exec doesn't wait for
+	// the Execs in progress, one that ignores its context can still be running when Teardown is called.
+	Teardown func(ctx context.Context, ac AC, oc OC)
+
+	// Inline optionally runs Exec directly on the goroutine scheduling jobs instead of handing the job to
+	// a worker, for states whose Exec is so cheap, eg pure CPU work on the job context, that the handoff
+	// costs more than the work. Inline Execs hold up every other state while they run, so they must never
+	// block, eg on the network, disk or a lock. Concurrency still bounds how many jobs are lined up to run
+	// in the state at once. Inline states can't have a RateLimit, RateWaiter or Timeout, as they would all
+	// hold up the scheduling goroutine while they wait. Processor.PreExec and PostExec run inline too, so
+	// they mustn't block either if any state is Inline.
+	Inline bool
+}
+
+// DelayState returns a delay state that holds jobs for delay before moving them to nextState
+func DelayState[AC any, OC any, JC any](triggerState string, delay time.Duration, nextState string) State[AC, OC, JC] {
+	return State[AC, OC, JC]{
+		TriggerState: triggerState,
+		Delay:        delay,
+		NextState:    nextState,
+	}
+}
+
+// isDelay reports whether this is a delay state rather than one that executes jobs
+func (s State[AC, OC, JC]) isDelay() bool {
+	return s.Delay > 0
+}
+
+// timeoutState is the state jobs that exceed MaxTimeouts are moved to
+func (s State[AC, OC, JC]) timeoutState() string {
+	if s.TimeoutState != "" {
+		return s.TimeoutState
+	}
+	return s.FailureState
+}
+
+// exec returns the state's Exec, or its ExecC adapted to the same signature, or nil if it has neither
+func (s State[AC, OC, JC]) exec() func(ctx context.Context, ac AC, oc OC, jc JC) (JC, string, []KickRequest[JC], error) {
+	if s.ExecC == nil {
+		return s.Exec
+	}
+	execC := s.ExecC
+	return func(ctx context.Context, ac AC, oc OC, jc JC) (JC, string, []KickRequest[JC], error) {
+		return execC(ExecContext[AC, OC, JC]{Context: ctx, App: ac, Overall: oc, Job: jc, JobId: JobId(ctx), Attempt: Attempt(ctx)})
+	}
 }
 
+// ExecContext is everything an ExecC is called with. It's also the context.Context for the Exec, so it can
+// be passed straight to RequeueAfter, Annotate and the like.
+type ExecContext[AC any, OC any, JC any] struct {
+	context.Context
+	App     AC // App is the processor's application context
+	Overall OC // Overall is the run's overall context
+	Job     JC // Job is the context of the job being executed
+
+	JobId   string // JobId is the id of the job being executed, see JobId
+	Attempt int    // Attempt is which attempt at the job this is in its state, see Attempt
+}
+
+// RetryOn returns an IsRetryable that retries errors matching any of targets with errors.Is, eg
+// RetryOn(context.DeadlineExceeded, io.ErrUnexpectedEOF), and fails the rest
+func RetryOn(targets ...error) func(err error) bool {
+	return func(err error) bool {
+		for _, target := range targets {
+			if errors.Is(err, target) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// IsTransient is an IsRetryable for errors that are likely to go away if the job is tried again: deadlines
+// (context.DeadlineExceeded, ErrExecTimeout or a net.Error that timed out) and errors implementing
+// RetryAfterError. Anything else, eg a validation error, fails the job.
+func IsTransient(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrExecTimeout) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var retryAfterErr RetryAfterError
+	return errors.As(err, &retryAfterErr)
+}
+
+// RetryAfterError can be implemented by errors returned from Exec to say how long to wait before the job is
+// retried, eg the Retry-After of a rate limited api. It overrides the state's RetryDelay.
+type RetryAfterError interface {
+	error
+	RetryAfter() time.Duration
+}
+
+// RateWaiter paces a state's jobs, see State.RateWaiter. A *rate.Limiter is one.
+type RateWaiter interface {
+	// Wait blocks until a job is allowed to execute, or ctx is done. It's called concurrently from each of
+	// the state's workers.
+	Wait(ctx context.Context) error
+}
+
+var _ RateWaiter = (*rate.Limiter)(nil)
+
 // KickRequest struct is a job context with a requested state that the
 // framework will expand into an actual job
+//
+// Kicks are also how a job goes down several states at once. A job only ever has one state, which keeps
+// retries, checkpoints and resumes simple, so rather than splitting a job in place, kick a copy into each
+// state (see Split). The copies get ids derived from the job's, so Run.Children finds them again to
+// recombine their results, eg from a state the original job waits in.
 type KickRequest[JC any] struct {
 	C     JC
 	State string
 }
 
+// Split kicks a copy of the job context into each of the states, eg to fetch from several sources at once
+func Split[JC any](jc JC, states ...string) []KickRequest[JC] {
+	kicks := make([]KickRequest[JC], 0, len(states))
+	for _, state := range states {
+		kicks = append(kicks, KickRequest[JC]{C: jc, State: state})
+	}
+	return kicks
+}
+
 type StatusCount struct {
 	State     string
 	Completed int
+	Skipped   int // Skipped counts the jobs in a terminal STATE_SKIPPED, which aren't counted as Completed
 	Executing int
 	Waiting   int
 	Terminal  bool
+	Breaker   BreakerState
+	TimedOut  int // Jobs that ran out of timeouts in this state and were moved to its timeout state
+
+	// RateLimited is how many of the Executing jobs are held up waiting on the state's RateLimit rather than
+	// doing work
+	RateLimited int
+
+	Executed int            // Executed is how many times Exec has run in this state
+	Errored  int            // Errored is how many of those Execs returned an error
+	Retries  RetryHistogram // Retries counts the jobs that have left this state by how many times they were retried in it
+
+	// Gauges holds the run wide metrics from Processor.Gauges, if it's set. Every StatusCount in a status
+	// update shares the same map, so don't modify it.
+	Gauges map[string]float64
+}
+
+// complete counts n jobs as having ended in the terminal state, as Skipped if it's STATE_SKIPPED
+func (c *StatusCount) complete(n int) {
+	if c.State == STATE_SKIPPED {
+		c.Skipped += n
+		return
+	}
+	c.Completed += n
+}
+
+// ErrorRate is the fraction of Execs in the state that returned an error
+func (c StatusCount) ErrorRate() float64 {
+	if c.Executed == 0 {
+		return 0
+	}
+	return float64(c.Errored) / float64(c.Executed)
+}
+
+// RetryHistogram counts jobs by how many times they were retried in a state after Exec returned an error,
+// so index 0 is jobs that didn't need retrying. The last bucket also counts jobs retried more times than that.
+type RetryHistogram [5]int
+
+func (h *RetryHistogram) add(retries int) {
+	h[min(retries, len(h)-1)] += 1
+}
+
+// Average is the average number of retries jobs needed, counting jobs in the last bucket as retried exactly
+// that many times
+func (h RetryHistogram) Average() float64 {
+	jobs, retries := 0, 0
+	for i, count := range h {
+		jobs += count
+		retries += i * count
+	}
+	if jobs == 0 {
+		return 0
+	}
+	return float64(retries) / float64(jobs)
+}
+
+// BreakerState is the state of a State's circuit breaker, see State.BreakerThreshold
+type BreakerState int
+
+const (
+	// BreakerClosed means jobs execute normally
+	BreakerClosed BreakerState = iota
+	// BreakerOpen means jobs wait without executing until the cooldown has passed
+	BreakerOpen
+	// BreakerHalfOpen means a single trial job may execute to see if the state has recovered
+	BreakerHalfOpen
+)
+
+func (b BreakerState) String() string {
+	switch b {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
 }
 
 type state struct {
@@ -65,37 +465,137 @@ type stateStorage[AC any, OC any, JC any] struct {
 	// These shouldn't be used outside stateStorage's methods
 	stateMap            map[string]State[AC, OC, JC]
 	stateStatusMap      map[string]*StatusCount
-	stateWaitingJobsMap map[string][]Job[JC]
+	stateWaitingJobsMap map[string]*jobQueue[JC]
 	stateChan           map[string]chan Job[JC]
 	sortedStateNames    []string
+
+	// downstreamStates tracks the states each state has been seen sending jobs to, for backpressure, and
+	// upstreamStates the same the other way round, to find the states backpressure may have been holding back
+	downstreamStates map[string]map[string]bool
+	upstreamStates   map[string]map[string]bool
+
+	// breakers tracks the circuit breaker of each state that has one
+	breakers map[string]*breaker
+
+	// lastParents tracks the parent of the job most recently started in each FairByParent state
+	lastParents map[string]string
+
+	// retries counts how many times each job has been retried in its current state after an error
+	retries map[string]int
+
+	// spills holds the waiting jobs of each state that didn't fit under spillThreshold, see Processor.SpillThreshold
+	spills         map[string]*spillQueue[JC]
+	spillThreshold int
+	spillDir       string
+	// spillFailed stops the run when a spill file can't be written or read, see Processor.spillFailed
+	spillFailed func(err error)
+
+	// resources counts the executing jobs holding each resource key, see Processor.ResourceKey
+	resourceKey   func(JC) string
+	resourceLimit int
+	resources     map[string]int
+	jobResources  map[string]string // the resource key held by each executing job, by job id
+
+	// weights sums the Weight of the jobs executing in each state that has one, and jobWeights holds the
+	// weight of each of those jobs by id
+	weights    map[string]int
+	jobWeights map[string]int
+
+	// draining stops any more jobs from being started, see Processor.drainExecuting
+	draining bool
+
+	// declarationOrder reports status counts in the order the states were declared rather than by name
+	declarationOrder bool
+
+	// maxConcurrency bounds the executing jobs across every state, see Processor.MaxConcurrency
+	maxConcurrency int
+
+	logger  *slog.Logger
+	metrics *channelMetrics
+
+	// inlineJobs are the jobs started in Inline states, waiting for the process goroutine to execute them
+	inlineJobs *[]Job[JC]
+
+	// nonTerminalJobs counts the run's jobs that aren't in a terminal state yet, so telling whether the run
+	// is finished doesn't mean looking at every job after every transition
+	nonTerminalJobs *int
+
+	// refused maps the jobs that are waiting to retry after ErrQueueFull to the state they're waiting in, and
+	// refusedWaiting counts them by state, so they aren't held against that state's MaxWaiting
+	refused        map[string]string
+	refusedWaiting map[string]int
+
+	// executingIds maps the ids of the jobs that are executing to the state they're executing in
+	executingIds map[string]string
 }
 
-func newStateStorageFromStates[AC any, OC any, JC any](states []State[AC, OC, JC]) stateStorage[AC, OC, JC] {
-	st := stateStorage[AC, OC, JC]{
-		states:              states,
-		stateMap:            map[string]State[AC, OC, JC]{},
-		stateStatusMap:      map[string]*StatusCount{},
-		stateWaitingJobsMap: map[string][]Job[JC]{},
-		stateChan:           map[string]chan Job[JC]{},
-		sortedStateNames:    []string{},
+type breaker struct {
+	consecutiveErrors int
+	openedAt          time.Time
+}
+
+// newStateStorageFromStates creates the storage for the states, plus a terminal state for each of terminalStates
+func newStateStorageFromStates[AC any, OC any, JC any](states []State[AC, OC, JC], terminalStates ...string) stateStorage[AC, OC, JC] {
+	if len(terminalStates) > 0 {
+		states = slices.Clone(states)
+		for _, name := range terminalStates {
+			states = append(states, State[AC, OC, JC]{TriggerState: name, Terminal: true})
+		}
 	}
 
+	st := stateStorage[AC, OC, JC]{
+		states:           states,
+		stateMap:         map[string]State[AC, OC, JC]{},
+		sortedStateNames: []string{},
+		metrics:          &channelMetrics{},
+	}
 	for _, s := range states {
-		stateName := s.TriggerState
+		st.sortedStateNames = append(st.sortedStateNames, s.TriggerState)
+		st.stateMap[s.TriggerState] = s
+	}
+	sort.Strings(st.sortedStateNames)
+	st.reset()
+
+	return st
+}
 
-		st.sortedStateNames = append(st.sortedStateNames, stateName)
-		st.stateMap[stateName] = s
-		st.stateStatusMap[stateName] = &StatusCount{
+// reset forgets everything about the jobs of the last Exec, so that the next one starts from scratch with
+// zeroed status counts and fresh channels for the workers
+func (s *stateStorage[AC, OC, JC]) reset() {
+	s.stateStatusMap = map[string]*StatusCount{}
+	s.stateWaitingJobsMap = map[string]*jobQueue[JC]{}
+	s.stateChan = map[string]chan Job[JC]{}
+	s.downstreamStates = map[string]map[string]bool{}
+	s.upstreamStates = map[string]map[string]bool{}
+	s.breakers = map[string]*breaker{}
+	s.lastParents = map[string]string{}
+	s.spills = map[string]*spillQueue[JC]{}
+	s.retries = map[string]int{}
+	s.resources = map[string]int{}
+	s.jobResources = map[string]string{}
+	s.weights = map[string]int{}
+	s.jobWeights = map[string]int{}
+	s.inlineJobs = &[]Job[JC]{}
+	s.nonTerminalJobs = new(int)
+	s.refused = map[string]string{}
+	s.refusedWaiting = map[string]int{}
+	s.executingIds = map[string]string{}
+	s.draining = false
+
+	for _, state := range s.states {
+		stateName := state.TriggerState
+		s.stateStatusMap[stateName] = &StatusCount{
 			State:    stateName,
-			Terminal: s.Terminal,
+			Terminal: state.Terminal,
 		}
 		// This is by-design unbuffered
-		st.stateChan[stateName] = make(chan Job[JC])
-	}
-
-	sort.Strings(st.sortedStateNames)
+		s.stateChan[stateName] = make(chan Job[JC])
+		s.stateWaitingJobsMap[stateName] = &jobQueue[JC]{}
 
-	return st
+		if state.BreakerThreshold > 0 {
+			s.breakers[stateName] = &breaker{}
+		}
+	}
 }
 
 func (s stateStorage[AC, OC, JC]) getJobChannelForState(stateName string) chan Job[JC] {
@@ -106,247 +606,2598 @@ func (s stateStorage[AC, OC, JC]) closeJobChannelForState(stateName string) {
 	close(s.stateChan[stateName])
 }
 
+// Sentinel errors for the ways a state can be misconfigured. NewProcessor returns them wrapped in a
+// *StateConfigError naming the offending state, so they can be checked with errors.Is.
+var (
+	// ErrDuplicateState means more than one state has the same TriggerState
+	ErrDuplicateState = errors.New("duplicate state")
+	// ErrNegativeConcurrency means a terminal state has a negative Concurrency
+	ErrNegativeConcurrency = errors.New("negative concurrency")
+	// ErrNoConcurrency means a state that executes jobs has a Concurrency below 1
+	ErrNoConcurrency = errors.New("non-positive concurrency")
+	// ErrMissingExec means a state that executes jobs has no Exec
+	ErrMissingExec = errors.New("missing exec")
+	// ErrInvalidDelay means a delay state is terminal or has an Exec
+	ErrInvalidDelay = errors.New("invalid delay state")
+	// ErrNegativeSetting means one of a state's limits or durations is negative
+	ErrNegativeSetting = errors.New("negative setting")
+	// ErrMissingCooldown means a state has a circuit breaker but no BreakerCooldown
+	ErrMissingCooldown = errors.New("missing breaker cooldown")
+	// ErrMissingFailureState means a state can fail jobs, eg with MaxKicksPerExec, but has nowhere to send them
+	ErrMissingFailureState = errors.New("missing failure state")
+	// ErrUnknownState means a state refers to another state that doesn't exist
+	ErrUnknownState = errors.New("unknown state")
+	// ErrInvalidInline means an Inline state has a RateLimit, RateWaiter or Timeout, which would block the
+	// scheduling goroutine
+	ErrInvalidInline = errors.New("invalid inline state")
+	// ErrConflictingRateLimits means a state has both a RateLimit and a RateWaiter
+	ErrConflictingRateLimits = errors.New("conflicting rate limits")
+	// ErrConflictingExec means a state has both an Exec and an ExecC
+	ErrConflictingExec = errors.New("conflicting exec functions")
+	// ErrInvalidWeight means a state's weight from WithConcurrencyWeights isn't a positive number, or the
+	// state doesn't have workers for it to weigh
+	ErrInvalidWeight = errors.New("invalid concurrency weight")
+)
+
+// StateConfigError is returned by NewProcessor when a state is misconfigured
+type StateConfigError struct {
+	State string // State is the TriggerState of the misconfigured state
+	Err   error  // Err is the sentinel error for the kind of misconfiguration, eg ErrMissingExec
+
+	msg string
+}
+
+func (e *StateConfigError) Error() string {
+	return e.msg
+}
+
+func (e *StateConfigError) Unwrap() error {
+	return e.Err
+}
+
+func configError(state string, err error, format string, args ...any) error {
+	return &StateConfigError{
+		State: state,
+		Err:   err,
+		msg:   fmt.Sprintf(format, args...),
+	}
+}
+
 func (s stateStorage[AC, OC, JC]) validate() error {
+	seen := map[string]bool{}
 	for _, state := range s.states {
+		name := state.TriggerState
+		if seen[name] {
+			return configError(name, ErrDuplicateState, "state %s is defined more than once", name)
+		}
+		seen[name] = true
+
+		if state.Delay < 0 {
+			return configError(name, ErrNegativeSetting, "state %s has negative delay", name)
+		}
 		if state.Terminal {
 			if state.Concurrency < 0 {
-				return fmt.Errorf("terminal state %s has negative concurrency", state.TriggerState)
+				return configError(name, ErrNegativeConcurrency, "terminal state %s has negative concurrency", name)
+			}
+			if state.isDelay() {
+				return configError(name, ErrInvalidDelay, "terminal state %s has a delay", name)
+			}
+		} else if state.isDelay() {
+			if state.Exec != nil {
+				return configError(name, ErrInvalidDelay, "delay state %s has an Exec function", name)
+			}
+			if _, ok := s.stateMap[state.NextState]; !ok {
+				return configError(name, ErrUnknownState, "delay state %s has unknown next state %s", name, state.NextState)
 			}
 		} else {
 			if state.Concurrency < 1 {
-				return fmt.Errorf("non-terminal state %s has non-positive concurrency", state.TriggerState)
+				return configError(name, ErrNoConcurrency, "non-terminal state %s has non-positive concurrency", name)
 			}
 			if state.Exec == nil {
-				return fmt.Errorf("non-terminal state %s but has no Exec function", state.TriggerState)
+				return configError(name, ErrMissingExec, "non-terminal state %s but has no Exec function", name)
 			}
 		}
+		if state.Inline && (state.RateLimit != nil || state.RateWaiter != nil) {
+			return configError(name, ErrInvalidInline, "inline state %s has a rate limit", name)
+		}
+		if state.Inline && state.Timeout > 0 {
+			return configError(name, ErrInvalidInline, "inline state %s has a timeout", name)
+		}
+		if state.RateLimit != nil && state.RateWaiter != nil {
+			return configError(name, ErrConflictingRateLimits, "state %s has both a rate limit and a rate waiter", name)
+		}
+		if state.BreakerThreshold < 0 {
+			return configError(name, ErrNegativeSetting, "state %s has negative breaker threshold", name)
+		}
+		if state.BreakerThreshold > 0 && state.BreakerCooldown <= 0 {
+			return configError(name, ErrMissingCooldown, "state %s has a circuit breaker but no cooldown", name)
+		}
+		if state.RetryDelay < 0 {
+			return configError(name, ErrNegativeSetting, "state %s has negative retry delay", name)
+		}
+		if state.MinInterval < 0 {
+			return configError(name, ErrNegativeSetting, "state %s has negative min interval", name)
+		}
+		if state.Timeout < 0 {
+			return configError(name, ErrNegativeSetting, "state %s has negative timeout", name)
+		}
+		if state.MaxTimeouts < 0 {
+			return configError(name, ErrNegativeSetting, "state %s has negative max timeouts", name)
+		}
+		if state.MaxTimeouts > 0 && state.timeoutState() == "" {
+			return configError(name, ErrMissingFailureState, "state %s limits timeouts but has no timeout or failure state", name)
+		}
+		if _, ok := s.stateMap[state.TimeoutState]; state.TimeoutState != "" && !ok {
+			return configError(name, ErrUnknownState, "state %s has unknown timeout state %s", name, state.TimeoutState)
+		}
+		if state.MaxStateAge < 0 {
+			return configError(name, ErrNegativeSetting, "state %s has negative max state age", name)
+		}
+		if state.MaxStateAge > 0 && state.FailureState == "" {
+			return configError(name, ErrMissingFailureState, "state %s limits state age but has no failure state", name)
+		}
+		if state.MaxWaiting < 0 {
+			return configError(name, ErrNegativeSetting, "state %s has negative max waiting", name)
+		}
+		if state.HighWaterMark < 0 {
+			return configError(name, ErrNegativeSetting, "state %s has negative high water mark", name)
+		}
+		if state.MaxKicksPerExec < 0 {
+			return configError(name, ErrNegativeSetting, "state %s has negative max kicks per exec", name)
+		}
+		if state.MaxKicksPerExec > 0 && state.FailureState == "" {
+			return configError(name, ErrMissingFailureState, "state %s limits kicks per exec but has no failure state", name)
+		}
+		if state.IsRetryable != nil && state.FailureState == "" {
+			return configError(name, ErrMissingFailureState, "state %s classifies retryable errors but has no failure state", name)
+		}
+		if state.MaxKickDepth < 0 {
+			return configError(name, ErrNegativeSetting, "state %s has negative max kick depth", name)
+		}
+		if state.MaxKickDepth > 0 && state.FailureState == "" {
+			return configError(name, ErrMissingFailureState, "state %s limits kick depth but has no failure state", name)
+		}
+		for _, next := range state.NextStates {
+			if _, ok := s.stateMap[next]; !ok {
+				return configError(name, ErrUnknownState, "state %s has unknown next state %s", name, next)
+			}
+		}
+		if _, ok := s.stateMap[state.FailureState]; state.FailureState != "" && !ok {
+			return configError(name, ErrUnknownState, "state %s has unknown failure state %s", name, state.FailureState)
+		}
 	}
 
 	return nil
 }
 
+// unreachableStates returns the states, in declaration order, that no job can move into according to the
+// states' NextStates, apart from TRIGGER_STATE_NEW and the seeded states that already have jobs. It returns
+// nil if any state with an Exec doesn't declare its NextStates, as its jobs could go anywhere.
+func (s stateStorage[AC, OC, JC]) unreachableStates(seeded map[string]bool) []string {
+	inbound := map[string]bool{}
+	for _, state := range s.states {
+		if state.Exec != nil && state.NextStates == nil {
+			return nil
+		}
+		for _, next := range state.NextStates {
+			if next != state.TriggerState {
+				inbound[next] = true
+			}
+		}
+		for _, next := range []string{state.FailureState, state.TimeoutState, state.NextState} {
+			if next != "" {
+				inbound[next] = true
+			}
+		}
+	}
+
+	var unreachable []string
+	for _, state := range s.states {
+		name := state.TriggerState
+		if name != TRIGGER_STATE_NEW && !seeded[name] && !inbound[name] {
+			unreachable = append(unreachable, name)
+		}
+	}
+	return unreachable
+}
+
 func (s stateStorage[AC, OC, JC]) runJob(job Job[JC]) {
 	s.stateStatusMap[job.State].Executing += 1
-	s.stateChan[job.State] <- job
+	s.executingIds[job.Id] = job.State
+	s.unrefuseJob(job.Id)
+	if s.stateMap[job.State].Weight != nil {
+		weight := s.jobWeight(job)
+		s.weights[job.State] += weight
+		s.jobWeights[job.Id] = weight
+	}
+	if key := s.jobResourceKey(job); key != "" {
+		s.resources[key] += 1
+		s.jobResources[job.Id] = key
+	}
+	if s.stateMap[job.State].Inline {
+		*s.inlineJobs = append(*s.inlineJobs, job)
+		return
+	}
+	countedSend(&s.metrics.dispatches, s.stateChan[job.State], job, nil)
 }
 
 func (s stateStorage[AC, OC, JC]) queueJob(job Job[JC]) {
 	s.stateStatusMap[job.State].Waiting += 1
-	// Since we pull queued jobs from the end of the slice, we should put new jobs at the front
-	// to ensure fairness (jobs that come later only get processed after already waiting jobs)
-	// If this was in the hot loop (happening thousands of times per second), the memory re-alloc here wouldn't be great
-	// However, typically work involved in state transitions is 4+ orders of magnitude lower than the actual work
-	// being done, so the simplicity is preferred compared to some sort of more elegant resizing ring buffer
-	s.stateWaitingJobsMap[job.State] = append([]Job[JC]{job}, s.stateWaitingJobsMap[job.State]...)
+	// New jobs go to the back of the queue so they only run after the jobs already waiting, see jobQueue
+	//
+	// Once there are too many waiting jobs to hold in memory, newer jobs go to the back of the state's spill
+	// queue on disk instead, and are paged back in oldest first once the jobs in memory have all been run
+	if s.spillThreshold > 0 && (s.spilledJobCount(job.State) > 0 || s.stateWaitingJobsMap[job.State].len() >= s.spillThreshold) {
+		s.spillJob(job)
+		return
+	}
+	s.stateWaitingJobsMap[job.State].push(job)
 }
 
-func (s stateStorage[AC, OC, JC]) completeJob(job Job[JC]) {
-	s.stateStatusMap[job.State].Completed += 1
+// spilledJobCount is how many of the state's waiting jobs are spilled to disk
+func (s stateStorage[AC, OC, JC]) spilledJobCount(state string) int {
+	if q, ok := s.spills[state]; ok {
+		return q.count
+	}
+	return 0
 }
 
-func (s stateStorage[AC, OC, JC]) processJob(job Job[JC]) {
-	if s.isTerminal(job) {
-		s.completeJob(job)
-		return
+func (s stateStorage[AC, OC, JC]) spillJob(job Job[JC]) {
+	q, ok := s.spills[job.State]
+	if !ok {
+		q = newSpillQueue[JC](s.spillDir, job.State)
+		s.spills[job.State] = q
 	}
+	if err := q.push(job); err != nil {
+		s.spillFailed(fmt.Errorf("spilling waiting job %s in state %s: %w", job.Id, job.State, err))
+	}
+}
 
-	if s.canRunJobForState(job.State) {
-		s.runJob(job)
+// pageInJobs moves the oldest of the state's spilled jobs back into memory once it has no other waiting jobs
+func (s stateStorage[AC, OC, JC]) pageInJobs(state string) {
+	if s.spilledJobCount(state) == 0 || s.stateWaitingJobsMap[state].len() > 0 {
+		return
+	}
+	jobs, err := s.spills[state].pop(s.spillThreshold)
+	if err != nil {
+		s.spillFailed(fmt.Errorf("reading spilled waiting jobs for state %s: %w", state, err))
 		return
 	}
+	s.stateWaitingJobsMap[state].replace(jobs)
+}
 
-	s.queueJob(job)
+// waitingJobs returns the state's waiting jobs, oldest first
+func (s stateStorage[AC, OC, JC]) waitingJobs(state string) []Job[JC] {
+	jobs := s.stateWaitingJobsMap[state].all()
+
+	if s.spilledJobCount(state) > 0 {
+		spilled, err := s.spills[state].peek()
+		if err != nil {
+			s.spillFailed(fmt.Errorf("reading spilled waiting jobs for state %s: %w", state, err))
+			return jobs
+		}
+		jobs = append(jobs, spilled...)
+	}
+	return jobs
 }
 
-func (s stateStorage[AC, OC, JC]) isTerminal(job Job[JC]) bool {
-	return s.stateMap[job.State].Terminal
+// drainWaiting removes all of the state's waiting jobs and returns them, oldest first
+func (s stateStorage[AC, OC, JC]) drainWaiting(state string) []Job[JC] {
+	jobs := s.waitingJobs(state)
+
+	s.stateWaitingJobsMap[state].replace(nil)
+	if q, ok := s.spills[state]; ok {
+		if err := q.close(); err != nil {
+			s.logger.Warn("CloseSpillFailed", "state", state, "error", err)
+		}
+	}
+	s.stateStatusMap[state].Waiting -= len(jobs)
+	for _, job := range jobs {
+		delete(s.retries, job.Id)
+		s.unrefuseJob(job.Id)
+	}
+	return jobs
 }
 
-func (s stateStorage[AC, OC, JC]) allJobsAreTerminal(r *Run[OC, JC]) bool {
-	for _, job := range r.Jobs {
-		if !s.isTerminal(job) {
-			return false
+// closeSpills removes any spill files, eg when processing stops early. The jobs in them are still in the run.
+func (s stateStorage[AC, OC, JC]) closeSpills() {
+	for state, q := range s.spills {
+		if err := q.close(); err != nil {
+			s.logger.Warn("CloseSpillFailed", "state", state, "error", err)
 		}
 	}
-	return true
 }
 
-func (s stateStorage[AC, OC, JC]) runNextWaitingJob(state string) {
-	// One less job is executing for the prior state
-	s.stateStatusMap[state].Executing -= 1
+// recordAttempt updates the metrics of the state a job was executed in once its Exec has finished
+func (s stateStorage[AC, OC, JC]) recordAttempt(id string, priorState string, nextState string, err error) {
+	status := s.stateStatusMap[priorState]
+	status.Executed += 1
+	if err != nil {
+		status.Errored += 1
+	}
 
-	// There are no waiting jobs for the state, so we have nothing to queue
-	waitingJobCount := len(s.stateWaitingJobsMap[state])
-	if waitingJobCount == 0 {
+	if nextState == priorState {
+		if err != nil {
+			s.retries[id] += 1
+		}
 		return
 	}
+	status.Retries.add(s.retries[id])
+	delete(s.retries, id)
+}
 
-	job := s.stateWaitingJobsMap[state][waitingJobCount-1]
-	s.stateWaitingJobsMap[state] = s.stateWaitingJobsMap[state][0 : waitingJobCount-1]
-	s.stateStatusMap[job.State].Waiting -= 1
-
-	s.runJob(job)
+// rateLimited tracks a worker of the state starting or finishing waiting on the state's rate limiter
+func (s stateStorage[AC, OC, JC]) rateLimited(state string, waiting bool) {
+	if waiting {
+		s.stateStatusMap[state].RateLimited += 1
+	} else {
+		s.stateStatusMap[state].RateLimited -= 1
+	}
 }
 
-func (s stateStorage[AC, OC, JC]) canRunJobForState(state string) bool {
-	return s.stateStatusMap[state].Executing < s.stateMap[state].Concurrency
+// refuseJob marks a job as retrying in its state after ErrQueueFull, see State.MaxWaiting
+func (s stateStorage[AC, OC, JC]) refuseJob(job Job[JC]) {
+	s.refused[job.Id] = job.State
+	s.refusedWaiting[job.State] += 1
 }
 
-func (s stateStorage[AC, OC, JC]) hasExecutingJobs() bool {
-	for _, value := range s.stateStatusMap {
-		if value.Executing > 0 {
-			return true
-		}
+// unrefuseJob stops treating a job as retrying after ErrQueueFull, once it has left its state's queue
+func (s stateStorage[AC, OC, JC]) unrefuseJob(id string) {
+	state, ok := s.refused[id]
+	if !ok {
+		return
 	}
-
-	return false
+	delete(s.refused, id)
+	s.refusedWaiting[state] -= 1
 }
 
-func (s stateStorage[AC, OC, JC]) getStatusCounts() []StatusCount {
-	ret := make([]StatusCount, 0)
-	for _, name := range s.sortedStateNames {
-		ret = append(ret, *s.stateStatusMap[name])
+// removeWaiting takes the job out of its state's waiting jobs in memory, reporting whether it was there.
+// Jobs that are executing, held on a timer or spilled to disk aren't.
+func (s stateStorage[AC, OC, JC]) removeWaiting(job Job[JC]) bool {
+	q := s.stateWaitingJobsMap[job.State]
+	i := q.index(job.Id)
+	if i == -1 {
+		return false
 	}
-	return ret
+	q.remove(i)
+	s.stateStatusMap[job.State].Waiting -= 1
+	delete(s.retries, job.Id)
+	s.unrefuseJob(job.Id)
+	return true
 }
 
-// Serializer is an interface that defines how to serialize and deserialize job contexts.
+// queuedWaiting counts the jobs waiting in the state that are held against its MaxWaiting. Jobs retrying
+// after ErrQueueFull aren't, as otherwise a state kicking into itself could refuse its own jobs forever.
+func (s stateStorage[AC, OC, JC]) queuedWaiting(state string) int {
+	return s.stateStatusMap[state].Waiting - s.refusedWaiting[state]
+}
 
-// Processor executes a job
-type Processor[AC any, OC any, JC any] struct {
-	appContext     AC
-	serializer     Serializer[OC, JC]
-	stateStorage   stateStorage[AC, OC, JC]
-	statusListener StatusListener
-	returnChan     chan Return[JC]
-	wg             sync.WaitGroup
+// holdJob counts a job held on a timer, eg by a delay state, as waiting in its state
+func (s stateStorage[AC, OC, JC]) holdJob(job Job[JC]) {
+	s.stateStatusMap[job.State].Waiting += 1
 }
 
-// Return is a struct that contains a job and a list of kick requests
-// that is used for returning job updates to the system
-type Return[JC any] struct {
-	PriorState   string
-	Job          Job[JC]
-	KickRequests []KickRequest[JC]
+// releaseJob stops counting a held job as waiting in the state it was held in
+func (s stateStorage[AC, OC, JC]) releaseJob(state string) {
+	s.stateStatusMap[state].Waiting -= 1
 }
 
-func NewProcessor[AC any, OC any, JC any](ac AC, states []State[AC, OC, JC], serializer Serializer[OC, JC], statusListener StatusListener) (*Processor[AC, OC, JC], error) {
-	p := &Processor[AC, OC, JC]{
-		appContext:     ac,
-		stateStorage:   newStateStorageFromStates(states),
-		serializer:     serializer,
-		statusListener: statusListener,
+// unfinishedJobs counts the jobs waiting or executing in any state that isn't terminal, including jobs held
+// on a timer or spilled to disk
+func (s stateStorage[AC, OC, JC]) unfinishedJobs() int {
+	unfinished := 0
+	for _, status := range s.stateStatusMap {
+		if !status.Terminal {
+			unfinished += status.Waiting + status.Executing
+		}
 	}
+	return unfinished
+}
 
-	if err := p.stateStorage.validate(); err != nil {
-		return nil, err
-	}
+func (s stateStorage[AC, OC, JC]) completeJob(job Job[JC]) {
+	s.stateStatusMap[job.State].complete(1)
+}
 
-	return p, nil
+// completeSummarised counts the terminal jobs the run only kept a count of as completed, see
+// Run.TerminalSummary. Counts for states that aren't terminal here are ignored.
+func (s stateStorage[AC, OC, JC]) completeSummarised(r *Run[OC, JC]) {
+	for state, count := range r.terminalSummary() {
+		if status, ok := s.stateStatusMap[state]; ok && status.Terminal {
+			status.complete(count)
+		}
+	}
 }
 
-func (p *Processor[AC, OC, JC]) init() {
-	if p.serializer == nil {
-		p.serializer = &NilSerializer[OC, JC]{}
+func (s stateStorage[AC, OC, JC]) processJob(job Job[JC]) {
+	if s.isTerminal(job) {
+		s.completeJob(job)
+		return
 	}
-	if p.statusListener == nil {
-		p.statusListener = &NilStatusListener{}
+
+	// Jobs that are already waiting go first
+	if s.canRunJobForState(job.State) && s.stateWaitingJobsMap[job.State].len() == 0 && s.spilledJobCount(job.State) == 0 && s.resourceAvailable(job) && s.weightAvailable(job) {
+		s.runJob(job)
+		return
 	}
 
-	// This is by-design unbuffered
-	p.returnChan = make(chan Return[JC])
+	s.queueJob(job)
 }
 
-// Exec this big work function, this does all the crunching
+// retryJob runs a job being retried with RetryFront placement, or queues it ahead of the jobs already
+// waiting if it can't run yet. It goes into memory even if the state's waiting jobs are spilling to disk.
+func (s stateStorage[AC, OC, JC]) retryJob(job Job[JC]) {
+	if s.canRunJobForState(job.State) && s.resourceAvailable(job) && s.weightAvailable(job) {
+		s.runJob(job)
+		return
+	}
+	s.stateStatusMap[job.State].Waiting += 1
+	s.stateWaitingJobsMap[job.State].pushFront(job)
+}
+
+func (s stateStorage[AC, OC, JC]) isTerminal(job Job[JC]) bool {
+	return s.stateMap[job.State].Terminal
+}
+
+// isFailureState reports whether the state is where some state sends the jobs it fails, ie its FailureState
+// or TimeoutState
+func (s stateStorage[AC, OC, JC]) isFailureState(name string) bool {
+	for _, state := range s.states {
+		if state.FailureState == name || state.timeoutState() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// terminalStateNames returns the terminal states in the order they were declared
+func (s stateStorage[AC, OC, JC]) terminalStateNames() []string {
+	names := []string{}
+	for _, state := range s.states {
+		if state.Terminal {
+			names = append(names, state.TriggerState)
+		}
+	}
+	return names
+}
+
+// countNonTerminalJobs counts the run's jobs that aren't terminal when Exec starts. From then on the count is
+// kept up with addNonTerminalJobs as jobs are added to the run, finish or are removed from it.
+func (s stateStorage[AC, OC, JC]) countNonTerminalJobs(r *Run[OC, JC]) {
+	n := 0
+	r.ForEachJob(func(job Job[JC]) {
+		if !s.isTerminal(job) {
+			n++
+		}
+	})
+	*s.nonTerminalJobs = n
+}
+
+// addNonTerminalJobs adds n, which is negative for jobs that have finished, to the count of the run's jobs
+// that aren't terminal
+func (s stateStorage[AC, OC, JC]) addNonTerminalJobs(n int) {
+	*s.nonTerminalJobs += n
+}
+
+func (s stateStorage[AC, OC, JC]) allJobsAreTerminal() bool {
+	return *s.nonTerminalJobs == 0
+}
+
+func (s stateStorage[AC, OC, JC]) runNextWaitingJob(state string) {
+	s.jobFinished(state)
+	s.runWaitingJobs(state)
+}
+
+// execFinished records that the job is no longer executing in the state, freeing up everything it held. It
+// reports whether that made room under a limit shared across states, MaxConcurrency or a resource key, which
+// may let jobs in any state run.
+func (s stateStorage[AC, OC, JC]) execFinished(state string, id string) bool {
+	shared := s.maxConcurrency > 0 && s.executingJobs() >= s.maxConcurrency
+	if _, ok := s.jobResources[id]; ok {
+		shared = true
+	}
+
+	s.jobFinished(state)
+	s.resourceFinished(id)
+	s.weightFinished(state, id)
+	delete(s.executingIds, id)
+	return shared
+}
+
+// jobFinished frees up the capacity a job was using in the state it executed in
+func (s stateStorage[AC, OC, JC]) jobFinished(state string) {
+	s.stateStatusMap[state].Executing -= 1
+}
+
+// resourceFinished releases the resource key held by a job that has finished executing
+func (s stateStorage[AC, OC, JC]) resourceFinished(id string) {
+	key, ok := s.jobResources[id]
+	if !ok {
+		return
+	}
+	delete(s.jobResources, id)
+	s.resources[key] -= 1
+	if s.resources[key] == 0 {
+		delete(s.resources, key)
+	}
+}
+
+// weightFinished frees up the weight held by a job that has finished executing
+func (s stateStorage[AC, OC, JC]) weightFinished(state string, id string) {
+	weight, ok := s.jobWeights[id]
+	if !ok {
+		return
+	}
+	delete(s.jobWeights, id)
+	s.weights[state] -= weight
+}
+
+// jobWeight is how much of its state's Concurrency the job uses, see State.Weight
+func (s stateStorage[AC, OC, JC]) jobWeight(job Job[JC]) int {
+	state := s.stateMap[job.State]
+	if state.Weight == nil {
+		return 1
+	}
+	return min(max(state.Weight(job.C), 1), state.Concurrency)
+}
+
+// weightAvailable reports whether the job's state has room for the job's weight
+func (s stateStorage[AC, OC, JC]) weightAvailable(job Job[JC]) bool {
+	if s.stateMap[job.State].Weight == nil {
+		return true
+	}
+	return s.weights[job.State]+s.jobWeight(job) <= s.stateMap[job.State].Concurrency
+}
+
+// jobResourceKey is the resource key the job contends on, or empty if it isn't limited
+func (s stateStorage[AC, OC, JC]) jobResourceKey(job Job[JC]) string {
+	if s.resourceKey == nil {
+		return ""
+	}
+	return s.resourceKey(job.C)
+}
+
+// resourceAvailable reports whether the job's resource key has room for another executing job
+func (s stateStorage[AC, OC, JC]) resourceAvailable(job Job[JC]) bool {
+	key := s.jobResourceKey(job)
+	return key == "" || s.resources[key] < s.resourceLimit
+}
+
+// runWaitingJobs starts waiting jobs for the state until it is out of capacity or out of waiting jobs
+// that can run
+func (s stateStorage[AC, OC, JC]) runWaitingJobs(state string) {
+	for s.canRunJobForState(state) {
+		// There are no waiting jobs for the state, so we have nothing to queue
+		s.pageInJobs(state)
+		waiting := s.stateWaitingJobsMap[state]
+		if waiting.len() == 0 {
+			return
+		}
+
+		var idx int
+		if s.stateMap[state].FairByParent {
+			idx = s.nextFairJobIndex(state)
+		} else {
+			idx = s.nextWaitingJobIndex(state)
+		}
+		// Every waiting job is parked until its resource key frees up
+		if idx == -1 {
+			return
+		}
+		// The next job is too heavy for the room left, so it waits for jobs to finish rather than letting
+		// lighter jobs behind it keep taking the room
+		if !s.weightAvailable(waiting.at(idx)) {
+			return
+		}
+		if s.stateMap[state].FairByParent {
+			s.lastParents[state] = waiting.at(idx).ParentId()
+		}
+
+		job := waiting.remove(idx)
+		s.stateStatusMap[job.State].Waiting -= 1
+
+		s.runJob(job)
+	}
+}
+
+// nextWaitingJobIndex picks the oldest of the state's waiting jobs whose resource key is available, or
+// -1 if there isn't one
+func (s stateStorage[AC, OC, JC]) nextWaitingJobIndex(state string) int {
+	waiting := s.stateWaitingJobsMap[state]
+	for i := 0; i < waiting.len(); i++ {
+		if s.resourceAvailable(waiting.at(i)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// nextFairJobIndex picks the waiting job to run next in a FairByParent state. Parents take turns in order of
+// their ids, starting after the parent of the last job run, and each parent's own jobs run oldest first.
+// Jobs whose resource key isn't available are skipped, and -1 is returned if that leaves none.
+// This favours simplicity over efficiency by scanning all the waiting jobs.
+func (s stateStorage[AC, OC, JC]) nextFairJobIndex(state string) int {
+	last := s.lastParents[state]
+	waiting := s.stateWaitingJobsMap[state]
+
+	nextIdx, firstIdx := -1, -1
+	var nextParent, firstParent string
+	// Walk from the oldest job to the newest, so the first job seen for each parent is its oldest
+	for i := 0; i < waiting.len(); i++ {
+		job := waiting.at(i)
+		if !s.resourceAvailable(job) {
+			continue
+		}
+		parent := job.ParentId()
+		if firstIdx == -1 || parent < firstParent {
+			firstIdx, firstParent = i, parent
+		}
+		if parent > last && (nextIdx == -1 || parent < nextParent) {
+			nextIdx, nextParent = i, parent
+		}
+	}
+
+	// Every waiting parent comes at or before the last one, so wrap around to the start
+	if nextIdx == -1 {
+		return firstIdx
+	}
+	return nextIdx
+}
+
+// runAllWaitingJobs starts waiting jobs in every state that has capacity, eg once backpressure is relieved
+func (s stateStorage[AC, OC, JC]) runAllWaitingJobs() {
+	for _, state := range s.sortedStateNames {
+		s.runWaitingJobs(state)
+	}
+}
+
+// runWokenJobs starts waiting jobs in the states a job finishing in state may have made room in, rather than
+// in every state. That's the state itself and, while states keep starting jobs, the states feeding them, as
+// each one that has fewer jobs waiting or executing may have dropped back under its high water mark.
+func (s stateStorage[AC, OC, JC]) runWokenJobs(state string) {
+	woken := []string{state}
+	queued := map[string]bool{state: true}
+	for len(woken) > 0 {
+		next := woken[0]
+		woken = woken[1:]
+		delete(queued, next)
+
+		executing := s.stateStatusMap[next].Executing
+		s.runWaitingJobs(next)
+		if s.stateMap[next].HighWaterMark == 0 || (next != state && s.stateStatusMap[next].Executing == executing) {
+			continue
+		}
+		for upstream := range s.upstreamStates[next] {
+			if !queued[upstream] {
+				queued[upstream] = true
+				woken = append(woken, upstream)
+			}
+		}
+	}
+}
+
+func (s stateStorage[AC, OC, JC]) canRunJobForState(state string) bool {
+	if s.maxConcurrency > 0 && s.executingJobs() >= s.maxConcurrency {
+		return false
+	}
+	return !s.draining && s.stateStatusMap[state].Executing < s.stateMap[state].Concurrency && !s.isBackpressured(state) && s.breakerAllows(state)
+}
+
+// breakerAllows reports whether the state's circuit breaker lets another job execute, moving an open
+// breaker to half open once its cooldown has passed
+func (s stateStorage[AC, OC, JC]) breakerAllows(state string) bool {
+	b, ok := s.breakers[state]
+	if !ok {
+		return true
+	}
+
+	status := s.stateStatusMap[state]
+	if status.Breaker == BreakerOpen && time.Since(b.openedAt) >= s.stateMap[state].BreakerCooldown {
+		status.Breaker = BreakerHalfOpen
+	}
+
+	switch status.Breaker {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		// Only one trial job at a time
+		return status.Executing == 0
+	default:
+		return true
+	}
+}
+
+// recordExecResult updates the state's circuit breaker with the outcome of an Exec, returning
+// true if that opened the breaker
+func (s stateStorage[AC, OC, JC]) recordExecResult(state string, err error) bool {
+	b, ok := s.breakers[state]
+	if !ok {
+		return false
+	}
+
+	status := s.stateStatusMap[state]
+	if err == nil {
+		b.consecutiveErrors = 0
+		status.Breaker = BreakerClosed
+		return false
+	}
+
+	b.consecutiveErrors += 1
+	if status.Breaker == BreakerHalfOpen || (status.Breaker == BreakerClosed && b.consecutiveErrors >= s.stateMap[state].BreakerThreshold) {
+		b.openedAt = time.Now()
+		status.Breaker = BreakerOpen
+		return true
+	}
+	return false
+}
+
+// recordTransition remembers that jobs flow from one state to another
+func (s stateStorage[AC, OC, JC]) recordTransition(from string, to string) {
+	if from == to {
+		return
+	}
+	if s.downstreamStates[from] == nil {
+		s.downstreamStates[from] = map[string]bool{}
+	}
+	s.downstreamStates[from][to] = true
+	if s.upstreamStates[to] == nil {
+		s.upstreamStates[to] = map[string]bool{}
+	}
+	s.upstreamStates[to][from] = true
+}
+
+// isBackpressured reports whether a state this one feeds is over its high water mark and still draining
+func (s stateStorage[AC, OC, JC]) isBackpressured(state string) bool {
+	for downstream := range s.downstreamStates[state] {
+		highWaterMark := s.stateMap[downstream].HighWaterMark
+		status := s.stateStatusMap[downstream]
+		if highWaterMark > 0 && status.Waiting > highWaterMark && status.Executing > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// executingJobs counts the jobs executing across every state
+func (s stateStorage[AC, OC, JC]) executingJobs() int {
+	executing := 0
+	for _, value := range s.stateStatusMap {
+		executing += value.Executing
+	}
+	return executing
+}
+
+func (s stateStorage[AC, OC, JC]) hasExecutingJobs() bool {
+	for _, value := range s.stateStatusMap {
+		if value.Executing > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getStatusCounts returns the counts for every state, sorted by state name unless declarationOrder is set
+func (s stateStorage[AC, OC, JC]) getStatusCounts() []StatusCount {
+	return s.orderStatusCounts(s.stateStatusMap)
+}
+
+// orderStatusCounts lists the counts for every state in the order status updates use
+func (s stateStorage[AC, OC, JC]) orderStatusCounts(counts map[string]*StatusCount) []StatusCount {
+	ret := make([]StatusCount, 0, len(s.states))
+	if s.declarationOrder {
+		for _, state := range s.states {
+			ret = append(ret, *counts[state.TriggerState])
+		}
+		return ret
+	}
+	for _, name := range s.sortedStateNames {
+		ret = append(ret, *counts[name])
+	}
+	return ret
+}
+
+// tagStatusCounts counts the run's jobs with the tag in each state. Only the job counts are filled in, as
+// the other metrics aren't tracked by tag.
+func (s stateStorage[AC, OC, JC]) tagStatusCounts(r *Run[OC, JC], tag string) []StatusCount {
+	counts := map[string]*StatusCount{}
+	for _, state := range s.states {
+		counts[state.TriggerState] = &StatusCount{
+			State:    state.TriggerState,
+			Terminal: state.Terminal,
+		}
+	}
+	r.ForEachJob(func(j Job[JC]) {
+		if !j.HasTag(tag) {
+			return
+		}
+		count := counts[j.State]
+		switch _, executing := s.executingIds[j.Id]; {
+		case count.Terminal:
+			count.complete(1)
+		case executing:
+			count.Executing += 1
+		default:
+			count.Waiting += 1
+		}
+	})
+	return s.orderStatusCounts(counts)
+}
+
+// Serializer is an interface that defines how to serialize and deserialize job contexts.
+
+// Processor executes a job
+type Processor[AC any, OC any, JC any] struct {
+	// SampleRate optionally limits the verbose per-job logging done by workers to a fraction (0 to 1) of
+	// jobs, eg 0.01 to trace 1% of jobs in a huge run. Jobs are sampled by a hash of their id, so the same
+	// jobs are traced across a resume. Errors are always logged. Zero logs every job. Set before calling Exec.
+	SampleRate float64
+
+	// AppContextProvider optionally supplies the app context for each job instead of the one passed to
+	// NewProcessor, eg to hand out clients whose credentials are refreshed during a long run. Workers call it
+	// concurrently before every job and pass the result to PreExec, Exec and PostExec, so it must be safe for
+	// concurrent use, eg by guarding a shared app context that is refreshed in the background with a mutex.
+	// Set before calling Exec.
+	AppContextProvider func() AC
+
+	// PreExec optionally runs before every Exec in every state, eg to refresh credentials in the app context
+	// or to validate the job context. The job context it returns is passed on to Exec. If it returns an error
+	// Exec isn't run, the job keeps the context it had and the error is handled as if Exec had returned it.
+	// Set before calling Exec.
+	PreExec func(ctx context.Context, ac AC, state string, jc JC) (JC, error)
+
+	// PostExec optionally runs after every Exec in every state with the job context and error Exec returned,
+	// and can replace either of them, eg to validate Exec's output or to wrap errors. Set before calling Exec.
+	PostExec func(ctx context.Context, ac AC, state string, jc JC, err error) (JC, error)
+
+	// SpillThreshold optionally bounds how many waiting jobs each state keeps in memory. Beyond that, newer
+	// waiting jobs are spilled to a file in SpillDir and paged back in, still in order, as the state catches
+	// up. FairByParent states only take turns among the waiting jobs in memory. Zero keeps all waiting jobs
+	// in memory. This only bounds the scheduling queues: the run itself still holds every job, spilled or
+	// not, and each checkpoint serializes all of them, so the memory a run takes still grows with its jobs.
+	// If a spill file can't be written or read the run stops and Exec returns ErrSpillFailed. Set before
+	// calling Exec.
+	SpillThreshold int
+
+	// SpillDir is the directory spill files are written to. Defaults to the system temp directory.
+	SpillDir string
+
+	// KeepAlive stops Exec from finishing when every job is terminal, so the processor idles waiting for
+	// jobs to be submitted until Close is called, eg for a long lived job engine behind a server. Exec still
+	// returns straight away if its context is cancelled, see Exec. Set before calling Exec.
+	KeepAlive bool
+
+	// Sink optionally receives each job as it moves into a terminal state. Jobs that were already terminal
+	// when Exec started aren't emitted again. A job may be emitted again if the processor is stopped before
+	// its run is next serialized. If it's an io.Closer, eg a JsonLinesSink, it's closed when Exec finishes.
+	// Set before calling Exec.
+	Sink TerminalSink[JC]
+
+	// Recorder optionally receives a record of the inputs and outputs of every Exec, eg a JsonLinesRecorder,
+	// so an Exec that misbehaved can be replayed later with Replay. Inputs are recorded after PreExec and
+	// outputs before PostExec. Recording copies every job context, so it's best kept for debugging. Set
+	// before calling Exec.
+	Recorder ExecRecorder[OC, JC]
+
+	// MetricsSink optionally receives every transition and completed job as it happens, to feed a metrics
+	// backend, eg a PrometheusMetricsSink. It's called synchronously on the goroutine that schedules every
+	// job, so a sink that blocks, eg on a network call, stalls scheduling for the whole run until it returns.
+	// Buffer or hand off anything slow. Defaults to a NilMetricsSink. Set before calling Exec.
+	MetricsSink MetricsSink
+
+	// EvictTerminal removes jobs from the run once Sink has accepted them, so huge runs don't have to keep
+	// every finished job in memory. Evicted jobs are gone from the serialized run too, and a resumed run only
+	// counts the jobs it still has as Completed. A run with only evicted jobs left is complete.
+	EvictTerminal bool
+
+	// ResourceKey optionally names the external resource a job contends on, eg the customer it belongs to.
+	// At most ResourceLimit jobs with the same key execute at once across all states, and the others wait in
+	// their states until the key frees up, letting jobs behind them with other keys go first. Jobs with an
+	// empty key aren't limited. Jobs spilled to disk aren't considered until the state pages them in.
+	// Set before calling Exec.
+	ResourceKey func(JC) string
+
+	// ResourceLimit is how many jobs with the same ResourceKey may execute at once. Defaults to 1.
+	ResourceLimit int
+
+	// Gauges optionally computes domain metrics from the run, eg total bytes processed summed over the job
+	// contexts, to send to the StatusListener with each status update. The result is set as Gauges on every
+	// StatusCount in the update. It is called on the goroutine scheduling jobs, so keep it quick, and it must
+	// not change the run. Set before calling Exec.
+	Gauges func(r *Run[OC, JC]) map[string]float64
+
+	// StatusInDeclarationOrder sends status updates with the states in the order they were passed to
+	// NewProcessor, eg so a progress table reads in pipeline order, instead of sorted by state name.
+	// Set before calling Exec.
+	StatusInDeclarationOrder bool
+
+	// Logger is where the processor and its workers log to, with the run's name and id added to everything
+	// logged. Defaults to slog.Default(). Set before calling Exec.
+	Logger *slog.Logger
+
+	// MaxConcurrency optionally bounds how many jobs execute at once across every state, on top of each state's
+	// own Concurrency, eg to stay within the memory of the machine. Zero means no bound. Set before calling Exec.
+	MaxConcurrency int
+
+	// MaxRuntime optionally bounds how long Exec runs for, eg for a scheduled batch that has to finish within
+	// its window. Once it has passed no more jobs are started, the jobs already executing are waited for with
+	// their contexts cancelled, the run is checkpointed so a later Exec can resume it, and Exec returns
+	// ErrMaxRuntimeExceeded. Zero means no limit. Set before calling Exec.
+	MaxRuntime time.Duration
+
+	// CheckpointTimeout optionally bounds how long each save of the run may take, eg so a hung network
+	// serializer doesn't hold up Exec returning. Saves are also given up on when Exec's ctx is done, apart
+	// from the final one written as Exec returns, which only CheckpointTimeout can cut short. Only a
+	// ContextSerializer can be interrupted, other serializers always finish their save. Zero means no limit.
+	// Set before calling Exec.
+	CheckpointTimeout time.Duration
+
+	// CheckpointPolicy is which changes to the run get it checkpointed. Defaults to CheckpointEveryTransition.
+	// Set before calling Exec.
+	CheckpointPolicy CheckpointPolicy
+
+	// ShuffleSeed optionally shuffles the order the run's jobs are first enqueued in, reproducibly for the
+	// same seed, eg to shake out order dependent behaviour. Without it jobs are enqueued in the order they
+	// were added to the run, kicked jobs after the job that kicked them. Zero doesn't shuffle. Set before
+	// calling Exec.
+	ShuffleSeed int64
+
+	// Source optionally streams jobs into the run as it goes, for runs with more jobs than fit in memory.
+	// It's called for the next job whenever fewer than SourceWindow jobs are unfinished, and each job it
+	// returns is added to the run in TRIGGER_STATE_NEW, until it returns false. Exec doesn't finish until
+	// it has. Finished jobs stay in the run, so use a Sink with EvictTerminal to keep memory bounded. Exec
+	// starts pulling again each time, so a resumed run's source should skip the jobs it already has, eg the
+	// first Run.NextJobId jobs if that's all it was seeded with. It's called on the goroutine scheduling
+	// jobs. Set before calling Exec.
+	Source func() (JC, bool)
+
+	// SourceWindow is how many unfinished jobs Source keeps the run topped up to, counting jobs kicked from
+	// them. Defaults to defaultSourceWindow. Set before calling Exec.
+	SourceWindow int
+
+	// Reentry is what happens to a job that moves back into TRIGGER_STATE_NEW from another state, eg to
+	// start a job over from scratch after a later state finds its input was stale. Defaults to
+	// ReentryKeepHistory. Set before calling Exec.
+	Reentry ReentryPolicy
+
+	// CancelChildrenOnParentFailure cancels the jobs a job kicked, and everything they kicked in turn, when
+	// it ends in a terminal state that's a FailureState or TimeoutState, eg so a fan out isn't finished for
+	// a parent that can't use it. The cancelled jobs follow their ancestor into its failure state with
+	// ErrParentFailed recorded against the state they were in. Descendants are found by their ids, see
+	// Job.ParentId, so jobs evicted from the run or already terminal are left alone. Waiting jobs are
+	// cancelled straight away, and jobs that are executing or held on a timer are cancelled when they come
+	// back, with whatever they moved to or kicked thrown away. Jobs spilled to disk still run their Exec
+	// once, as they can't be found until they're paged back in. Set before calling Exec.
+	CancelChildrenOnParentFailure bool
+
+	// RecordHistory records every state each job enters in its History, for an audit trail of the path
+	// it took. It's off by default as it grows every job, in memory and in checkpoints, by a string per
+	// transition. Set before calling Exec.
+	RecordHistory bool
+
+	// OnStateDrained is optionally called with a state's name when it runs out of work, ie when the jobs
+	// waiting and executing in it, counting jobs held on a timer, first drop to zero after it has had some,
+	// eg to start setting up whatever comes after it. Jobs can come back into a drained state, eg by looping
+	// back or being kicked into it, and then it's called again when the state next runs out. It's never
+	// called for terminal states. It's called on the goroutine scheduling jobs, so keep it quick and don't
+	// call the processor's methods from it, eg WaitingJobs, as they wait on that goroutine. Set before
+	// calling Exec.
+	OnStateDrained func(state string)
+
+	// MergeKick optionally fills in each kicked job's context from the context of the job that kicked it, eg
+	// to carry a trace id or tenant down to every child without each Exec copying it into its kick requests.
+	// It's called with the parent's context as its Exec returned it and the kick request's context, and
+	// returns the context the kicked job starts with. Set before calling Exec.
+	MergeKick func(parent JC, child JC) JC
+
+	// IdempotencyKey optionally derives a key from a job's context and state for every state with an Exec,
+	// like each state's own IdempotencyKey, eg when the job context has a natural unique id. Transitions
+	// are recorded in the run under the key and skipped once recorded, so a resumed run doesn't repeat
+	// them. A state's own IdempotencyKey takes precedence, and an empty key leaves the transition
+	// unrecorded. Set before calling Exec.
+	IdempotencyKey func(jc JC, state string) string
+
+	appContext     AC
+	terminalStates []string       // extra terminal states to create, see WithTerminalStates
+	concurrency    map[string]int // overrides of the states' Concurrency, see WithConcurrency
+	serializer     Serializer[OC, JC]
+	statusListener StatusListener
+	metrics        *channelMetrics // shared by every Exec, see Metrics
+
+	concurrencyBudget  int                // workers shared out by concurrencyWeights, see WithConcurrencyWeights
+	concurrencyWeights map[string]float64 // each weighted state's share of concurrencyBudget
+
+	// The state of the processor's own Exec, see execution
+	*execution[AC, OC, JC]
+}
+
+// execution is the state of a single Exec: the run's scheduling state, the channels its goroutines talk
+// over and the live controls for it, eg Submit. A processor has an execution of its own, which Exec uses
+// and the live methods act on, and which is reset at the start of each Exec. An Exec started while that one
+// is busy runs on a copy of the processor with a new execution, see Exec, so Execs never share one.
+type execution[AC any, OC any, JC any] struct {
+	// running is whether an Exec is using this execution, guarded by inputM
+	running bool
+
+	// busyStates are the states that have had work since they last drained, see OnStateDrained
+	busyStates map[string]bool
+
+	logger        *slog.Logger
+	metricsSink   MetricsSink
+	stateStorage  stateStorage[AC, OC, JC]
+	statusUpdates *bufferedStatusListener
+	inlineExecs   map[string]*StateExec[AC, OC, JC]
+	returnChan    chan Return[JC]
+	timerChan     chan func()
+	rateLimitChan chan rateLimitEvent
+	events        chan JobEvent[JC]
+	checkpoints   *checkpointer[OC, JC] // set and cleared under inputM, see ResumeSerialization
+	wg            sync.WaitGroup
+
+	// workers tracks the worker goroutines apart from wg, as a cancelled Exec doesn't wait for them
+	workers sync.WaitGroup
+	// stopped is closed once the process goroutine stops taking returns, so workers with a job in hand when
+	// Exec is cancelled drop it rather than waiting forever to hand it back
+	stopped chan struct{}
+
+	// serializationPaused stops the run being checkpointed as it changes, see PauseSerialization
+	serializationPaused atomic.Bool
+
+	// unsavedFinish is whether jobs have finished since the last checkpoint, see CheckpointOnTerminal
+	unsavedFinish bool
+
+	// Live job submission, see Submit and Close
+	submitChan chan KickRequest[JC]
+	closeChan  chan struct{} // closed by Close, made afresh for each Exec under inputM
+	inputM     sync.Mutex
+	streaming  bool          // Submit has been called, so Exec waits for Close before finishing
+	closed     bool          // Close has been called, no more jobs will be submitted
+	finished   bool          // The current Exec has finished and won't accept submitted jobs
+	exited     chan struct{} // Closed when the current Exec stops processing
+
+	// controlChan runs functions on the process goroutine for callers outside it, see control
+	controlChan chan func(r *Run[OC, JC])
+
+	// abort cancels the current Exec when a job returns ErrAbortRun, with the job's error as the cause
+	abort context.CancelCauseFunc
+
+	// sourceExhausted is whether Source has run out of jobs, or there's no Source
+	sourceExhausted bool
+
+	// jobWaiters are the WaitForJob calls waiting on each job id
+	jobWaiters map[string][]chan<- waitedJob[JC]
+
+	// cancelledJobs are the jobs cancelled by CancelChildrenOnParentFailure that haven't been moved to their
+	// ancestor's failure state yet, as they were executing or held on a timer
+	cancelledJobs map[string]cancelledJob
+
+	// lastExecs is when each job's last Exec finished in each state with a MinInterval, by job id and then state
+	lastExecs map[string]map[string]time.Time
+
+	// retryingFront are the jobs being retried in a state with RetryFront placement, mapped to that state,
+	// until they're queued in it
+	retryingFront map[string]string
+}
+
+// cancelledJob is where a job cancelled by CancelChildrenOnParentFailure goes and why
+type cancelledJob struct {
+	state string
+	err   error
+}
+
+// waitedJob is what a WaitForJob call is woken up with
+type waitedJob[JC any] struct {
+	job Job[JC]
+	err error
+}
+
+// newExecution creates an execution that schedules jobs with stateStorage
+func newExecution[AC any, OC any, JC any](stateStorage stateStorage[AC, OC, JC]) *execution[AC, OC, JC] {
+	return &execution[AC, OC, JC]{
+		stateStorage: stateStorage,
+		submitChan:   make(chan KickRequest[JC]),
+		closeChan:    make(chan struct{}),
+		controlChan:  make(chan func(r *Run[OC, JC])),
+		exited:       make(chan struct{}),
+	}
+}
+
+var (
+	// ErrProcessorClosed is returned when submitting a job to a processor after Close has been called
+	ErrProcessorClosed = errors.New("processor is closed to new jobs")
+	// ErrProcessorFinished is returned when submitting a job to a processor whose Exec has already finished
+	ErrProcessorFinished = errors.New("processor has finished processing")
+	// ErrMaxRuntimeExceeded is returned by Exec when it was stopped early by MaxRuntime
+	ErrMaxRuntimeExceeded = errors.New("processor ran past its max runtime")
+	// ErrSpillFailed is wrapped by the error Exec returns when it stopped because a spill file couldn't be
+	// written or read, see Processor.SpillThreshold
+	ErrSpillFailed = errors.New("spilling waiting jobs failed")
+	// ErrJobDrained is returned by WaitForJob when the job was removed from the run by DrainWaiting
+	ErrJobDrained = errors.New("job was drained")
+)
+
+// statusBufferSize is how many status updates can queue up for a slow StatusListener before the
+// oldest are dropped
+const statusBufferSize = 64
+
+// defaultSourceWindow is how many unfinished jobs a Source keeps the run topped up to if there's no
+// SourceWindow
+const defaultSourceWindow = 1000
+
+// Return is a struct that contains a job and a list of kick requests
+// that is used for returning job updates to the system
+type Return[JC any] struct {
+	PriorState   string
+	Job          Job[JC]
+	KickRequests []KickRequest[JC]
+
+	key      string // idempotency key of the input job context, if the prior state has one
+	err      error  // error returned by Exec, if any
+	timedOut bool   // the job ran out of timeouts and was moved to the timeout state
+
+	after    time.Duration // how long to hold the job before queueing it in its next state, eg to delay a retry
+	duration time.Duration // how long the Exec took
+
+	// original is the job as it was before Exec, to retry from if the result can't be queued
+	original Job[JC]
+}
+
+// ErrExecTimeout is recorded against a job when its Exec runs past the state's Timeout
+var ErrExecTimeout = errors.New("exec timed out")
+
+// ErrMaxStateAge is recorded against a job that is failed because it has been retried in a state for
+// longer than the state's MaxStateAge
+var ErrMaxStateAge = errors.New("max state age exceeded")
+
+// ErrParentFailed is recorded against a job cancelled because the job that kicked it, or one of that job's
+// ancestors, failed, see Processor.CancelChildrenOnParentFailure
+var ErrParentFailed = errors.New("parent job failed")
+
+// ErrQueueFull is recorded against a job when the jobs its Exec moved or kicked would take a state over
+// its MaxWaiting
+var ErrQueueFull = errors.New("queue full")
+
+// ErrAbortRun is returned, or wrapped, by an Exec to stop the whole run rather than just failing its job,
+// eg when it finds the credentials have been revoked. The job is left in the state it was in, with the
+// error recorded against it, no more jobs are started, the jobs already executing are waited for with
+// their contexts cancelled, and the run is checkpointed. Exec then returns the error, naming the job.
+var ErrAbortRun = errors.New("run aborted")
+
+// timeoutGracePeriod is how long an Exec has to return after its timeout before it is abandoned
+const timeoutGracePeriod = 100 * time.Millisecond
+
+type progressKey struct{}
+
+// progress holds the latest job context saved by an Exec with SaveProgress
+type progress struct {
+	m     sync.Mutex
+	jc    any
+	saved bool
+}
+
+// SaveProgress records the partially updated job context from within Exec. If Exec times out without
+// returning, the job keeps the last saved context instead of the one Exec started with.
+// It does nothing if the state has no Timeout.
+//
+// jc is kept as it is, not deep copied, so any maps, slices or pointers in it are shared with Exec. Don't
+// change what they hold after saving it unless the job should see those changes too, even if Exec goes on
+// running after its timeout.
+func SaveProgress[JC any](ctx context.Context, jc JC) {
+	p, ok := ctx.Value(progressKey{}).(*progress)
+	if !ok {
+		return
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.jc = jc
+	p.saved = true
+}
+
+type execJobKey struct{}
+
+// execJob identifies the job an Exec is running for
+type execJob struct {
+	id      string
+	attempt int
+}
+
+// withExecJob returns a context for executing the job that JobId and Attempt can read it from
+func withExecJob[JC any](ctx context.Context, j Job[JC]) context.Context {
+	return context.WithValue(ctx, execJobKey{}, execJob{id: j.Id, attempt: j.attempt()})
+}
+
+// JobId returns the id of the job being executed from within Exec, eg to log or key on it without copying it
+// into the job context. Kicked jobs' ids are derived from the job that kicked them, see Job.ParentId. It
+// returns "" outside of Exec.
+func JobId(ctx context.Context) string {
+	j, _ := ctx.Value(execJobKey{}).(execJob)
+	return j.id
+}
+
+// Attempt returns which attempt at the job Exec is making in its state from within Exec, starting at 1 and
+// going up each time Exec returns an error or times out for the job in the state, as counted by its
+// StateErrors. It returns 0 outside of Exec.
+func Attempt(ctx context.Context) int {
+	j, _ := ctx.Value(execJobKey{}).(execJob)
+	return j.attempt
+}
+
+type requeueKey struct{}
+
+// requeue holds the delay requested by an Exec with RequeueAfter
+type requeue struct {
+	m     sync.Mutex
+	after time.Duration
+}
+
+// RequeueAfter asks from within Exec for the job to be held for d before it is queued in the state Exec
+// returns, without using a worker. Use it for polling, eg returning the same state with a delay when
+// something isn't ready yet, rather than busy looping. It is ignored if Exec returns an error, see
+// State.RetryDelay for delaying retries instead.
+func RequeueAfter(ctx context.Context, d time.Duration) {
+	r, ok := ctx.Value(requeueKey{}).(*requeue)
+	if !ok {
+		return
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.after = d
+}
+
+type annotationsKey struct{}
+
+// annotations holds the annotations added by an Exec with Annotate
+type annotations struct {
+	m      sync.Mutex
+	values map[string]string
+}
+
+// Annotate attaches a key/value annotation to the job from within Exec, eg "api_latency_ms" "230", as a
+// diagnostic trail kept apart from the job context. Annotations are saved in Job.Annotations along with
+// the job, whether or not Exec returns an error, and a later annotation with the same key replaces the
+// earlier one.
+func Annotate(ctx context.Context, key string, value string) {
+	a, ok := ctx.Value(annotationsKey{}).(*annotations)
+	if !ok {
+		return
+	}
+	a.m.Lock()
+	defer a.m.Unlock()
+	if a.values == nil {
+		a.values = map[string]string{}
+	}
+	a.values[key] = value
+}
+
+// NewProcessor creates a processor for the states with the given serializer and status listener, either of
+// which may be nil. It's shorthand for NewProcessorWithOptions with WithSerializer and WithStatusListener.
+func NewProcessor[AC any, OC any, JC any](ac AC, states []State[AC, OC, JC], serializer Serializer[OC, JC], statusListener StatusListener) (*Processor[AC, OC, JC], error) {
+	return NewProcessorWithOptions(ac, states, WithSerializer[AC](serializer), WithStatusListener[AC, OC, JC](statusListener))
+}
+
+// NewProcessorWithOptions creates a processor for the states, configured by opts, see Option. It returns a
+// *StateConfigError if the states are misconfigured.
+func NewProcessorWithOptions[AC any, OC any, JC any](ac AC, states []State[AC, OC, JC], opts ...Option[AC, OC, JC]) (*Processor[AC, OC, JC], error) {
+	p := &Processor[AC, OC, JC]{
+		appContext: ac,
+		metrics:    &channelMetrics{},
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.serializer == nil {
+		p.serializer = &NilSerializer[OC, JC]{}
+	}
+	if p.statusListener == nil {
+		p.statusListener = &NilStatusListener{}
+	}
+
+	states, err := weighConcurrency(states, p.concurrencyBudget, p.concurrencyWeights)
+	if err != nil {
+		return nil, err
+	}
+	states, err = overrideConcurrency(states, p.concurrency)
+	if err != nil {
+		return nil, err
+	}
+	states, err = adaptExecCs(states)
+	if err != nil {
+		return nil, err
+	}
+	stateStorage := newStateStorageFromStates(states, p.terminalStates...)
+	if err := stateStorage.validate(); err != nil {
+		return nil, err
+	}
+	p.execution = newExecution(stateStorage)
+
+	return p, nil
+}
+
+// adaptExecCs returns a copy of the states with each ExecC wrapped up as an Exec, so the rest of the processor
+// only deals with Exec, leaving the states passed in alone
+func adaptExecCs[AC any, OC any, JC any](states []State[AC, OC, JC]) ([]State[AC, OC, JC], error) {
+	adapted := slices.Clone(states)
+	for i, state := range adapted {
+		if state.Exec != nil && state.ExecC != nil {
+			return nil, configError(state.TriggerState, ErrConflictingExec, "state %s has both an Exec and an ExecC", state.TriggerState)
+		}
+		adapted[i].Exec = state.exec()
+	}
+	return adapted, nil
+}
+
+// weighConcurrency returns a copy of the states with the Concurrency of the weighted states replaced by their
+// share of budget, see WithConcurrencyWeights, leaving the states passed in untouched. Shares are rounded down
+// and what's left of the budget goes to the states that lost the most to rounding, so they add up to budget,
+// but every weighted state gets at least one worker.
+func weighConcurrency[AC any, OC any, JC any](states []State[AC, OC, JC], budget int, weights map[string]float64) ([]State[AC, OC, JC], error) {
+	if len(weights) == 0 {
+		return states, nil
+	}
+	if budget < 1 {
+		return nil, configError("", ErrNoConcurrency, "concurrency budget %d isn't positive", budget)
+	}
+
+	// Sorted, so the same misconfiguration always gets the same error
+	names := make([]string, 0, len(weights))
+	for name := range weights {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var total float64
+	for _, name := range names {
+		i := slices.IndexFunc(states, func(s State[AC, OC, JC]) bool {
+			return s.TriggerState == name
+		})
+		if i == -1 {
+			return nil, configError(name, ErrUnknownState, "concurrency weight for unknown state %s", name)
+		}
+		if states[i].Terminal || states[i].isDelay() {
+			return nil, configError(name, ErrInvalidWeight, "state %s has no workers to weigh", name)
+		}
+		weight := weights[name]
+		if !(weight > 0) || math.IsInf(weight, 1) {
+			return nil, configError(name, ErrInvalidWeight, "state %s has concurrency weight %v", name, weight)
+		}
+		total += weight
+	}
+
+	states = slices.Clone(states)
+	type share struct {
+		i        int
+		fraction float64
+	}
+	var shares []share
+	left := budget
+	for i, state := range states {
+		weight, ok := weights[state.TriggerState]
+		if !ok {
+			continue
+		}
+		exact := float64(budget) * weight / total
+		states[i].Concurrency = max(int(exact), 1)
+		left -= states[i].Concurrency
+		shares = append(shares, share{i: i, fraction: exact - math.Floor(exact)})
+	}
+	// Stable, so ties go to the state declared first
+	slices.SortStableFunc(shares, func(a, b share) int {
+		return cmp.Compare(b.fraction, a.fraction)
+	})
+	for _, share := range shares[:max(min(left, len(shares)), 0)] {
+		states[share.i].Concurrency++
+	}
+	return states, nil
+}
+
+// overrideConcurrency returns a copy of the states with their Concurrency replaced by overrides, leaving the
+// states passed in untouched so they can be shared between processors
+func overrideConcurrency[AC any, OC any, JC any](states []State[AC, OC, JC], overrides map[string]int) ([]State[AC, OC, JC], error) {
+	if len(overrides) == 0 {
+		return states, nil
+	}
+	states = slices.Clone(states)
+	for name, concurrency := range overrides {
+		i := slices.IndexFunc(states, func(s State[AC, OC, JC]) bool {
+			return s.TriggerState == name
+		})
+		if i == -1 {
+			return nil, configError(name, ErrUnknownState, "concurrency override for unknown state %s", name)
+		}
+		states[i].Concurrency = concurrency
+	}
+	return states, nil
+}
+
+func (p *Processor[AC, OC, JC]) init(r *Run[OC, JC]) {
+	p.logger = p.Logger
+	if p.logger == nil {
+		p.logger = slog.Default()
+	}
+	p.metricsSink = p.MetricsSink
+	if p.metricsSink == nil {
+		p.metricsSink = NilMetricsSink{}
+	}
+	// Everything the processor and its workers log carries the run, so the logs of runs that share a name
+	// can be told apart
+	p.logger = p.logger.With("run", r.Name, "runId", r.Id)
+
+	// This is by-design unbuffered
+	p.returnChan = make(chan Return[JC])
+	p.stopped = make(chan struct{})
+	p.timerChan = make(chan func())
+	p.rateLimitChan = make(chan rateLimitEvent)
+
+	p.stateStorage.spillThreshold = p.SpillThreshold
+	p.stateStorage.spillFailed = p.spillFailed
+	p.stateStorage.spillDir = p.SpillDir
+	if p.stateStorage.spillDir == "" {
+		p.stateStorage.spillDir = os.TempDir()
+	}
+
+	// Every Exec starts from scratch, so the same processor can run one run after another
+	p.stateStorage.reset()
+	p.stateStorage.countNonTerminalJobs(r)
+	p.stateStorage.declarationOrder = p.StatusInDeclarationOrder
+	p.stateStorage.maxConcurrency = p.MaxConcurrency
+	p.stateStorage.logger = p.logger
+	p.stateStorage.metrics = p.metrics
+	p.inlineExecs = map[string]*StateExec[AC, OC, JC]{}
+	p.busyStates = map[string]bool{}
+	p.sourceExhausted = p.Source == nil
+	p.jobWaiters = map[string][]chan<- waitedJob[JC]{}
+	p.lastExecs = map[string]map[string]time.Time{}
+	p.cancelledJobs = map[string]cancelledJob{}
+	p.unsavedFinish = false
+	p.retryingFront = map[string]string{}
+	p.stateStorage.resourceKey = p.ResourceKey
+	p.stateStorage.resourceLimit = max(p.ResourceLimit, 1)
+
+	// Status updates are delivered from their own goroutine so a slow listener can't stall scheduling
+	listener := p.statusListener
+	if l, ok := listener.(RunStatusListener[OC, JC]); ok {
+		listener = withRun[OC, JC]{listener: l, run: r}
+	}
+	p.statusUpdates = newBufferedStatusListener(listener, statusBufferSize)
+
+	p.inputM.Lock()
+	if p.finished {
+		p.exited = make(chan struct{})
+		p.finished = false
+		// Submit and Close only applied to the Exec that has finished, so this one starts open again. A Close
+		// before the processor's first Exec still applies to it.
+		p.streaming = false
+		p.closed = false
+		p.closeChan = make(chan struct{})
+	}
+	p.inputM.Unlock()
+}
+
+// Exec this big work function, this does all the crunching
+//
+// Once Exec has returned the processor can Exec another run, eg to push many runs through the same configured
+// processor one after another. Each Exec starts from scratch, with zeroed status counts.
+//
+// If ctx is cancelled Exec stops starting jobs and returns straight away, checkpointing the run as it stands.
+// It doesn't wait for the Execs in progress, which may still be running once it has returned. What they
+// return is dropped, so those jobs run again when the run is resumed. MaxRuntime and ErrAbortRun do wait
+// for them.
+//
+// Exec can also be called again while it's running, to process independent runs at the same time with the
+// same configuration. Each run gets its own workers and scheduling state. The serializer, status listener and
+// Metrics are shared though, so give concurrent runs a serializer that saves each run somewhere of its own,
+// eg by Run.Name, and expect status updates from every run. The live methods, eg Submit, Close, Events and
+// WaitingJobs, only act on an Exec started while no other was running, as the others have no way to be told
+// apart, so use a processor per run if each needs them.
+// Likewise KeepAlive only stops that Exec from finishing, the others finish once their jobs are terminal.
 func (p *Processor[AC, OC, JC]) Exec(ctx context.Context, r *Run[OC, JC]) error {
-	p.init()
+	p.inputM.Lock()
+	busy := p.running
+	p.running = true
+	p.inputM.Unlock()
+	if busy {
+		return p.withNewExecution().exec(ctx, r)
+	}
+
+	defer func() {
+		p.inputM.Lock()
+		p.running = false
+		p.inputM.Unlock()
+	}()
+	return p.exec(ctx, r)
+}
+
+// withNewExecution returns a copy of the processor with an execution of its own, for an Exec started while
+// the processor's own execution is busy. The copy shares the processor's configuration and Metrics.
+func (p *Processor[AC, OC, JC]) withNewExecution() *Processor[AC, OC, JC] {
+	c := *p
+	c.execution = newExecution(newStateStorageFromStates(p.stateStorage.states))
+	c.running = true
+	return &c
+}
+
+// exec does the work of Exec using the processor's execution
+func (p *Processor[AC, OC, JC]) exec(ctx context.Context, r *Run[OC, JC]) error {
+	// Runs that weren't made with NewRun or deserialized by a JsonSerializer, eg struct literals, still need
+	// their id
+	r.Init()
+	p.init(r)
+	if err := p.ValidateRun(r); err != nil {
+		p.finishWithoutProcessing()
+		return err
+	}
+	p.warnUnreachableStates(r)
+	r.setTerminalStates(p.stateStorage.terminalStateNames())
+
+	if p.isComplete(r) {
+		// Send one status update so that if there are listeners they can render the correct values
+		for _, job := range r.Jobs {
+			p.stateStorage.completeJob(job)
+		}
+		p.stateStorage.completeSummarised(r)
+		p.updateStatus(r)
+		p.finishWithoutProcessing()
+		p.logger.Info("AllJobsTerminal")
+		return nil
+	}
+
+	setUp, err := p.setUpStates(ctx, r)
+	// Teardown still runs if processing is cancelled, so it shouldn't be cut short by it
+	defer p.tearDownStates(context.WithoutCancel(ctx), r, setUp)
+	if err != nil {
+		p.finishWithoutProcessing()
+		return err
+	}
+
+	ctx, p.abort = context.WithCancelCause(ctx)
+	defer p.abort(nil)
+	if p.MaxRuntime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, p.MaxRuntime, ErrMaxRuntimeExceeded)
+		defer cancel()
+	}
+
+	// create the workers
+	for _, s := range p.stateStorage.states {
+		// Terminal states don't need to recieve jobs, they're just done, and delay states only hold them
+		if s.Terminal || s.isDelay() {
+			continue
+		}
+		// Inline states are executed by the process goroutine itself
+		if s.Inline {
+			p.inlineExecs[s.TriggerState] = p.newStateExec(ctx, s, r.Overall, 0, &p.workers)
+			continue
+		}
+
+		p.execFunc(ctx, s, r.Overall, &p.workers)
+	}
+
+	pprof.Do(ctx, pprof.Labels("type", "main"), func(ctx context.Context) {
+		p.wg.Add(1)
+		go p.process(ctx, r, &p.wg)
+	})
+
+	p.wg.Wait()
+	// A plain cancel doesn't wait for Execs still in progress, they may be ignoring ctx. Otherwise nothing is
+	// executing by now and the workers stop as soon as they see their channels closed.
+	if ctx.Err() == nil || drainsOnCancel(ctx) {
+		p.workers.Wait()
+	}
+
+	if ctx.Err() == nil {
+		p.warnIdleWorkers()
+	}
+	if errors.Is(context.Cause(ctx), ErrMaxRuntimeExceeded) {
+		p.logger.Warn("MaxRuntimeExceeded", "maxRuntime", p.MaxRuntime)
+		return ErrMaxRuntimeExceeded
+	}
+	if cause := context.Cause(ctx); errors.Is(cause, ErrAbortRun) || errors.Is(cause, ErrSpillFailed) {
+		return cause
+	}
+	return nil
+}
+
+// finishWithoutProcessing wraps up an Exec that returns before processing starts, so that listeners,
+// Submit callers and Events consumers aren't left waiting
+func (p *Processor[AC, OC, JC]) finishWithoutProcessing() {
+	p.statusUpdates.close()
+	p.stopAcceptingJobs()
+	p.closeEvents()
+}
+
+// setUpStates calls each state's Setup in the order the states were declared, stopping at the first error.
+// It returns the states that were set up, or didn't need to be, which need tearing down whether or not
+// there was an error.
+func (p *Processor[AC, OC, JC]) setUpStates(ctx context.Context, r *Run[OC, JC]) ([]State[AC, OC, JC], error) {
+	var setUp []State[AC, OC, JC]
+	for _, state := range p.stateStorage.states {
+		if state.Setup == nil {
+			setUp = append(setUp, state)
+			continue
+		}
+		if err := state.Setup(ctx, p.appContext, r.OverallContext()); err != nil {
+			p.logger.Error("StateSetupFailed", "state", state.TriggerState, "error", err)
+			return setUp, fmt.Errorf("setting up state %s: %w", state.TriggerState, err)
+		}
+		setUp = append(setUp, state)
+	}
+	return setUp, nil
+}
+
+// tearDownStates calls the Teardown of each of the states that were set up, in reverse order
+func (p *Processor[AC, OC, JC]) tearDownStates(ctx context.Context, r *Run[OC, JC], setUp []State[AC, OC, JC]) {
+	for i := len(setUp) - 1; i >= 0; i-- {
+		if setUp[i].Teardown != nil {
+			setUp[i].Teardown(ctx, p.appContext, r.OverallContext())
+		}
+	}
+}
+
+// maxInvalidJobIds is how many ids ValidateRun lists for each unknown state before summarising the rest
+const maxInvalidJobIds = 10
+
+// ValidateRun checks that every job in the run is in one of the processor's states, eg to catch jobs
+// seeded into a misspelt state before starting. Jobs can be seeded into any state, not just
+// TRIGGER_STATE_NEW, so a run can have several entry points, see AddJobWithState. The error lists the
+// jobs in each unknown state and wraps ErrUnknownState. Exec calls it before doing any work.
+func (p *Processor[AC, OC, JC]) ValidateRun(r *Run[OC, JC]) error {
+	unknown := map[string][]string{}
+	r.ForEachJob(func(j Job[JC]) {
+		if _, ok := p.stateStorage.stateMap[j.State]; !ok {
+			unknown[j.State] = append(unknown[j.State], j.Id)
+		}
+	})
+
+	states := make([]string, 0, len(unknown))
+	for state := range unknown {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+
+	var errs []error
+	for _, state := range states {
+		ids := unknown[state]
+		slices.SortFunc(ids, compareJobIds)
+		listed := strings.Join(ids[:min(len(ids), maxInvalidJobIds)], ", ")
+		if len(ids) > maxInvalidJobIds {
+			listed += fmt.Sprintf(" and %d more", len(ids)-maxInvalidJobIds)
+		}
+		errs = append(errs, fmt.Errorf("jobs %s are in unknown state %s: %w", listed, state, ErrUnknownState))
+	}
+	return errors.Join(errs...)
+}
+
+// warnUnreachableStates logs the states that none of the run's jobs can ever reach, see State.NextStates.
+// They're only warnings since jobs can be submitted into any state.
+func (p *Processor[AC, OC, JC]) warnUnreachableStates(r *Run[OC, JC]) {
+	seeded := map[string]bool{}
+	r.ForEachJob(func(j Job[JC]) {
+		seeded[j.State] = true
+	})
+	for _, state := range p.stateStorage.unreachableStates(seeded) {
+		p.logger.Warn("UnreachableState", "state", state)
+	}
+}
+
+// idleWorkerFactor is how many times more workers than Execs a state has to have had before Exec warns that
+// most of its workers sat idle
+const idleWorkerFactor = 2
+
+// warnIdleWorkers logs a warning for each state that ran far fewer Execs than it has workers, as the rest of
+// its workers sat idle for the whole run and a lower Concurrency would do the same work. It's only a hint, as
+// a later run may have more jobs.
+func (p *Processor[AC, OC, JC]) warnIdleWorkers() {
+	for _, state := range p.stateStorage.states {
+		if state.Terminal || state.isDelay() || state.Inline {
+			continue
+		}
+		executed := p.stateStorage.stateStatusMap[state.TriggerState].Executed
+		suggested := max(executed, 1)
+		if state.Concurrency > idleWorkerFactor*executed && suggested < state.Concurrency {
+			p.logger.Warn("IdleWorkers", "state", state.TriggerState, "concurrency", state.Concurrency, "executed", executed,
+				"suggestedConcurrency", suggested)
+		}
+	}
+}
+
+// seedOrder returns the run's jobs in the order they're first enqueued: in the order they were added, see
+// compareJobIds, or shuffled by ShuffleSeed if it's set. Either way the same run is always enqueued in the
+// same order.
+func (p *Processor[AC, OC, JC]) seedOrder(r *Run[OC, JC]) []Job[JC] {
+	jobs := make([]Job[JC], 0, len(r.Jobs))
+	r.ForEachJob(func(j Job[JC]) {
+		jobs = append(jobs, j)
+	})
+	slices.SortFunc(jobs, func(a, b Job[JC]) int {
+		return compareJobIds(a.Id, b.Id)
+	})
+	if p.ShuffleSeed != 0 {
+		rand.New(rand.NewSource(p.ShuffleSeed)).Shuffle(len(jobs), func(i, j int) {
+			jobs[i], jobs[j] = jobs[j], jobs[i]
+		})
+	}
+	return jobs
+}
+
+// process owns all of the scheduling state and is the only goroutine that changes it, so anything slow it
+// waits on stalls every state. Status updates, events and checkpoints are all handed off to other goroutines,
+// and jobs are only sent to a state's workers when one of them is free to take it straight away.
+func (p *Processor[AC, OC, JC]) process(ctx context.Context, r *Run[OC, JC], wg *sync.WaitGroup) {
+	defer func() {
+		p.shutdown()
+		wg.Done()
+	}()
+
+	// Serializing the whole run can be slow, so it happens off the goroutine scheduling jobs
+	if _, ok := p.serializer.(*NilSerializer[OC, JC]); !ok {
+		p.inputM.Lock()
+		p.checkpoints = newCheckpointer(ctx, p.CheckpointTimeout, p.logger, p.serializer, r)
+		p.inputM.Unlock()
+	}
+
+	// Enqueue the jobs to start
+	p.stateStorage.completeSummarised(r)
+	for _, job := range p.seedOrder(r) {
+		// Jobs that finished in an earlier Exec have already been given to the sink
+		if p.stateStorage.isTerminal(job) {
+			p.stateStorage.completeJob(job)
+			continue
+		}
+		p.enqueue(r, job)
+	}
+	p.pullSource(ctx, r)
+
+	// Send the initial status update with the state of all the jobs
+	p.updateStatus(r)
+
+	// Enqueueing can finish jobs without executing anything, eg by skipping recorded transitions
+	if p.isComplete(r) {
+		return
+	}
+
+	p.inputM.Lock()
+	closeChan := p.closeChan
+	p.inputM.Unlock()
+	for {
+		// Anything that finishes jobs makes room for more from the source
+		if p.pullSource(ctx, r) {
+			p.updateStatus(r)
+			if p.isComplete(r) {
+				return
+			}
+		}
+		// Anything that finishes jobs can start jobs in inline states, so run them before waiting on anything
+		if p.runInlineJobs(ctx, r) && p.isComplete(r) {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			if drainsOnCancel(ctx) {
+				p.drainExecuting(ctx, r)
+			}
+			return
+		case <-closeChan:
+			// No more jobs will be submitted, so we may already be done. Stop selecting on the closed channel.
+			closeChan = nil
+			if p.isComplete(r) {
+				return
+			}
+		case event := <-p.rateLimitChan:
+			p.stateStorage.rateLimited(event.state, event.waiting)
+			p.updateStatus(r)
+		case f := <-p.controlChan:
+			f(r)
+			p.updateStatus(r)
+			if p.isComplete(r) {
+				return
+			}
+		case f := <-p.timerChan:
+			f()
+			p.stateStorage.runAllWaitingJobs()
+			p.updateStatus(r)
+			if p.isComplete(r) {
+				return
+			}
+		case submitted := <-p.submitChan:
+			job := r.addJob(submitted.C, submitted.State)
+			p.stateStorage.addNonTerminalJobs(1)
+			p.enqueue(r, job)
+			p.updateStatus(r)
+			if p.isComplete(r) {
+				return
+			}
+		case completedJob := <-p.returnChan:
+			p.handleReturn(r, completedJob)
+			if p.isComplete(r) {
+				return
+			}
+		}
+	}
+}
+
+// abortRun stops the run because the job's Exec returned ErrAbortRun. Nothing more is started, even before
+// the process goroutine sees ctx is done, so the job waits in its state to run again when the run is resumed.
+func (p *Processor[AC, OC, JC]) abortRun(completedJob Return[JC]) {
+	p.logger.Warn("RunAborted", "job", completedJob.Job.Id, "state", completedJob.PriorState, "error", completedJob.err)
+	p.stateStorage.draining = true
+	p.abort(fmt.Errorf("job %s in state %s: %w", completedJob.Job.Id, completedJob.PriorState, completedJob.err))
+}
+
+// spillFailed stops the run because a spill file couldn't be written or read. Spilled jobs are still in the
+// run, so the final checkpoint has them all to resume from, and Exec returns ErrSpillFailed.
+func (p *Processor[AC, OC, JC]) spillFailed(err error) {
+	p.logger.Error("SpillFailed", "error", err)
+	p.stateStorage.draining = true
+	p.abort(fmt.Errorf("%w: %w", ErrSpillFailed, err))
+}
+
+// pullSource adds jobs from the Source to the run until there are SourceWindow unfinished jobs or it runs
+// out. It reports whether it did anything, ie added jobs or found the source was exhausted.
+func (p *Processor[AC, OC, JC]) pullSource(ctx context.Context, r *Run[OC, JC]) bool {
+	window := p.SourceWindow
+	if window <= 0 {
+		window = defaultSourceWindow
+	}
+	pulled := false
+	for !p.sourceExhausted && ctx.Err() == nil && p.stateStorage.unfinishedJobs() < window {
+		jc, ok := p.Source()
+		if !ok {
+			p.sourceExhausted = true
+			p.logger.Info("SourceExhausted")
+			return true
+		}
+		p.stateStorage.addNonTerminalJobs(1)
+		p.enqueue(r, r.addJob(jc, TRIGGER_STATE_NEW))
+		pulled = true
+	}
+	return pulled
+}
+
+// drainsOnCancel reports whether ctx was cut short by MaxRuntime, ErrAbortRun or a failed spill, which wait
+// for the jobs already executing, rather than by the caller, which doesn't
+func drainsOnCancel(ctx context.Context) bool {
+	cause := context.Cause(ctx)
+	return errors.Is(cause, ErrMaxRuntimeExceeded) || errors.Is(cause, ErrAbortRun) || errors.Is(cause, ErrSpillFailed)
+}
+
+// drainExecuting stops starting jobs once ctx is done and waits for the ones already executing to come back,
+// so the work they finished makes it into the final checkpoint. Jobs whose Exec was cut short by ctx are left
+// as they were, to run again when the run is resumed.
+func (p *Processor[AC, OC, JC]) drainExecuting(ctx context.Context, r *Run[OC, JC]) {
+	p.stateStorage.draining = true
+	// Jobs lined up in inline states haven't started, so they just stay where they are
+	for _, job := range *p.stateStorage.inlineJobs {
+		p.stateStorage.execFinished(job.State, job.Id)
+	}
+	*p.stateStorage.inlineJobs = nil
+	for p.stateStorage.hasExecutingJobs() {
+		select {
+		case event := <-p.rateLimitChan:
+			p.stateStorage.rateLimited(event.state, event.waiting)
+		case completedJob := <-p.returnChan:
+			if completedJob.err != nil && errors.Is(completedJob.err, ctx.Err()) {
+				p.stateStorage.execFinished(completedJob.PriorState, completedJob.Job.Id)
+				continue
+			}
+			p.handleReturn(r, completedJob)
+		}
+	}
+	p.updateStatus(r)
+}
+
+// runInlineJobs executes the jobs lined up in Inline states, and any inline jobs that they lead to, until
+// there are none left or ctx is done. It reports whether it ran anything.
+func (p *Processor[AC, OC, JC]) runInlineJobs(ctx context.Context, r *Run[OC, JC]) bool {
+	ran := false
+	for len(*p.stateStorage.inlineJobs) > 0 && ctx.Err() == nil {
+		job := (*p.stateStorage.inlineJobs)[0]
+		*p.stateStorage.inlineJobs = (*p.stateStorage.inlineJobs)[1:]
+		p.handleReturn(r, p.inlineExecs[job.State].execute(job))
+		ran = true
+	}
+	return ran
+}
+
+// handleReturn records a job that has finished executing in the run and queues it and any jobs it kicked
+func (p *Processor[AC, OC, JC]) handleReturn(r *Run[OC, JC], completedJob Return[JC]) {
+	// If the prior state of the completed job was at capacity, we now have space for one more
+	freedShared := p.stateStorage.execFinished(completedJob.PriorState, completedJob.Job.Id)
+
+	if errors.Is(completedJob.err, ErrAbortRun) {
+		p.abortRun(completedJob)
+	}
+
+	// A cancelled job's Exec was for nothing, so nothing it did is kept, and enqueue fails it
+	if _, ok := p.cancelledJobs[completedJob.Job.Id]; ok {
+		completedJob.Job.State = completedJob.PriorState
+		completedJob.KickRequests = nil
+		completedJob.after = 0
+	}
+
+	if completedJob.timedOut {
+		p.stateStorage.stateStatusMap[completedJob.PriorState].TimedOut += 1
+	}
+	p.stateStorage.recordAttempt(completedJob.Job.Id, completedJob.PriorState, completedJob.Job.State, completedJob.err)
+
+	breakerOpened := p.stateStorage.recordExecResult(completedJob.PriorState, completedJob.err)
+	if breakerOpened {
+		cooldown := p.stateStorage.stateMap[completedJob.PriorState].BreakerCooldown
+		p.logger.Warn("BreakerOpened", "state", completedJob.PriorState, "cooldown", cooldown, "error", completedJob.err)
+		// Wake up once the cooldown is over so the state's waiting jobs get their trial
+		p.after(cooldown, func() {})
+	}
+
+	completedJob = p.limitKicks(completedJob)
+	completedJob = p.limitStateAge(completedJob)
+	completedJob = p.limitWaiting(completedJob)
+
+	p.stateStorage.recordTransition(completedJob.PriorState, completedJob.Job.State)
+	for _, kickRequest := range completedJob.KickRequests {
+		p.stateStorage.recordTransition(completedJob.PriorState, kickRequest.State)
+	}
+
+	// Remember successful transitions out of idempotent states so they aren't repeated
+	if completedJob.key != "" && completedJob.err == nil {
+		r.RecordTransition(completedJob.PriorState, completedJob.key, Transition[JC]{
+			C:     completedJob.Job.C,
+			State: completedJob.Job.State,
+		})
+	}
+
+	completedJob.after = max(completedJob.after, p.paceJob(completedJob))
+
+	if completedJob.err != nil && completedJob.Job.State == completedJob.PriorState &&
+		p.stateStorage.stateMap[completedJob.PriorState].RetryPlacement == RetryFront {
+		p.retryingFront[completedJob.Job.Id] = completedJob.PriorState
+	}
+
+	// Update the run with the new state
+	if completedJob.after > 0 {
+		p.enqueueAfter(r, completedJob.Job, completedJob.after)
+	} else {
+		p.enqueue(r, completedJob.Job)
+	}
+
+	// Start any of the new jobs that need kicking. Their ids are derived from the id of the job that kicked
+	// them, which is how Job.ParentId traces the lineage of a job
+	for idx, kickRequest := range completedJob.KickRequests {
+		if p.MergeKick != nil {
+			kickRequest.C = p.MergeKick(completedJob.Job.C, kickRequest.C)
+		}
+		job := Job[JC]{
+			Id:          fmt.Sprintf("%s->%d", completedJob.Job.Id, idx),
+			C:           kickRequest.C,
+			State:       kickRequest.State,
+			StateErrors: map[string][]string{},
+			Depth:       completedJob.Job.Depth + 1,
+			Tags:        completedJob.Job.Tags,
+		}
+		p.stateStorage.addNonTerminalJobs(1)
+		p.enqueue(r, p.insertKickedJob(r, job))
+	}
+
+	p.metricsSink.JobTransitioned(completedJob.PriorState, completedJob.Job.State, completedJob.duration, completedJob.err)
+	p.emitEvent(JobEvent[JC]{
+		JobId:     completedJob.Job.Id,
+		C:         completedJob.Job.C,
+		FromState: completedJob.PriorState,
+		ToState:   completedJob.Job.State,
+		Err:       completedJob.err,
+		Duration:  completedJob.duration,
+		Kicks:     len(completedJob.KickRequests),
+
+		Annotations: completedJob.Job.Annotations,
+	})
+
+	// Fill the space the completed job left in its prior state. This happens once the job and its kicks
+	// have been queued so that backpressure from the states they landed in is taken into account.
+	// Jobs leaving a state can also bring it back under its high water mark, letting the states feeding it resume.
+	// Only a limit shared across states, eg MaxConcurrency, means every state has to be looked at.
+	if freedShared {
+		p.stateStorage.runAllWaitingJobs()
+	} else {
+		p.stateStorage.runWokenJobs(completedJob.PriorState)
+	}
+
+	p.checkpoint()
+
+	// If we move a job back to the same state and there are no kick requests, no need to see a status
+	// update as the totals will be the same, unless the job errored and changed the state's error rate
+	if completedJob.PriorState != completedJob.Job.State || len(completedJob.KickRequests) > 0 || breakerOpened || completedJob.after > 0 || completedJob.err != nil {
+		p.updateStatus(r)
+	}
+}
+
+// paceJob records when the job's Exec finished in its prior state, for that state's MinInterval, and returns
+// how long the job has to wait before it can go back into the state it's moving to, if it has one
+func (p *Processor[AC, OC, JC]) paceJob(completedJob Return[JC]) time.Duration {
+	id := completedJob.Job.Id
+	if p.stateStorage.stateMap[completedJob.PriorState].MinInterval > 0 {
+		if p.lastExecs[id] == nil {
+			p.lastExecs[id] = map[string]time.Time{}
+		}
+		p.lastExecs[id][completedJob.PriorState] = time.Now()
+	}
+
+	state := p.stateStorage.stateMap[completedJob.Job.State]
+	if state.Terminal {
+		delete(p.lastExecs, id)
+		return 0
+	}
+	last, ok := p.lastExecs[id][state.TriggerState]
+	if state.MinInterval == 0 || !ok {
+		return 0
+	}
+	return max(state.MinInterval-time.Since(last), 0)
+}
+
+// after runs f on the process goroutine once d has passed, unless processing has stopped by then
+func (p *Processor[AC, OC, JC]) after(d time.Duration, f func()) {
+	exited := p.exited
+	time.AfterFunc(d, func() {
+		select {
+		case p.timerChan <- f:
+		case <-exited:
+		}
+	})
+}
+
+// isComplete reports whether processing is done: every job is terminal, nothing is executing, and no
+// more jobs can be submitted
+func (p *Processor[AC, OC, JC]) isComplete(r *Run[OC, JC]) bool {
+	if !p.sourceExhausted || !p.stateStorage.allJobsAreTerminal() || p.stateStorage.hasExecutingJobs() {
+		return false
+	}
+
+	p.inputM.Lock()
+	defer p.inputM.Unlock()
+	return !(p.streaming || p.KeepAlive) || p.closed
+}
+
+// stopAcceptingJobs makes any pending or future Submit calls fail until the next Exec
+func (p *Processor[AC, OC, JC]) stopAcceptingJobs() {
+	p.inputM.Lock()
+	defer p.inputM.Unlock()
+	p.finished = true
+	close(p.exited)
+}
+
+// Submit adds a job in TRIGGER_STATE_NEW to the run that is currently being processed
+func (p *Processor[AC, OC, JC]) Submit(jc JC) error {
+	return p.SubmitWithState(jc, TRIGGER_STATE_NEW)
+}
+
+// SubmitWithState adds a job in the given state to the run that is currently being processed. It blocks
+// until the processor has accepted the job, so it may be called before Exec to wait for processing to start.
+//
+// Once a job has been submitted, Exec no longer finishes as soon as all jobs are terminal, as more jobs
+// may be on their way. Call Close when there is nothing more to submit so that Exec can finish.
+func (p *Processor[AC, OC, JC]) SubmitWithState(jc JC, state string) error {
+	if _, ok := p.stateStorage.stateMap[state]; !ok {
+		return fmt.Errorf("unknown state %s", state)
+	}
+
+	p.inputM.Lock()
+	if p.closed {
+		p.inputM.Unlock()
+		return ErrProcessorClosed
+	}
+	if p.finished {
+		p.inputM.Unlock()
+		return ErrProcessorFinished
+	}
+	p.streaming = true
+	exited := p.exited
+	closeChan := p.closeChan
+	p.inputM.Unlock()
+
+	select {
+	case p.submitChan <- KickRequest[JC]{C: jc, State: state}:
+		return nil
+	case <-closeChan:
+		return ErrProcessorClosed
+	case <-exited:
+		return ErrProcessorFinished
+	}
+}
+
+// control runs f on the process goroutine, where it can safely use the scheduling state, and waits for it
+// to finish. If Exec hasn't started yet it waits for it to.
+func (p *Processor[AC, OC, JC]) control(f func(r *Run[OC, JC])) error {
+	p.inputM.Lock()
+	if p.finished {
+		p.inputM.Unlock()
+		return ErrProcessorFinished
+	}
+	exited := p.exited
+	p.inputM.Unlock()
+
+	done := make(chan struct{})
+	select {
+	case p.controlChan <- func(r *Run[OC, JC]) {
+		defer close(done)
+		f(r)
+	}:
+		<-done
+		return nil
+	case <-exited:
+		return ErrProcessorFinished
+	}
+}
+
+// WaitingJobs returns the jobs waiting to execute in the state, oldest first. Jobs held on a timer, eg in a
+// delay state or waiting out a RetryDelay, aren't included. It is safe to call while Exec is running.
+func (p *Processor[AC, OC, JC]) WaitingJobs(state string) ([]Job[JC], error) {
+	if _, ok := p.stateStorage.stateMap[state]; !ok {
+		return nil, fmt.Errorf("unknown state %s", state)
+	}
+
+	var jobs []Job[JC]
+	err := p.control(func(r *Run[OC, JC]) {
+		jobs = p.stateStorage.waitingJobs(state)
+	})
+	return jobs, err
+}
 
-	if p.stateStorage.allJobsAreTerminal(r) {
-		// Send one status update so that if there are listeners they can render the correct values
-		for _, job := range r.Jobs {
-			p.stateStorage.completeJob(job)
+// ExecutingJobs returns the ids of the jobs executing in each state, sorted, eg to find the jobs whose Exec
+// is hung. States with no executing jobs are left out. It is safe to call while Exec is running.
+func (p *Processor[AC, OC, JC]) ExecutingJobs() (map[string][]string, error) {
+	executing := map[string][]string{}
+	err := p.control(func(r *Run[OC, JC]) {
+		for id, state := range p.stateStorage.executingIds {
+			executing[state] = append(executing[state], id)
 		}
-		p.statusListener.StatusUpdate(p.stateStorage.getStatusCounts())
-		slog.Info("AllJobsTerminal")
-		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	for _, ids := range executing {
+		slices.Sort(ids)
+	}
+	return executing, nil
+}
 
-	// create the workers
-	for _, s := range p.stateStorage.states {
-		// Terminal states don't need to recieve jobs, they're just done
-		if s.Terminal {
-			continue
+// StatusByTag returns the status of the jobs tagged with the tag, see Run.AddJobWithTags, with the states
+// in the same order as status updates. Only Completed, Skipped, Executing and Waiting are counted, and jobs that
+// were handed to a TerminalSink aren't in the run any more so aren't counted. It is safe to call while
+// Exec is running.
+func (p *Processor[AC, OC, JC]) StatusByTag(tag string) ([]StatusCount, error) {
+	var status []StatusCount
+	err := p.control(func(r *Run[OC, JC]) {
+		status = p.stateStorage.tagStatusCounts(r, tag)
+	})
+	return status, err
+}
+
+// DrainWaiting cancels all of the jobs waiting to execute in the state, eg when a whole class of queued
+// work is no longer needed. The drained jobs are removed from the run and returned, oldest first, so they
+// can be recorded or added back later. Jobs already executing aren't affected. It is safe to call while
+// Exec is running.
+func (p *Processor[AC, OC, JC]) DrainWaiting(state string) ([]Job[JC], error) {
+	if _, ok := p.stateStorage.stateMap[state]; !ok {
+		return nil, fmt.Errorf("unknown state %s", state)
+	}
+
+	var jobs []Job[JC]
+	err := p.control(func(r *Run[OC, JC]) {
+		jobs = p.stateStorage.drainWaiting(state)
+		p.stateStorage.addNonTerminalJobs(-len(jobs))
+		p.unsavedFinish = true
+		for _, job := range jobs {
+			r.removeJob(job.Id)
+			p.wakeJobWaiters(job, ErrJobDrained)
 		}
+		p.logger.Info("DrainedWaitingJobs", "state", state, "jobs", len(jobs))
+		p.checkpoint()
+	})
+	return jobs, err
+}
 
-		p.execFunc(ctx, s, r.Overall, &p.wg)
+// ReRoute moves every job waiting to execute in from to to, eg to send jobs stuck behind a broken state
+// down a different path once it's been fixed. The jobs enter to as if Exec had moved them there, and it
+// returns how many were moved. Jobs already executing in from, or held on a timer there, stay put. It is
+// safe to call while Exec is running.
+func (p *Processor[AC, OC, JC]) ReRoute(from string, to string) (int, error) {
+	for _, state := range []string{from, to} {
+		if _, ok := p.stateStorage.stateMap[state]; !ok {
+			return 0, fmt.Errorf("rerouting from %s to %s: %w", from, to, ErrUnknownState)
+		}
+	}
+	if from == to {
+		return 0, fmt.Errorf("rerouting from %s to itself", from)
 	}
 
-	pprof.Do(ctx, pprof.Labels("type", "main"), func(ctx context.Context) {
-		p.wg.Add(1)
-		go p.process(ctx, r, &p.wg)
+	var moved int
+	err := p.control(func(r *Run[OC, JC]) {
+		jobs := p.stateStorage.drainWaiting(from)
+		for _, job := range jobs {
+			job.State = to
+			p.enqueue(r, job)
+		}
+		moved = len(jobs)
+		p.logger.Info("ReRoutedWaitingJobs", "from", from, "to", to, "jobs", moved)
+		p.checkpoint()
 	})
+	return moved, err
+}
 
-	p.wg.Wait()
+// WaitForJob blocks until the job with the id reaches a terminal state and returns it as it was then, eg
+// to wait on a job added with Submit. A job that's already terminal is returned straight away. The job
+// doesn't have to be in the run yet, so it can be waited on before it's kicked or submitted, but then a
+// mistyped id waits until ctx is done. It returns ErrJobDrained if the job is removed by DrainWaiting,
+// ErrProcessorFinished if Exec finishes first, and ctx's error if ctx is done first. It is safe to call
+// while Exec is running.
+func (p *Processor[AC, OC, JC]) WaitForJob(ctx context.Context, id string) (Job[JC], error) {
+	// Buffered so the process goroutine never waits on a caller that has given up
+	woken := make(chan waitedJob[JC], 1)
+	var exited <-chan struct{}
+	err := p.control(func(r *Run[OC, JC]) {
+		exited = p.exited
+		if job, ok := r.JobByID(id); ok && p.stateStorage.isTerminal(job) {
+			woken <- waitedJob[JC]{job: job}
+			return
+		}
+		p.jobWaiters[id] = append(p.jobWaiters[id], woken)
+	})
+	if err != nil {
+		return Job[JC]{}, err
+	}
+
+	select {
+	case w := <-woken:
+		return w.job, w.err
+	case <-ctx.Done():
+		return Job[JC]{}, ctx.Err()
+	case <-exited:
+		// The job may have finished right as Exec did
+		select {
+		case w := <-woken:
+			return w.job, w.err
+		default:
+			return Job[JC]{}, ErrProcessorFinished
+		}
+	}
+}
+
+// wakeJobWaiters hands the job to everything waiting on it in WaitForJob, along with err
+func (p *Processor[AC, OC, JC]) wakeJobWaiters(job Job[JC], err error) {
+	for _, woken := range p.jobWaiters[job.Id] {
+		woken <- waitedJob[JC]{job: job, err: err}
+	}
+	delete(p.jobWaiters, job.Id)
+}
+
+// Close signals that no more jobs will be submitted, letting Exec finish once every job is terminal. It only
+// applies to the current Exec, and each Exec after the first starts open to submitted jobs again.
+func (p *Processor[AC, OC, JC]) Close() {
+	p.inputM.Lock()
+	defer p.inputM.Unlock()
+	if !p.closed {
+		p.closed = true
+		close(p.closeChan)
+	}
+}
+
+// idempotencyKey returns how the state keys its transitions, if it does, see Processor.IdempotencyKey
+func (p *Processor[AC, OC, JC]) idempotencyKey(state State[AC, OC, JC]) func(jc JC) string {
+	switch {
+	case state.IdempotencyKey != nil:
+		return state.IdempotencyKey
+	case p.IdempotencyKey != nil && state.Exec != nil:
+		return func(jc JC) string {
+			return p.IdempotencyKey(jc, state.TriggerState)
+		}
+	}
 	return nil
 }
 
-func (p *Processor[AC, OC, JC]) process(ctx context.Context, r *Run[OC, JC], wg *sync.WaitGroup) {
-	defer func() {
-		p.shutdown()
-		wg.Done()
-	}()
+// enqueue records the job in the run and hands it to the state storage, first skipping over any
+// transitions that were already recorded for idempotent states
+func (p *Processor[AC, OC, JC]) enqueue(r *Run[OC, JC], job Job[JC]) {
+	cancelled, wasCancelled := p.cancelledJobs[job.Id]
+	if wasCancelled {
+		delete(p.cancelledJobs, job.Id)
+		job.recordError(job.State, cancelled.err)
+		job.State = cancelled.state
+	}
 
-	// Enqueue the jobs to start
-	for _, job := range r.Jobs {
+	visited := map[string]bool{}
+	for {
+		keyFunc := p.idempotencyKey(p.stateStorage.stateMap[job.State])
+		if keyFunc == nil {
+			break
+		}
+
+		key := keyFunc(job.C)
+		transition, ok := r.RecordedTransition(job.State, key)
+		if !ok || visited[transitionKey(job.State, key)] {
+			break
+		}
+		visited[transitionKey(job.State, key)] = true
+
+		p.logger.Info("SkippingRecordedTransition", "job", job.Id, "state", job.State, "key", key, "newState", transition.State)
+		job.C = transition.C
+		job.State = transition.State
+	}
+
+	// Jobs from runs saved before StateEnteredAt existed are treated as having just entered their state
+	if current, ok := r.JobByID(job.Id); ok && (current.State != job.State || job.StateEnteredAt == nil) {
+		if current.State != job.State && job.State == TRIGGER_STATE_NEW && p.Reentry == ReentryAsNew {
+			job = job.restart()
+		}
+		job = job.enterState()
+	}
+	if p.RecordHistory {
+		job = job.recordHistory()
+	}
+	if err := r.UpdateJob(job); err != nil {
+		// The job isn't part of the run any more, so scheduling it would do work nobody will see
+		p.logger.Error("UpdateJobFailed", "job", job.Id, "state", job.State, "error", err)
+		return
+	}
+	if p.stateStorage.stateMap[job.State].isDelay() {
+		p.delay(r, job)
+		return
+	}
+	retryState, retrying := p.retryingFront[job.Id]
+	delete(p.retryingFront, job.Id)
+	if retrying && retryState == job.State {
+		p.stateStorage.retryJob(job)
+	} else {
 		p.stateStorage.processJob(job)
 	}
 
-	// Send the initial status update with the state of all the jobs
-	p.updateStatus()
+	if p.stateStorage.isTerminal(job) {
+		// Every job counted as added, including one added straight into a terminal state, gets here once
+		p.stateStorage.addNonTerminalJobs(-1)
+		p.unsavedFinish = true
+		p.wakeJobWaiters(job, nil)
+		p.metricsSink.JobCompleted(job.State)
+		// A cancelled job's descendants were cancelled along with it
+		if p.CancelChildrenOnParentFailure && !wasCancelled && p.stateStorage.isFailureState(job.State) {
+			p.cancelDescendants(r, job)
+		}
+		p.sink(r, job)
+	}
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case completedJob := <-p.returnChan:
-			// If the prior state of the completed job was at capacity, we now have space for one more
-			p.stateStorage.runNextWaitingJob(completedJob.PriorState)
-
-			// Update the run with the new state
-			r.UpdateJob(completedJob.Job)
-			p.stateStorage.processJob(completedJob.Job)
-
-			// Start any of the new jobs that need kicking
-			for idx, kickRequest := range completedJob.KickRequests {
-				job := Job[JC]{
-					Id:          fmt.Sprintf("%s->%d", completedJob.Job.Id, idx),
-					C:           kickRequest.C,
-					State:       kickRequest.State,
-					StateErrors: map[string][]string{},
-				}
-				r.UpdateJob(job)
-				p.stateStorage.processJob(job)
-			}
+// cancelDescendants sends every job descended from the failed job that isn't terminal yet after it into its
+// failure state, see CancelChildrenOnParentFailure
+func (p *Processor[AC, OC, JC]) cancelDescendants(r *Run[OC, JC], failed Job[JC]) {
+	// Kicked ids start with the id of the job that kicked them, so this finds descendants at every depth
+	prefix := failed.Id + "->"
+	var descendants []Job[JC]
+	r.ForEachJob(func(j Job[JC]) {
+		if strings.HasPrefix(j.Id, prefix) && !p.stateStorage.isTerminal(j) {
+			descendants = append(descendants, j)
+		}
+	})
+	if len(descendants) == 0 {
+		return
+	}
 
-			if err := p.serializer.Serialize(*r); err != nil {
-				log.Fatalf("Error serializing, aborting now to not lose work: %v", err)
-			}
+	p.logger.Info("CancellingDescendants", "job", failed.Id, "state", failed.State, "descendants", len(descendants))
+	err := fmt.Errorf("job %s ended in %s: %w", failed.Id, failed.State, ErrParentFailed)
+	for _, job := range descendants {
+		if _, ok := p.cancelledJobs[job.Id]; ok {
+			continue
+		}
+		p.cancelledJobs[job.Id] = cancelledJob{state: failed.State, err: err}
+		// Anything not waiting is failed once it comes back to enqueue
+		if p.stateStorage.removeWaiting(job) {
+			p.enqueue(r, job)
+		}
+	}
+}
 
-			// If we move a job back to the same state and there are no kick requests, no need to see a status
-			// update as the totals will be the same
-			if completedJob.PriorState != completedJob.Job.State || len(completedJob.KickRequests) > 0 {
-				p.updateStatus()
-			}
+// insertKickedJob adds a kicked job to the run and returns it. Kicked ids are derived from their parent's id,
+// so a parent that kicks again, eg after looping back through the same state, would reuse them. Rather than
+// overwrite the earlier job, the new one gets a "#n" suffix on its id.
+func (p *Processor[AC, OC, JC]) insertKickedJob(r *Run[OC, JC], job Job[JC]) Job[JC] {
+	id := job.Id
+	for n := 1; ; n++ {
+		err := r.insertJob(job)
+		if err == nil {
+			return job
+		}
+		job.Id = fmt.Sprintf("%s#%d", id, n)
+		p.logger.Warn("DuplicateJobId", "job", id, "newId", job.Id, "error", err)
+	}
+}
 
-			if p.stateStorage.allJobsAreTerminal(r) && !p.stateStorage.hasExecutingJobs() {
-				return
-			}
+// sink hands a job that has reached a terminal state to the Sink, evicting it from the run if configured
+func (p *Processor[AC, OC, JC]) sink(r *Run[OC, JC], job Job[JC]) {
+	if p.Sink == nil {
+		return
+	}
+	if err := p.Sink.Emit(job); err != nil {
+		p.logger.Error("SinkFailed", "job", job.Id, "state", job.State, "error", err)
+		return
+	}
+	if p.EvictTerminal {
+		r.removeJob(job.Id)
+	}
+}
+
+// hold keeps a job waiting in its state on a timer rather than a worker, then runs f with it
+func (p *Processor[AC, OC, JC]) hold(job Job[JC], d time.Duration, f func()) {
+	p.stateStorage.holdJob(job)
+	p.after(d, func() {
+		p.stateStorage.releaseJob(job.State)
+		f()
+	})
+}
+
+// enqueueAfter holds a job for d before queueing it, eg to delay a retry
+func (p *Processor[AC, OC, JC]) enqueueAfter(r *Run[OC, JC], job Job[JC], d time.Duration) {
+	p.logger.Info("HoldingJob", "job", job.Id, "state", job.State, "delay", d)
+	if err := r.UpdateJob(job); err != nil {
+		p.logger.Error("UpdateJobFailed", "job", job.Id, "state", job.State, "error", err)
+		return
+	}
+	p.hold(job, d, func() {
+		p.enqueue(r, job)
+	})
+}
+
+// delay holds a job in its delay state on a timer rather than a worker, then moves it to the next state
+func (p *Processor[AC, OC, JC]) delay(r *Run[OC, JC], job Job[JC]) {
+	state := p.stateStorage.stateMap[job.State]
+	p.hold(job, state.Delay, func() {
+		p.stateStorage.recordTransition(state.TriggerState, state.NextState)
+
+		job.State = state.NextState
+		job = job.UpdateLastEvent()
+		p.enqueue(r, job)
+
+		p.checkpoint()
+	})
+}
+
+// limitKicks fails the job if its Exec returned more kick requests than the prior state allows, or kick
+// requests that would be deeper than it allows
+func (p *Processor[AC, OC, JC]) limitKicks(completedJob Return[JC]) Return[JC] {
+	state := p.stateStorage.stateMap[completedJob.PriorState]
+	kicks := len(completedJob.KickRequests)
+
+	var err error
+	switch {
+	case state.MaxKicksPerExec > 0 && kicks > state.MaxKicksPerExec:
+		err = fmt.Errorf("exec returned %d kick requests, more than the limit of %d", kicks, state.MaxKicksPerExec)
+		p.logger.Warn("TooManyKicks", "job", completedJob.Job.Id, "state", completedJob.PriorState, "failureState", state.FailureState, "error", err)
+	case state.MaxKickDepth > 0 && kicks > 0 && completedJob.Job.Depth+1 > state.MaxKickDepth:
+		err = fmt.Errorf("exec returned kick requests at depth %d, deeper than the limit of %d", completedJob.Job.Depth+1, state.MaxKickDepth)
+		p.logger.Warn("KicksTooDeep", "job", completedJob.Job.Id, "state", completedJob.PriorState, "failureState", state.FailureState, "error", err)
+	default:
+		return completedJob
+	}
+
+	completedJob.Job.recordError(completedJob.PriorState, err)
+	completedJob.Job.State = state.FailureState
+	completedJob.KickRequests = nil
+	return completedJob
+}
+
+// limitStateAge fails a job that would be retried in its state if it has already been there longer than the
+// state's MaxStateAge
+func (p *Processor[AC, OC, JC]) limitStateAge(completedJob Return[JC]) Return[JC] {
+	state := p.stateStorage.stateMap[completedJob.PriorState]
+	job := completedJob.Job
+	if state.MaxStateAge == 0 || completedJob.err == nil || job.State != completedJob.PriorState || job.StateEnteredAt == nil {
+		return completedJob
+	}
+	age := time.Since(*job.StateEnteredAt)
+	if age <= state.MaxStateAge {
+		return completedJob
+	}
+
+	err := fmt.Errorf("retrying for %s, longer than the limit of %s: %w", age.Round(time.Millisecond), state.MaxStateAge, ErrMaxStateAge)
+	p.logger.Warn("MaxStateAgeExceeded", "job", job.Id, "state", completedJob.PriorState, "failureState", state.FailureState, "error", err)
+	completedJob.Job.recordError(completedJob.PriorState, err)
+	completedJob.Job.State = state.FailureState
+	completedJob.Job.Timeouts = 0
+	completedJob.after = 0
+	return completedJob
+}
+
+// limitWaiting throws away the result of the job's Exec if queueing the jobs it moved or kicked would take a
+// state over its MaxWaiting, putting the job back as it was before the Exec to retry later
+func (p *Processor[AC, OC, JC]) limitWaiting(completedJob Return[JC]) Return[JC] {
+	added := map[string]int{}
+	if completedJob.Job.State != completedJob.PriorState {
+		added[completedJob.Job.State] += 1
+	}
+	for _, kickRequest := range completedJob.KickRequests {
+		added[kickRequest.State] += 1
+	}
+
+	for state, count := range added {
+		maxWaiting := p.stateStorage.stateMap[state].MaxWaiting
+		waiting := p.stateStorage.queuedWaiting(state)
+		if maxWaiting == 0 || waiting == 0 || waiting+count <= maxWaiting {
+			continue
+		}
+
+		err := fmt.Errorf("adding %d jobs to state %s with %d of %d waiting: %w", count, state, waiting, maxWaiting, ErrQueueFull)
+		p.logger.Warn("QueueFull", "job", completedJob.Job.Id, "state", completedJob.PriorState, "fullState", state, "error", err)
+		job := completedJob.original
+		job.recordError(completedJob.PriorState, err)
+		completedJob.Job = job
+		completedJob.KickRequests = nil
+		completedJob.err = err
+		completedJob.after = p.stateStorage.stateMap[completedJob.PriorState].RetryDelay
+		p.stateStorage.refuseJob(job)
+		return completedJob
+	}
+	return completedJob
+}
+
+// checkpoint asks for the run to be serialized in the background, see checkpointer
+func (p *Processor[AC, OC, JC]) checkpoint() {
+	if p.checkpoints == nil || p.serializationPaused.Load() {
+		return
+	}
+	if p.CheckpointPolicy == CheckpointOnTerminal && !p.unsavedFinish {
+		return
+	}
+	p.unsavedFinish = false
+	p.checkpoints.request()
+}
+
+// PauseSerialization stops the run being checkpointed as it changes, eg during a burst of cheap transitions
+// that would be lost harmlessly if the processor died, until ResumeSerialization is called. The run is still
+// saved when Exec returns. It's safe to call at any time, including from Exec and before Exec starts.
+func (p *Processor[AC, OC, JC]) PauseSerialization() {
+	p.serializationPaused.Store(true)
+}
+
+// ResumeSerialization checkpoints the run as it changes again after PauseSerialization, starting with a
+// checkpoint straight away so nothing that changed while it was paused is left unsaved. It's safe to call at
+// any time, and does nothing if serialization isn't paused.
+func (p *Processor[AC, OC, JC]) ResumeSerialization() {
+	if !p.serializationPaused.Swap(false) {
+		return
+	}
+
+	p.inputM.Lock()
+	defer p.inputM.Unlock()
+	if p.checkpoints != nil {
+		p.checkpoints.request()
+	}
+}
+
+func (p *Processor[AC, OC, JC]) updateStatus(r *Run[OC, JC]) {
+	p.notifyDrainedStates()
+	status := p.stateStorage.getStatusCounts()
+	if p.Gauges != nil {
+		gauges := p.Gauges(r)
+		for i := range status {
+			status[i].Gauges = gauges
 		}
 	}
+	p.statusUpdates.offer(status)
 }
 
-func (p *Processor[AC, OC, JC]) updateStatus() {
-	p.statusListener.StatusUpdate(p.stateStorage.getStatusCounts())
+// notifyDrainedStates calls OnStateDrained for each state that has run out of work since the last call
+func (p *Processor[AC, OC, JC]) notifyDrainedStates() {
+	if p.OnStateDrained == nil {
+		return
+	}
+	for _, state := range p.stateStorage.states {
+		if state.Terminal {
+			continue
+		}
+		name := state.TriggerState
+		status := p.stateStorage.stateStatusMap[name]
+		switch busy := status.Waiting+status.Executing > 0; {
+		case busy:
+			p.busyStates[name] = true
+		case p.busyStates[name]:
+			delete(p.busyStates, name)
+			p.logger.Info("StateDrained", "state", name)
+			p.OnStateDrained(name)
+		}
+	}
 }
 
 func (p *Processor[AC, OC, JC]) shutdown() {
@@ -354,8 +3205,33 @@ func (p *Processor[AC, OC, JC]) shutdown() {
 	for _, state := range p.stateStorage.states {
 		p.stateStorage.closeJobChannelForState(state.TriggerState)
 	}
-	// close ourselves down
-	close(p.returnChan)
+	// close ourselves down. returnChan stays open, as workers cut loose by a cancelled Exec may still be
+	// finishing a job, they see stopped instead.
+	close(p.stopped)
+
+	// Always save the final state of the run before Exec returns, errors and all
+	// The final save happens even if serialization is paused. ResumeSerialization can't ask for another
+	// checkpoint once it's been taken away.
+	p.inputM.Lock()
+	checkpoints := p.checkpoints
+	p.checkpoints = nil
+	p.inputM.Unlock()
+	if checkpoints != nil {
+		checkpoints.close()
+	}
+	p.stateStorage.closeSpills()
+	if closer, ok := p.Sink.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			p.logger.Warn("CloseSinkFailed", "error", err)
+		}
+	}
+
+	p.stopAcceptingJobs()
+
+	// Make sure the listener has seen the final status before Exec returns
+	p.statusUpdates.close()
+
+	p.closeEvents()
 }
 
 type StateExec[AC any, OC any, JC any] struct {
@@ -365,71 +3241,378 @@ type StateExec[AC any, OC any, JC any] struct {
 	state      State[AC, OC, JC]
 	jobChan    <-chan Job[JC]
 	returnChan chan<- Return[JC]
+	stopped    <-chan struct{}
 	i          int
 	wg         *sync.WaitGroup
+	sampleRate float64
+	preExec    func(ctx context.Context, ac AC, state string, jc JC) (JC, error)
+	postExec   func(ctx context.Context, ac AC, state string, jc JC, err error) (JC, error)
+
+	// rateLimitChan reports when the worker is held up by the state's rate limiter, for status updates
+	rateLimitChan chan<- rateLimitEvent
+
+	// acProvider optionally replaces ac with a fresh app context for each job, see Processor.AppContextProvider
+	acProvider func() AC
+
+	// recorder optionally records each Exec, see Processor.Recorder
+	recorder ExecRecorder[OC, JC]
+
+	logger  *slog.Logger
+	metrics *channelMetrics
+}
+
+// sampleJob reports whether a job should get verbose logging with the given sample rate
+func sampleJob(id string, sampleRate float64) bool {
+	if sampleRate <= 0 || sampleRate >= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return float64(h.Sum32()) < sampleRate*float64(math.MaxUint32)
 }
 
 func (s *StateExec[AC, OC, JC]) Run() {
-	slog.Info("Starting worker", "worker", s.i, "state", s.state.TriggerState)
-	defer func() {
-		s.wg.Done()
-		slog.Info("Stopped worker", "worker", s.i, "state", s.state.TriggerState)
-	}()
+	s.logger.Info("Starting worker", "worker", s.i, "state", s.state.TriggerState)
+	// Done only once the worker has finished logging, so Exec doesn't return while it's still using the logger
+	defer s.wg.Done()
+	defer s.logger.Info("Stopped worker", "worker", s.i, "state", s.state.TriggerState)
+
+	// Workers keep taking jobs until shutdown closes their channel, even once ctx is done, so the process
+	// goroutine is never left trying to hand a job to a worker that has gone. Execs see the cancelled ctx.
+	// Once the process goroutine has stopped, the job in hand is dropped and left as it was in the run.
+	for j := range s.jobChan {
+		rtn := s.execute(j)
+		sampled := sampleJob(j.Id, s.sampleRate)
+		if sampled {
+			s.logger.Info("Returning job", "job", j.Id, "newState", rtn.Job.State)
+		}
+		if !countedSend(&s.metrics.returns, s.returnChan, rtn, s.stopped) {
+			continue
+		}
+		if sampled {
+			s.logger.Info("Returned job", "job", j.Id, "newState", rtn.Job.State)
+		}
+	}
+}
 
-	for {
-		select {
-		case <-s.ctx.Done():
-			return
-		case j, more := <-s.jobChan:
-			// The channel was closed
-			if !more {
-				return
-			}
+// execute runs the job through the state's Exec, along with its hooks, timeout and error handling, and
+// returns the result to hand back to the process goroutine
+func (s *StateExec[AC, OC, JC]) execute(j Job[JC]) Return[JC] {
+	sampled := sampleJob(j.Id, s.sampleRate)
+	var err error
+	if s.state.RateLimit != nil || s.state.RateWaiter != nil {
+		// If processing is stopped while waiting, the job goes back without running so the limit holds
+		err = s.waitForRateLimit()
+		if sampled && err == nil {
+			s.logger.Info("LimiterAllowed", "worker", s.i, "state", s.state.TriggerState, "job", j.Id)
+		}
+	}
+	priorState := j.State
+	// Execute the job
+	rtn := Return[JC]{
+		PriorState: priorState,
+		original:   j,
+	}
+	if s.state.IdempotencyKey != nil {
+		rtn.key = s.state.IdempotencyKey(j.C)
+	}
+	if sampled {
+		s.logger.Info("Executing job", "job", j.Id, "state", s.state.TriggerState)
+	}
+	var timedOut bool
+	start := time.Now()
+	ac := s.appContext()
+	if err == nil && s.preExec != nil {
+		// A failed PreExec leaves the job's context as it was
+		var jc JC
+		if jc, err = s.preExec(s.ctx, ac, priorState, j.C); err == nil {
+			j.C = jc
+		}
+	}
+	requested := &requeue{}
+	annotated := &annotations{}
+	if err == nil {
+		ctx := context.WithValue(context.WithValue(s.ctx, requeueKey{}, requested), annotationsKey{}, annotated)
+		input, attempt := j.C, j.attempt()
+		execStart := time.Now()
+		j.C, j.State, rtn.KickRequests, timedOut, err = s.exec(ctx, ac, j)
+		if observer, ok := s.state.RateWaiter.(RateObserver); ok && s.ctx.Err() == nil {
+			observer.ObserveExec(err)
+		}
+		if s.recorder != nil {
+			s.record(j.Id, attempt, input, j, rtn.KickRequests, timedOut, err, execStart)
+		}
+		if s.postExec != nil {
+			j.C, err = s.postExec(s.ctx, ac, priorState, j.C, err)
+		}
+	}
+	rtn.err = err
+	rtn.duration = time.Since(start)
+	if errors.Is(err, ErrAbortRun) {
+		// The whole run is stopping, so the job isn't retried or routed anywhere, see ErrAbortRun
+		rtn.Job = rtn.original
+		rtn.Job.recordError(priorState, err)
+		rtn.KickRequests = nil
+		return rtn
+	}
+	if timedOut {
+		j, rtn.timedOut = s.handleTimeout(j)
+	}
+	if err == nil && s.state.Router != nil {
+		j.State = s.state.Router(j.C)
+	}
+	if err != nil && !timedOut && s.state.ErrorRouter != nil {
+		j.State = s.routeError(err, j)
+	} else if err != nil && !timedOut && s.state.IsRetryable != nil {
+		j.State = s.classifyError(err)
+	}
+	if j.State != priorState {
+		j.Timeouts = 0
+	}
+	annotated.m.Lock()
+	j.annotate(annotated.values)
+	annotated.m.Unlock()
+	if err == nil {
+		requested.m.Lock()
+		rtn.after = requested.after
+		requested.m.Unlock()
+	} else if j.State == priorState {
+		rtn.after = s.retryDelay(err)
+	}
+	if err != nil {
+		j.recordError(priorState, err)
+		s.logger.Info("Execution complete", "job", j.Id, "state", s.state.TriggerState, "newState", j.State, "error", err, "kickRequests", len(rtn.KickRequests))
+	} else if sampled {
+		s.logger.Info("Execution complete", "job", j.Id, "state", s.state.TriggerState, "newState", j.State, "kickRequests", len(rtn.KickRequests))
+	}
 
-			if s.state.RateLimit != nil {
-				s.state.RateLimit.Wait(s.ctx)
-				slog.Info("LimiterAllowed", "worker", s.i, "state", s.state.TriggerState, "job", j.Id)
-			}
-			priorState := j.State
-			// Execute the job
-			rtn := Return[JC]{
-				PriorState: priorState,
-			}
-			slog.Info("Executing job", "job", j.Id, "state", s.state.TriggerState)
-			var err error
-			j.C, j.State, rtn.KickRequests, err = s.state.Exec(s.ctx, s.ac, s.oc, j.C)
-			if err != nil {
-				j.StateErrors[priorState] = append(j.StateErrors[priorState], err.Error())
-				slog.Info("Execution complete", "job", j.Id, "state", s.state.TriggerState, "newState", j.State, "error", err, "kickRequests", len(rtn.KickRequests))
-			} else {
-				slog.Info("Execution complete", "job", j.Id, "state", s.state.TriggerState, "newState", j.State, "kickRequests", len(rtn.KickRequests))
-			}
+	rtn.Job = j
+	return rtn
+}
+
+// record hands the recorder what went into and came out of an Exec
+func (s *StateExec[AC, OC, JC]) record(id string, attempt int, input JC, out Job[JC], kicks []KickRequest[JC], timedOut bool, err error, start time.Time) {
+	rec := ExecRecord[OC, JC]{
+		JobId:     id,
+		Attempt:   attempt,
+		State:     s.state.TriggerState,
+		Overall:   s.oc,
+		Input:     input,
+		Output:    out.C,
+		NextState: out.State,
+		Kicks:     kicks,
+		TimedOut:  timedOut,
+		Started:   start,
+		Duration:  time.Since(start),
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if err := s.recorder.Record(rec); err != nil {
+		s.logger.Error("RecordExecFailed", "job", id, "state", s.state.TriggerState, "error", err)
+	}
+}
+
+// rateLimitEvent is sent by a worker when it starts or finishes waiting on its state's rate limiter
+type rateLimitEvent struct {
+	state   string
+	waiting bool
+}
+
+// waitForRateLimit waits until the state's rate limiter allows another job through. If it has to wait
+// it tells the process goroutine, so the job shows up as RateLimited rather than doing work. It gives up
+// as soon as the processor's context is done, returning the context's error, however long the wait. A
+// RateWaiter is just waited on.
+func (s *StateExec[AC, OC, JC]) waitForRateLimit() error {
+	if s.state.RateWaiter != nil {
+		return s.state.RateWaiter.Wait(s.ctx)
+	}
+
+	reservation := s.state.RateLimit.Reserve()
+	if !reservation.OK() {
+		// The limiter can never allow the job through, eg it has no burst. Like a failed Wait, carry on anyway.
+		return nil
+	}
+	delay := reservation.Delay()
+	if delay == 0 {
+		return nil
+	}
+
+	if s.signalRateLimited(true) {
+		defer s.signalRateLimited(false)
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-s.ctx.Done():
+		reservation.Cancel()
+		return s.ctx.Err()
+	}
+}
+
+// signalRateLimited tells the process goroutine the worker started or finished waiting on the rate limiter,
+// and reports whether it was told. The process goroutine keeps listening while it drains a cancelled run, so
+// this only gives up once the processor has stopped and nothing reads the counts any more.
+func (s *StateExec[AC, OC, JC]) signalRateLimited(waiting bool) bool {
+	select {
+	case s.rateLimitChan <- rateLimitEvent{state: s.state.TriggerState, waiting: waiting}:
+		return true
+	case <-s.stopped:
+		return false
+	}
+}
 
-			rtn.Job = j
-			slog.Info("Returning job", "job", j.Id, "newState", j.State)
-			s.returnChan <- rtn
-			slog.Info("Returned job", "job", j.Id, "newState", j.State)
+// appContext returns the app context to execute the next job with
+func (s *StateExec[AC, OC, JC]) appContext() AC {
+	if s.acProvider != nil {
+		return s.acProvider()
+	}
+	return s.ac
+}
+
+// exec runs the state's Exec for the job with ctx and ac, enforcing the state's Timeout if it has one
+func (s *StateExec[AC, OC, JC]) exec(ctx context.Context, ac AC, j Job[JC]) (JC, string, []KickRequest[JC], bool, error) {
+	ctx = withExecJob(ctx, j)
+	if s.state.Timeout == 0 {
+		jc, state, kicks, err := s.state.Exec(ctx, ac, s.oc, j.C)
+		return jc, state, kicks, false, err
+	}
+
+	// Exec runs on its own goroutine so that we can give up on it if it ignores the cancelled context.
+	// It works on its own copy of the job context and hands back copies, so we never share it with Exec.
+	type result struct {
+		jc    JC
+		state string
+		kicks []KickRequest[JC]
+		err   error
+	}
+	saved := &progress{}
+	ctx, cancel := context.WithTimeout(context.WithValue(ctx, progressKey{}, saved), s.state.Timeout)
+	defer cancel()
+
+	results := make(chan result, 1)
+	go func(jc JC) {
+		var r result
+		r.jc, r.state, r.kicks, r.err = s.state.Exec(ctx, ac, s.oc, jc)
+		results <- r
+	}(j.C)
+
+	timeoutErr := fmt.Errorf("%w after %v", ErrExecTimeout, s.state.Timeout)
+	returned := func(r result) (JC, string, []KickRequest[JC], bool, error) {
+		// An Exec that succeeded just after the deadline still finished its work, so keep it, kicks and all.
+		// It only timed out if it failed with the deadline passed, eg by giving up on the cancelled context.
+		if r.err != nil && ctx.Err() == context.DeadlineExceeded && s.ctx.Err() == nil {
+			// Exec noticed the deadline and returned whatever it had done so far
+			return r.jc, r.state, nil, true, timeoutErr
+		}
+		return r.jc, r.state, r.kicks, false, r.err
+	}
+	select {
+	case r := <-results:
+		return returned(r)
+	case <-ctx.Done():
+		if s.ctx.Err() != nil {
+			// The whole processor is shutting down, not a timeout of this job
+			return j.C, j.State, nil, false, s.ctx.Err()
 		}
+
+		// Give an Exec that is winding down because of the deadline a moment to return what it has
+		select {
+		case r := <-results:
+			return returned(r)
+		case <-time.After(timeoutGracePeriod):
+		}
+
+		saved.m.Lock()
+		defer saved.m.Unlock()
+		if saved.saved {
+			return saved.jc.(JC), j.State, nil, true, timeoutErr
+		}
+		return j.C, j.State, nil, true, timeoutErr
+	}
+}
+
+// handleTimeout retries a timed out job in this state, or moves it to the timeout state once it has
+// exceeded MaxTimeouts, reporting whether it did the latter
+func (s *StateExec[AC, OC, JC]) handleTimeout(j Job[JC]) (Job[JC], bool) {
+	j.Timeouts += 1
+	if s.state.MaxTimeouts > 0 && j.Timeouts > s.state.MaxTimeouts {
+		j.State = s.state.timeoutState()
+		return j, true
 	}
+	j.State = s.state.TriggerState
+	return j, false
+}
+
+// retryDelay is how long a job that errored should wait before it is retried in this state
+func (s *StateExec[AC, OC, JC]) retryDelay(err error) time.Duration {
+	var retryAfterErr RetryAfterError
+	if errors.As(err, &retryAfterErr) {
+		return retryAfterErr.RetryAfter()
+	}
+	return s.state.RetryDelay
+}
+
+// routeError picks the next state for a job whose Exec returned an error using the state's ErrorRouter
+func (s *StateExec[AC, OC, JC]) routeError(err error, j Job[JC]) string {
+	nextState, retry := s.state.ErrorRouter(err, j.C)
+	if retry {
+		return s.state.TriggerState
+	}
+	if nextState != "" {
+		return nextState
+	}
+	if s.state.FailureState != "" {
+		return s.state.FailureState
+	}
+	return j.State
+}
+
+// classifyError picks the next state for a job whose Exec returned an error using the state's IsRetryable
+func (s *StateExec[AC, OC, JC]) classifyError(err error) string {
+	if s.state.IsRetryable(err) {
+		return s.state.TriggerState
+	}
+	return s.state.FailureState
 }
 
 func (p *Processor[AC, OC, JC]) execFunc(ctx context.Context, state State[AC, OC, JC], overallContext OC, wg *sync.WaitGroup) {
 	// Make workers for each, they just process and fire back to the central channel
 	for i := 0; i < state.Concurrency; i++ {
-		p.wg.Add(1)
-		stateExec := StateExec[AC, OC, JC]{
-			ctx:        ctx,
-			ac:         p.appContext,
-			oc:         overallContext,
-			state:      state,
-			jobChan:    p.stateStorage.getJobChannelForState(state.TriggerState),
-			returnChan: p.returnChan,
-			i:          i,
-			wg:         wg,
-		}
+		wg.Add(1)
+		stateExec := p.newStateExec(ctx, state, overallContext, i, wg)
 
 		pprof.Do(ctx, pprof.Labels("type", "worker", "state", state.TriggerState, "id", fmt.Sprintf("%d", i)), func(ctx context.Context) {
 			go stateExec.Run()
 		})
 	}
 }
+
+// newStateExec sets up the i'th worker for the state
+func (p *Processor[AC, OC, JC]) newStateExec(ctx context.Context, state State[AC, OC, JC], overallContext OC, i int, wg *sync.WaitGroup) *StateExec[AC, OC, JC] {
+	// The worker has its own copy of the state, which keys with the processor's IdempotencyKey if it has none
+	state.IdempotencyKey = p.idempotencyKey(state)
+	return &StateExec[AC, OC, JC]{
+		ctx:        ctx,
+		ac:         p.appContext,
+		oc:         overallContext,
+		state:      state,
+		jobChan:    p.stateStorage.getJobChannelForState(state.TriggerState),
+		returnChan: p.returnChan,
+		stopped:    p.stopped,
+		i:          i,
+		wg:         wg,
+		sampleRate: p.SampleRate,
+		preExec:    p.PreExec,
+		postExec:   p.PostExec,
+
+		rateLimitChan: p.rateLimitChan,
+		acProvider:    p.AppContextProvider,
+		recorder:      p.Recorder,
+		logger:        p.logger,
+		metrics:       p.metrics,
+	}
+}
@@ -1,14 +1,22 @@
 package jorb
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"math/rand"
+	"net"
 	"os"
+	"path/filepath"
 	"runtime/pprof"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -40,6 +48,7 @@ const (
 	STATE_DONE     = "done"
 	STATE_MIDDLE   = "middle"
 	STATE_DONE_TWO = "done_two"
+	STATE_FAILED   = "failed"
 )
 
 func createJob(state string) Job[MyJobContext] {
@@ -147,6 +156,129 @@ func TestStateStorage(t *testing.T) {
 	}, stateS.getStatusCounts())
 }
 
+func TestStateStorage_DeclarationOrder(t *testing.T) {
+	t.Parallel()
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_MIDDLE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{
+			TriggerState: STATE_MIDDLE,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+	stateS := newStateStorageFromStates(states)
+	stateS.processJob(createJob(STATE_DONE))
+
+	names := func() []string {
+		names := []string{}
+		for _, status := range stateS.getStatusCounts() {
+			names = append(names, status.State)
+		}
+		return names
+	}
+	assert.Equal(t, []string{STATE_DONE, STATE_MIDDLE, TRIGGER_STATE_NEW}, names())
+
+	stateS.declarationOrder = true
+	assert.Equal(t, []string{TRIGGER_STATE_NEW, STATE_MIDDLE, STATE_DONE}, names())
+	assert.Equal(t, []StatusCount{
+		{State: TRIGGER_STATE_NEW},
+		{State: STATE_MIDDLE},
+		{State: STATE_DONE, Terminal: true, Completed: 1},
+	}, stateS.getStatusCounts())
+}
+
+func TestStateStorage_FairByParent(t *testing.T) {
+	stateS := newStateStorageFromStates([]State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency:  1,
+			FairByParent: true,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	})
+
+	started := make(chan string, 10)
+	go func() {
+		for job := range stateS.stateChan[TRIGGER_STATE_NEW] {
+			started <- job.Id
+		}
+	}()
+
+	// Parent 0 fans out into more children than parent 1, and they all arrive first
+	for _, id := range []string{"9", "0->0", "0->1", "0->2", "0->3", "1->0", "1->1", "5"} {
+		job := createJob(TRIGGER_STATE_NEW)
+		job.Id = id
+		stateS.processJob(job)
+	}
+	for i := 0; i < 7; i++ {
+		stateS.runNextWaitingJob(TRIGGER_STATE_NEW)
+	}
+
+	ids := []string{}
+	for i := 0; i < 8; i++ {
+		ids = append(ids, <-started)
+	}
+	assert.Equal(t, []string{"9", "0->0", "1->0", "5", "0->1", "1->1", "0->2", "0->3"}, ids)
+}
+
+func TestStateStorage_RunWokenJobs(t *testing.T) {
+	t.Parallel()
+	exec := func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+		return jc, STATE_DONE, nil, nil
+	}
+	stateS := newStateStorageFromStates([]State[MyAppContext, MyOverallContext, MyJobContext]{
+		{TriggerState: TRIGGER_STATE_NEW, Exec: exec, Concurrency: 1},
+		{TriggerState: STATE_MIDDLE, Exec: exec, Concurrency: 1, HighWaterMark: 1},
+		{TriggerState: STATE_DONE, Terminal: true},
+	})
+
+	started := make(chan string, 10)
+	for _, state := range []string{TRIGGER_STATE_NEW, STATE_MIDDLE} {
+		go func(state string) {
+			for job := range stateS.stateChan[state] {
+				started <- job.Id
+			}
+		}(state)
+	}
+
+	// Middle has one job executing and two waiting, which is over its mark, so new is held back
+	stateS.recordTransition(TRIGGER_STATE_NEW, STATE_MIDDLE)
+	for _, id := range []string{"m0", "m1", "m2"} {
+		job := createJob(STATE_MIDDLE)
+		job.Id = id
+		stateS.processJob(job)
+	}
+	job := createJob(TRIGGER_STATE_NEW)
+	job.Id = "n0"
+	stateS.processJob(job)
+	assert.Equal(t, "m0", <-started)
+	assert.Equal(t, 1, stateS.stateStatusMap[TRIGGER_STATE_NEW].Waiting)
+
+	// Once m0 finishes middle starts m1 and drops back to its mark, which wakes new too
+	assert.False(t, stateS.execFinished(STATE_MIDDLE, "m0"))
+	stateS.runWokenJobs(STATE_MIDDLE)
+	assert.ElementsMatch(t, []string{"m1", "n0"}, []string{<-started, <-started})
+	assert.Equal(t, 0, stateS.stateStatusMap[TRIGGER_STATE_NEW].Waiting)
+}
+
 func TestProcessorOneJob(t *testing.T) {
 	t.Parallel()
 	oc := MyOverallContext{}
@@ -396,130 +528,195 @@ func (t *testStatusListener) ExpectStatus(counts []StatusCount) {
 
 var _ StatusListener = &testStatusListener{}
 
-func TestProcessor_StateCallback(t *testing.T) {
-	t.Skip("Need to do a better job of the assert state machine")
-	prev := log.Writer()
-	log.SetOutput(io.Discard)
-	defer func() {
-		log.SetOutput(prev)
-	}()
-
+func TestFairness(t *testing.T) {
 	oc := MyOverallContext{}
 	ac := MyAppContext{}
 	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
-	for i := 0; i < 11; i++ {
+	for i := 0; i < 5; i++ {
 		r.AddJob(MyJobContext{
 			Count: 0,
 		})
 	}
-
-	tl := &testStatusListener{
-		t: t,
-	}
-	tl.ExpectStatus([]StatusCount{
+	totalCount := 0
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
 		{
-			State:     TRIGGER_STATE_NEW,
-			Waiting:   1,
-			Executing: 10,
-			Completed: 0,
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				totalCount++
+				if totalCount > 10 {
+					return jc, STATE_DONE, nil, nil
+				}
+
+				jc.Count++
+
+				return jc, TRIGGER_STATE_NEW, nil, nil
+			},
+			Concurrency: 1,
 		},
 		{
-			State:     STATE_DONE,
-			Waiting:   0,
-			Executing: 0,
-			Completed: 0,
-			Terminal:  true,
+			TriggerState: STATE_DONE,
+			Terminal:     true,
 		},
-	})
-	for i := 0; i <= 10; i++ {
-		tl.ExpectStatus([]StatusCount{
-			{
-				State:     TRIGGER_STATE_NEW,
-				Waiting:   0,
-				Executing: 10 - i,
-				Completed: 0,
-			},
-			{
-				State:     STATE_DONE,
-				Waiting:   0,
-				Executing: 0,
-				Completed: 1 + i,
-				Terminal:  true,
-			},
-		})
 	}
 
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, nil, nil)
+	assert.NoError(t, err)
+
+	err = p.Exec(context.Background(), r)
+	for _, job := range r.Jobs {
+		assert.Equal(t, 2, job.C.Count)
+	}
+}
+
+func TestProcessor_Reentry(t *testing.T) {
+	t.Parallel()
 	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
-		State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
 			TriggerState: TRIGGER_STATE_NEW,
 			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
-				//log.Println("Processing New")
-				jc.Count += 1
-				time.Sleep(time.Second)
+				jc.Count++
+				switch jc.Count {
+				case 1:
+					return jc, TRIGGER_STATE_NEW, nil, errors.New("flaky")
+				case 2:
+					return jc, STATE_MIDDLE, nil, nil
+				}
 				return jc, STATE_DONE, nil, nil
 			},
-			Terminal:    false,
-			Concurrency: 10,
+			Concurrency: 1,
 		},
-		State[MyAppContext, MyOverallContext, MyJobContext]{
-			TriggerState: STATE_DONE,
-			Exec:         nil,
-			Terminal:     true,
+		{
+			TriggerState: STATE_MIDDLE,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				// Send it back to start over
+				return jc, TRIGGER_STATE_NEW, nil, errors.New("stale")
+			},
+			Concurrency: 1,
 		},
+		{TriggerState: STATE_DONE, Terminal: true},
 	}
 
-	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, nil, tl)
-	assert.NoError(t, err)
+	for _, tc := range []struct {
+		policy ReentryPolicy
+		errors map[string][]string
+	}{
+		{ReentryKeepHistory, map[string][]string{TRIGGER_STATE_NEW: {"flaky"}, STATE_MIDDLE: {"stale"}}},
+		{ReentryAsNew, map[string][]string{}},
+	} {
+		r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+		r.AddJob(MyJobContext{})
+		listener := &slowStatusListener{}
+		p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, listener)
+		require.NoError(t, err)
+		p.Reentry = tc.policy
+		require.NoError(t, p.Exec(context.Background(), r))
 
-	start := time.Now()
-	err = p.Exec(context.Background(), r)
-	delta := time.Since(start)
-	require.NoError(t, err)
-	assert.Less(t, delta, time.Second*2, "Should take less than 2 seconds when run in parallel")
+		j := r.Jobs["0"]
+		assert.Equal(t, STATE_DONE, j.State)
+		assert.Equal(t, 3, j.C.Count, "the job keeps its context either way")
+		assert.Equal(t, tc.errors, j.StateErrors)
 
-	for _, j := range r.Jobs {
-		assert.Equal(t, 1, j.C.Count, "Job Count should be 1")
+		// Either way the status counts every Exec, and the job only completes once
+		final := map[string]StatusCount{}
+		for _, status := range listener.latest {
+			final[status.State] = status
+		}
+		assert.Equal(t, 3, final[TRIGGER_STATE_NEW].Executed)
+		assert.Equal(t, 1, final[TRIGGER_STATE_NEW].Errored)
+		assert.Equal(t, 1, final[STATE_DONE].Completed)
+		assert.Zero(t, final[TRIGGER_STATE_NEW].Waiting+final[TRIGGER_STATE_NEW].Executing)
 	}
 }
 
-func TestFairness(t *testing.T) {
-	oc := MyOverallContext{}
-	ac := MyAppContext{}
-	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
-	for i := 0; i < 5; i++ {
-		r.AddJob(MyJobContext{
-			Count: 0,
-		})
-	}
-	totalCount := 0
+func TestProcessor_RecordHistory(t *testing.T) {
+	t.Parallel()
 	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
 		{
 			TriggerState: TRIGGER_STATE_NEW,
 			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
-				totalCount++
-				if totalCount > 10 {
-					return jc, STATE_DONE, nil, nil
-				}
-
 				jc.Count++
-
+				switch jc.Count {
+				case 1:
+					return jc, TRIGGER_STATE_NEW, nil, errors.New("flaky")
+				case 2:
+					return jc, STATE_MIDDLE, nil, nil
+				}
+				return jc, STATE_DONE, []KickRequest[MyJobContext]{{C: jc, State: STATE_DONE_TWO}}, nil
+			},
+			Concurrency: 1,
+		},
+		{
+			TriggerState: STATE_MIDDLE,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
 				return jc, TRIGGER_STATE_NEW, nil, nil
 			},
 			Concurrency: 1,
 		},
+		{TriggerState: STATE_DONE, Terminal: true},
+		{TriggerState: STATE_DONE_TWO, Terminal: true},
+	}
+
+	for _, record := range []bool{false, true} {
+		r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+		r.AddJob(MyJobContext{})
+		p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+		require.NoError(t, err)
+		p.RecordHistory = record
+		require.NoError(t, p.Exec(context.Background(), r))
+
+		require.Len(t, r.Jobs, 2)
+		if !record {
+			assert.Nil(t, r.Jobs["0"].History)
+			assert.Nil(t, r.Jobs["0->0"].History)
+			continue
+		}
+		// The retry in new isn't a transition, but coming back to it is
+		assert.Equal(t, []string{TRIGGER_STATE_NEW, STATE_MIDDLE, TRIGGER_STATE_NEW, STATE_DONE}, r.Jobs["0"].History)
+		assert.Equal(t, []string{STATE_DONE_TWO}, r.Jobs["0->0"].History)
+	}
+}
+
+func TestProcessor_Skipped(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 5; i++ {
+		r.AddJob(MyJobContext{Count: i})
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
 		{
-			TriggerState: STATE_DONE,
-			Terminal:     true,
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				// Odd jobs don't apply
+				if jc.Count%2 == 1 {
+					return jc, STATE_SKIPPED, nil, nil
+				}
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 2,
 		},
 	}
 
-	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, nil, nil)
-	assert.NoError(t, err)
+	listener := &slowStatusListener{}
+	p, err := NewProcessorWithOptions(MyAppContext{}, states,
+		WithStatusListener[MyAppContext, MyOverallContext, MyJobContext](listener),
+		WithTerminalStates[MyAppContext, MyOverallContext, MyJobContext](STATE_DONE, STATE_SKIPPED))
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
 
-	err = p.Exec(context.Background(), r)
-	for _, job := range r.Jobs {
-		assert.Equal(t, 2, job.C.Count)
+	// Skipped jobs stay in the run without errors
+	assert.Equal(t, STATE_SKIPPED, r.Jobs["1"].State)
+	assert.Empty(t, r.Jobs["1"].StateErrors)
+	assert.Equal(t, map[string]int{STATE_DONE: 3, STATE_SKIPPED: 2}, r.TerminalCounts())
+
+	final := map[string]StatusCount{}
+	for _, status := range listener.latest {
+		final[status.State] = status
 	}
+	assert.Equal(t, 3, final[STATE_DONE].Completed)
+	assert.Zero(t, final[STATE_DONE].Skipped)
+	assert.Equal(t, 2, final[STATE_SKIPPED].Skipped)
+	assert.Zero(t, final[STATE_SKIPPED].Completed)
+	assert.Zero(t, final[TRIGGER_STATE_NEW].Errored)
 }
 
 func TestStatusCountDedup(t *testing.T) {
@@ -568,7 +765,9 @@ func TestStatusCountDedup(t *testing.T) {
 					Terminal:  true,
 				},
 				StatusCount{
-					State: TRIGGER_STATE_NEW,
+					State:    TRIGGER_STATE_NEW,
+					Executed: 10,
+					Retries:  RetryHistogram{1},
 				},
 			},
 		},
@@ -738,6 +937,63 @@ func TestProcessor_RateLimiterSlows(t *testing.T) {
 	}
 }
 
+// countingWaiter is a RateWaiter that fails its first Wait
+type countingWaiter struct {
+	waits atomic.Int32
+}
+
+func (w *countingWaiter) Wait(ctx context.Context) error {
+	if w.waits.Add(1) == 1 {
+		return errors.New("throttled")
+	}
+	return nil
+}
+
+func TestProcessor_RateWaiter(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 5; i++ {
+		r.AddJob(MyJobContext{})
+	}
+	waiter := &countingWaiter{}
+	var execs atomic.Int32
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				execs.Add(1)
+				jc.Count += 1
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 2,
+			RateWaiter:  waiter,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	// The job whose wait failed didn't execute, and was retried like any other error
+	assert.Equal(t, int32(6), waiter.waits.Load())
+	assert.Equal(t, int32(5), execs.Load())
+	errored := 0
+	for _, j := range r.Jobs {
+		assert.Equal(t, 1, j.C.Count)
+		errored += len(j.StateErrors[TRIGGER_STATE_NEW])
+	}
+	assert.Equal(t, 1, errored)
+
+	// It's one or the other, and never inline
+	states[0].RateLimit = rate.NewLimiter(1, 1)
+	_, err = NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	assert.ErrorIs(t, err, ErrConflictingRateLimits)
+	states[0].RateLimit = nil
+	states[0].Inline = true
+	_, err = NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	assert.ErrorIs(t, err, ErrInvalidInline)
+}
+
 func TestProcessor_LoopWithExit(t *testing.T) {
 	t.Parallel()
 	oc := MyOverallContext{}
@@ -850,11 +1106,12 @@ func TestProcessor_Serialization(t *testing.T) {
 		assert.Equal(t, map[string][]string{TRIGGER_STATE_NEW: {"errored", "errored again"}}, j.StateErrors)
 	}
 
-	// Now reload the job
+	// Now reload the job, the final save should match the finished run exactly, error history included
 	actual, err := serialzer.Deserialize()
 	require.NoError(t, err)
 	assert.NotNil(t, r)
 	assert.Equal(t, len(r.Jobs), len(actual.Jobs))
+	assert.True(t, r.Equal(actual), "serialized run should match the finished run")
 }
 
 const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
@@ -867,30 +1124,167 @@ func randString(length int) string {
 	return string(b)
 }
 
-func TestProcessor_FirstStepExpands(t *testing.T) {
+func TestProcessor_CancelChildrenOnParentFailure(t *testing.T) {
 	t.Parallel()
-	oc := MyOverallContext{}
-	ac := MyAppContext{}
-	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
-	for i := 0; i < 10; i++ {
-		jobContext := MyJobContext{
-			Count:      0,
-			StringList: []string{},
+	for _, cancel := range []bool{false, true} {
+		r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+		r.AddJob(MyJobContext{})
+
+		blocked := make(chan struct{})
+		release := make(chan struct{})
+		states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+			{
+				TriggerState: TRIGGER_STATE_NEW,
+				Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+					kicks := []KickRequest[MyJobContext]{}
+					for i := 0; i < 3; i++ {
+						kicks = append(kicks, KickRequest[MyJobContext]{C: MyJobContext{Count: i}, State: STATE_MIDDLE})
+					}
+					return jc, "check", kicks, nil
+				},
+				Concurrency: 1,
+			},
+			{
+				TriggerState: "check",
+				Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+					// Fail once the first child is done and the second is executing
+					<-blocked
+					return jc, STATE_FAILED, nil, errors.New("bad parent")
+				},
+				Concurrency:  1,
+				FailureState: STATE_FAILED,
+			},
+			{
+				TriggerState: STATE_MIDDLE,
+				Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+					if jc.Count == 1 {
+						close(blocked)
+						<-release
+						// A grandchild that should never exist if the parent failed
+						return jc, STATE_DONE, []KickRequest[MyJobContext]{{C: MyJobContext{Count: 10}, State: STATE_MIDDLE}}, nil
+					}
+					return jc, STATE_DONE, nil, nil
+				},
+				Concurrency: 1,
+			},
+			{TriggerState: STATE_DONE, Terminal: true},
+			{TriggerState: STATE_FAILED, Terminal: true},
 		}
-		for i := 0; i < 10; i++ {
-			// Append a 30 length randomly generated string to jobContext.StringList
-			jobContext.StringList = append(jobContext.StringList, randString(30))
+
+		p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+		require.NoError(t, err)
+		p.CancelChildrenOnParentFailure = cancel
+		execErr := make(chan error)
+		go func() {
+			execErr <- p.Exec(context.Background(), r)
+		}()
+		_, err = p.WaitForJob(context.Background(), "0")
+		require.NoError(t, err)
+		close(release)
+		require.NoError(t, <-execErr)
+
+		assert.Equal(t, STATE_FAILED, r.Jobs["0"].State)
+		// The child that finished before its parent failed keeps its outcome either way
+		assert.Equal(t, STATE_DONE, r.Jobs["0->0"].State)
+		if !cancel {
+			assert.Equal(t, STATE_DONE, r.Jobs["0->1"].State)
+			assert.Equal(t, STATE_DONE, r.Jobs["0->2"].State)
+			assert.Equal(t, STATE_DONE, r.Jobs["0->1->0"].State)
+			continue
+		}
+
+		// The executing child is failed when it comes back, without its kick, and the waiting one straight away
+		require.Len(t, r.Jobs, 4)
+		for _, id := range []string{"0->1", "0->2"} {
+			j := r.Jobs[id]
+			assert.Equal(t, STATE_FAILED, j.State, id)
+			require.Len(t, j.StateErrors[STATE_MIDDLE], 1, id)
+			assert.Contains(t, j.StateErrors[STATE_MIDDLE][0], ErrParentFailed.Error(), id)
 		}
-		r.AddJob(jobContext)
 	}
+}
+
+func TestProcessor_MergeKick(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	r.AddJob(MyJobContext{Name: "tenant-a"})
+	r.AddJob(MyJobContext{Name: "tenant-b"})
 	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
-		// This state generates a list of job requests
-		State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
 			TriggerState: TRIGGER_STATE_NEW,
 			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
-				newJobs := []KickRequest[MyJobContext]{}
-				for _, state := range jc.StringList {
-					newJobs = append(newJobs, KickRequest[MyJobContext]{
+				jc.String = "trace-" + jc.Name
+				return jc, STATE_DONE, []KickRequest[MyJobContext]{
+					{C: MyJobContext{Count: 1}, State: STATE_MIDDLE},
+					{C: MyJobContext{Count: 2, Name: "own"}, State: STATE_MIDDLE},
+				}, nil
+			},
+			Concurrency: 2,
+		},
+		{
+			TriggerState: STATE_MIDDLE,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				if jc.Count == 1 {
+					return jc, STATE_DONE, []KickRequest[MyJobContext]{{C: MyJobContext{Count: 3}, State: STATE_DONE_TWO}}, nil
+				}
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 2,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+		{TriggerState: STATE_DONE_TWO, Terminal: true},
+	}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	p.MergeKick = func(parent MyJobContext, child MyJobContext) MyJobContext {
+		if child.Name == "" {
+			child.Name = parent.Name
+		}
+		child.String = parent.String
+		return child
+	}
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	require.Len(t, r.Jobs, 8)
+	for id, j := range r.Jobs {
+		if j.ParentId() == "" {
+			continue
+		}
+		root, _ := r.JobByID(id[:1])
+		assert.Equal(t, "trace-"+root.C.Name, j.C.String, id)
+		if j.C.Count == 2 {
+			assert.Equal(t, "own", j.C.Name, id)
+		} else {
+			// Grandchildren inherit through their parents
+			assert.Equal(t, root.C.Name, j.C.Name, id)
+		}
+	}
+}
+
+func TestProcessor_FirstStepExpands(t *testing.T) {
+	t.Parallel()
+	oc := MyOverallContext{}
+	ac := MyAppContext{}
+	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
+	for i := 0; i < 10; i++ {
+		jobContext := MyJobContext{
+			Count:      0,
+			StringList: []string{},
+		}
+		for i := 0; i < 10; i++ {
+			// Append a 30 length randomly generated string to jobContext.StringList
+			jobContext.StringList = append(jobContext.StringList, randString(30))
+		}
+		r.AddJob(jobContext)
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		// This state generates a list of job requests
+		State[MyAppContext, MyOverallContext, MyJobContext]{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				newJobs := []KickRequest[MyJobContext]{}
+				for _, state := range jc.StringList {
+					newJobs = append(newJobs, KickRequest[MyJobContext]{
 						C:     MyJobContext{String: state},
 						State: STATE_MIDDLE,
 					})
@@ -944,3 +1338,3731 @@ func TestProcessor_FirstStepExpands(t *testing.T) {
 	assert.Equal(t, 10, stateCount[STATE_DONE])
 	assert.Equal(t, 10*10, stateCount[STATE_DONE_TWO])
 }
+
+func TestRun_TerminalCounts(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 10; i++ {
+		r.AddJob(MyJobContext{Count: i})
+	}
+	assert.Nil(t, r.TerminalCounts(), "a run that hasn't been executed doesn't know its terminal states")
+
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				if jc.Count < 3 {
+					return jc, STATE_DONE, nil, nil
+				}
+				return jc, STATE_DONE_TWO, nil, nil
+			},
+			Concurrency: 2,
+		},
+		{TriggerState: STATE_DONE_TWO, Terminal: true},
+		{TriggerState: STATE_DONE, Terminal: true},
+		{TriggerState: "unused", Terminal: true},
+	}
+
+	listener := &recordingStatusListener{}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, listener)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	counts := r.TerminalCounts()
+	assert.Equal(t, map[string]int{STATE_DONE: 3, STATE_DONE_TWO: 7, "unused": 0}, counts)
+	assert.Equal(t, []string{STATE_DONE_TWO, STATE_DONE, "unused"}, r.TerminalStates)
+
+	updates := listener.Updates()
+	require.NotEmpty(t, updates)
+	for _, count := range updates[len(updates)-1] {
+		if count.Terminal {
+			assert.Equal(t, count.Completed, counts[count.State], count.State)
+		}
+	}
+
+	clone, err := r.Clone()
+	require.NoError(t, err)
+	assert.Equal(t, counts, clone.TerminalCounts(), "terminal states survive serialization")
+}
+
+func TestProcessor_MaxKicksPerExec(t *testing.T) {
+	t.Parallel()
+	oc := MyOverallContext{}
+	ac := MyAppContext{}
+	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
+	r.AddJob(MyJobContext{Count: 2})
+	r.AddJob(MyJobContext{Count: 5})
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				kicks := []KickRequest[MyJobContext]{}
+				for i := 0; i < jc.Count; i++ {
+					kicks = append(kicks, KickRequest[MyJobContext]{C: MyJobContext{}, State: STATE_DONE_TWO})
+				}
+				return jc, STATE_DONE, kicks, nil
+			},
+			Concurrency:     2,
+			MaxKicksPerExec: 3,
+			FailureState:    STATE_FAILED,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+		{
+			TriggerState: STATE_DONE_TWO,
+			Terminal:     true,
+		},
+		{
+			TriggerState: STATE_FAILED,
+			Terminal:     true,
+		},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, nil, nil)
+	require.NoError(t, err)
+
+	err = p.Exec(context.Background(), r)
+	require.NoError(t, err)
+
+	stateCount := map[string]int{}
+	for _, j := range r.Jobs {
+		stateCount[j.State] += 1
+	}
+	assert.Equal(t, map[string]int{STATE_DONE: 1, STATE_DONE_TWO: 2, STATE_FAILED: 1}, stateCount)
+	for _, j := range r.Jobs {
+		if j.State == STATE_FAILED {
+			assert.Equal(t, 5, j.C.Count)
+			assert.Len(t, j.StateErrors[TRIGGER_STATE_NEW], 1)
+		}
+	}
+}
+
+func TestNewProcessor_MaxKicksPerExecRequiresFailureState(t *testing.T) {
+	t.Parallel()
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency:     1,
+			MaxKicksPerExec: 3,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	_, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	assert.Error(t, err)
+
+	states[0].FailureState = STATE_FAILED
+	_, err = NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	assert.Error(t, err, "failure state must be declared")
+
+	states[0].FailureState = STATE_DONE
+	_, err = NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	assert.NoError(t, err)
+}
+
+func TestProcessor_IdempotencyKeySkipsRecordedTransitions(t *testing.T) {
+	t.Parallel()
+
+	tempFile := filepath.Join(t.TempDir(), "state.json")
+	serializer := NewJsonSerializer[MyOverallContext, MyJobContext](tempFile)
+
+	oc := MyOverallContext{}
+	ac := MyAppContext{}
+	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
+	for i := 0; i < 5; i++ {
+		r.AddJob(MyJobContext{Name: fmt.Sprintf("job-%d", i)})
+	}
+
+	var execs atomic.Int32
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				execs.Add(1)
+				jc.Count += 1
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 5,
+			IdempotencyKey: func(jc MyJobContext) string {
+				return jc.Name
+			},
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, serializer, nil)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+	assert.Equal(t, int32(5), execs.Load())
+
+	// Redrive every job back to the start, as if the state file had been edited, and reload it
+	resumed, err := serializer.Deserialize()
+	require.NoError(t, err)
+	for id, j := range resumed.Jobs {
+		j.State = TRIGGER_STATE_NEW
+		j.C.Count = 0
+		resumed.Jobs[id] = j
+	}
+
+	p, err = NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, serializer, nil)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), resumed))
+	assert.Equal(t, int32(5), execs.Load(), "recorded transitions should not execute again")
+
+	for _, j := range resumed.Jobs {
+		assert.Equal(t, STATE_DONE, j.State)
+		assert.Equal(t, 1, j.C.Count, "job context should come from the recorded transition")
+	}
+}
+
+func TestProcessor_ProcessorIdempotencyKey(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 5; i++ {
+		r.AddJob(MyJobContext{Name: fmt.Sprintf("job-%d", i)})
+	}
+
+	var newExecs, middleExecs atomic.Int32
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				newExecs.Add(1)
+				jc.Count += 1
+				return jc, STATE_MIDDLE, nil, nil
+			},
+			Concurrency: 5,
+		},
+		{
+			TriggerState: STATE_MIDDLE,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				middleExecs.Add(1)
+				jc.Count += 1
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 5,
+			IdempotencyKey: func(jc MyJobContext) string {
+				return "own-" + jc.Name
+			},
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	p.IdempotencyKey = func(jc MyJobContext, state string) string {
+		assert.NotEqual(t, STATE_DONE, state, "terminal states don't execute so aren't keyed")
+		if jc.Name == "job-0" {
+			return ""
+		}
+		return state + ":" + jc.Name
+	}
+	require.NoError(t, p.Exec(context.Background(), r))
+	assert.Equal(t, int32(5), newExecs.Load())
+	assert.Equal(t, int32(5), middleExecs.Load())
+	_, ok := r.RecordedTransition(TRIGGER_STATE_NEW, "new:job-1")
+	assert.True(t, ok)
+	_, ok = r.RecordedTransition(STATE_MIDDLE, "own-job-1")
+	assert.True(t, ok, "the state's own key takes precedence")
+
+	// Redrive every job, only job-0 has no recorded transition out of new
+	for id, j := range r.Jobs {
+		j.State = TRIGGER_STATE_NEW
+		j.C.Count = 0
+		r.Jobs[id] = j
+	}
+	require.NoError(t, p.Exec(context.Background(), r))
+	assert.Equal(t, int32(6), newExecs.Load())
+	assert.Equal(t, int32(5), middleExecs.Load())
+	for _, j := range r.Jobs {
+		assert.Equal(t, STATE_DONE, j.State)
+		assert.Equal(t, 2, j.C.Count, j.Id)
+	}
+}
+
+type slowStatusListener struct {
+	m      sync.Mutex
+	delay  time.Duration
+	latest []StatusCount
+}
+
+func (s *slowStatusListener) StatusUpdate(status []StatusCount) {
+	time.Sleep(s.delay)
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.latest = status
+}
+
+func TestProcessor_SlowStatusListenerDoesNotStall(t *testing.T) {
+	t.Parallel()
+	oc := MyOverallContext{}
+	ac := MyAppContext{}
+	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
+	for i := 0; i < 20; i++ {
+		r.AddJob(MyJobContext{})
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_MIDDLE, nil, nil
+			},
+			Concurrency: 2,
+		},
+		{
+			TriggerState: STATE_MIDDLE,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 2,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	listener := &slowStatusListener{delay: 100 * time.Millisecond}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, nil, listener)
+	require.NoError(t, err)
+
+	start := time.Now()
+	require.NoError(t, p.Exec(context.Background(), r))
+	// 40 transitions each waiting on a 100ms listener would take 4 seconds
+	assert.Less(t, time.Since(start), time.Second)
+
+	// The listener still gets the final status before Exec returns
+	assert.Equal(t, []StatusCount{
+		{State: STATE_DONE, Completed: 20, Terminal: true},
+		{State: STATE_MIDDLE, Executed: 20, Retries: RetryHistogram{20}},
+		{State: TRIGGER_STATE_NEW, Executed: 20, Retries: RetryHistogram{20}},
+	}, listener.latest)
+}
+
+func TestProcessor_Router(t *testing.T) {
+	t.Parallel()
+	oc := MyOverallContext{}
+	ac := MyAppContext{}
+	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
+	for i := 0; i < 10; i++ {
+		r.AddJob(MyJobContext{Count: i})
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				jc.Name = "worked"
+				// The router decides where the job goes, so the state returned here is ignored
+				return jc, TRIGGER_STATE_NEW, nil, nil
+			},
+			Router: func(jc MyJobContext) string {
+				if jc.Count%2 == 0 {
+					return STATE_DONE
+				}
+				return STATE_DONE_TWO
+			},
+			Concurrency: 10,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+		{
+			TriggerState: STATE_DONE_TWO,
+			Terminal:     true,
+		},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	for _, j := range r.Jobs {
+		assert.Equal(t, "worked", j.C.Name)
+		if j.C.Count%2 == 0 {
+			assert.Equal(t, STATE_DONE, j.State)
+		} else {
+			assert.Equal(t, STATE_DONE_TWO, j.State)
+		}
+	}
+}
+
+func TestProcessor_Submit(t *testing.T) {
+	t.Parallel()
+	oc := MyOverallContext{}
+	ac := MyAppContext{}
+	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
+	for i := 0; i < 2; i++ {
+		r.AddJob(MyJobContext{})
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				jc.Count++
+				return jc, STATE_MIDDLE, nil, nil
+			},
+			Concurrency: 2,
+		},
+		{
+			TriggerState: STATE_MIDDLE,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				jc.Count++
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 2,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, nil, nil)
+	require.NoError(t, err)
+
+	assert.Error(t, p.SubmitWithState(MyJobContext{}, "unknown"))
+
+	// Submitting before Exec starts waits for it, and keeps Exec going until Close
+	go func() {
+		assert.NoError(t, p.Submit(MyJobContext{Name: "submitted"}))
+		time.Sleep(100 * time.Millisecond)
+		for i := 0; i < 5; i++ {
+			assert.NoError(t, p.SubmitWithState(MyJobContext{Name: "submitted", Count: 1}, STATE_MIDDLE))
+		}
+		p.Close()
+	}()
+
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	assert.Equal(t, 8, len(r.Jobs))
+	for _, j := range r.Jobs {
+		assert.Equal(t, STATE_DONE, j.State)
+		assert.Equal(t, 2, j.C.Count)
+	}
+
+	assert.ErrorIs(t, p.Submit(MyJobContext{}), ErrProcessorClosed)
+}
+
+type maxWaitingStatusListener struct {
+	m          sync.Mutex
+	state      string
+	maxWaiting int
+}
+
+func (l *maxWaitingStatusListener) StatusUpdate(status []StatusCount) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	for _, s := range status {
+		if s.State == l.state && s.Waiting > l.maxWaiting {
+			l.maxWaiting = s.Waiting
+		}
+	}
+}
+
+func TestProcessor_HighWaterMark(t *testing.T) {
+	t.Parallel()
+	oc := MyOverallContext{}
+	ac := MyAppContext{}
+	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
+	for i := 0; i < 10; i++ {
+		r.AddJob(MyJobContext{})
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				kicks := []KickRequest[MyJobContext]{}
+				for i := 0; i < 10; i++ {
+					kicks = append(kicks, KickRequest[MyJobContext]{State: STATE_MIDDLE})
+				}
+				return jc, STATE_DONE, kicks, nil
+			},
+			Concurrency: 1,
+		},
+		{
+			TriggerState: STATE_MIDDLE,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				time.Sleep(5 * time.Millisecond)
+				return jc, STATE_DONE_TWO, nil, nil
+			},
+			Concurrency:   1,
+			HighWaterMark: 5,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+		{
+			TriggerState: STATE_DONE_TWO,
+			Terminal:     true,
+		},
+	}
+
+	listener := &maxWaitingStatusListener{state: STATE_MIDDLE}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, nil, listener)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	stateCount := map[string]int{}
+	for _, j := range r.Jobs {
+		stateCount[j.State] += 1
+	}
+	assert.Equal(t, 10, stateCount[STATE_DONE])
+	assert.Equal(t, 100, stateCount[STATE_DONE_TWO])
+
+	// Without backpressure the first state would kick all 100 jobs into the middle state almost immediately.
+	// With it, the middle state can only overshoot its mark by the kicks of the one upstream job in flight.
+	assert.LessOrEqual(t, listener.maxWaiting, 5+10)
+}
+
+func TestSampleJob(t *testing.T) {
+	t.Parallel()
+	assert.True(t, sampleJob("0", 0), "zero samples every job")
+	assert.True(t, sampleJob("0", 1))
+
+	sampled := 0
+	for i := 0; i < 10000; i++ {
+		id := fmt.Sprintf("%d", i)
+		if sampleJob(id, 0.1) {
+			sampled++
+		}
+		assert.Equal(t, sampleJob(id, 0.1), sampleJob(id, 0.1), "sampling should be deterministic")
+	}
+	assert.InDelta(t, 1000, sampled, 200)
+}
+
+var errPermanent = errors.New("bad input")
+
+func TestProcessor_ErrorRouter(t *testing.T) {
+	t.Parallel()
+	oc := MyOverallContext{}
+	ac := MyAppContext{}
+	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
+	for i := 0; i < 10; i++ {
+		r.AddJob(MyJobContext{Count: i})
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				switch {
+				case jc.Count == 0:
+					return jc, STATE_DONE, nil, fmt.Errorf("job zero: %w", errPermanent)
+				case jc.Count%2 == 1 && jc.Name == "":
+					jc.Name = "retried"
+					return jc, STATE_DONE, nil, errors.New("transient")
+				}
+				return jc, STATE_DONE, nil, nil
+			},
+			ErrorRouter: func(err error, jc MyJobContext) (string, bool) {
+				if errors.Is(err, errPermanent) {
+					return "", false
+				}
+				return "", true
+			},
+			Concurrency:  10,
+			FailureState: STATE_FAILED,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+		{
+			TriggerState: STATE_FAILED,
+			Terminal:     true,
+		},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	for _, j := range r.Jobs {
+		switch {
+		case j.C.Count == 0:
+			assert.Equal(t, STATE_FAILED, j.State)
+			assert.Equal(t, []string{"job zero: bad input"}, j.StateErrors[TRIGGER_STATE_NEW])
+		case j.C.Count%2 == 1:
+			assert.Equal(t, STATE_DONE, j.State)
+			assert.Equal(t, "retried", j.C.Name)
+			assert.Equal(t, []string{"transient"}, j.StateErrors[TRIGGER_STATE_NEW])
+		default:
+			assert.Equal(t, STATE_DONE, j.State)
+			assert.Empty(t, j.StateErrors[TRIGGER_STATE_NEW])
+		}
+	}
+}
+
+func TestProcessor_IsRetryable(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 6; i++ {
+		r.AddJob(MyJobContext{Count: i})
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			// Every job fails its first try, half with a deadline and half with bad input
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				if jc.Name != "" {
+					return jc, STATE_DONE, nil, nil
+				}
+				jc.Name = "tried"
+				if jc.Count%2 == 0 {
+					return jc, STATE_DONE, nil, fmt.Errorf("calling api: %w", context.DeadlineExceeded)
+				}
+				return jc, STATE_DONE, nil, fmt.Errorf("job %d: %w", jc.Count, errPermanent)
+			},
+			IsRetryable:  IsTransient,
+			Concurrency:  3,
+			FailureState: STATE_FAILED,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+		{
+			TriggerState: STATE_FAILED,
+			Terminal:     true,
+		},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	for _, j := range r.Jobs {
+		require.Len(t, j.StateErrors[TRIGGER_STATE_NEW], 1)
+		if j.C.Count%2 == 0 {
+			assert.Equal(t, STATE_DONE, j.State, "deadlines are retried")
+		} else {
+			assert.Equal(t, STATE_FAILED, j.State, "bad input isn't")
+		}
+	}
+
+	// Classifying errors needs somewhere to send the ones that aren't retried
+	states[0].FailureState = ""
+	_, err = NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	assert.ErrorIs(t, err, ErrMissingFailureState)
+}
+
+func TestRetryOn(t *testing.T) {
+	t.Parallel()
+	retryable := RetryOn(context.DeadlineExceeded, io.ErrUnexpectedEOF)
+	assert.True(t, retryable(fmt.Errorf("reading: %w", io.ErrUnexpectedEOF)))
+	assert.True(t, retryable(context.DeadlineExceeded))
+	assert.False(t, retryable(errPermanent))
+}
+
+func TestIsTransient(t *testing.T) {
+	t.Parallel()
+	assert.True(t, IsTransient(fmt.Errorf("calling api: %w", context.DeadlineExceeded)))
+	assert.True(t, IsTransient(ErrExecTimeout))
+	assert.True(t, IsTransient(&net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}))
+	assert.True(t, IsTransient(fmt.Errorf("calling api: %w", errRateLimited{after: time.Second})))
+	assert.False(t, IsTransient(errPermanent))
+	assert.False(t, IsTransient(&net.OpError{Op: "dial", Err: errors.New("connection refused")}))
+}
+
+type breakerStatusListener struct {
+	m     sync.Mutex
+	state string
+	seen  map[BreakerState]bool
+}
+
+func (l *breakerStatusListener) StatusUpdate(status []StatusCount) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	for _, s := range status {
+		if s.State == l.state {
+			l.seen[s.Breaker] = true
+		}
+	}
+}
+
+func TestProcessor_CircuitBreaker(t *testing.T) {
+	t.Parallel()
+	oc := MyOverallContext{}
+	ac := MyAppContext{}
+	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
+	for i := 0; i < 5; i++ {
+		r.AddJob(MyJobContext{})
+	}
+
+	cooldown := 200 * time.Millisecond
+	var m sync.Mutex
+	calls := []time.Time{}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				m.Lock()
+				defer m.Unlock()
+				calls = append(calls, time.Now())
+				// The service is down for the first three calls
+				if len(calls) <= 3 {
+					return jc, TRIGGER_STATE_NEW, nil, errors.New("service unavailable")
+				}
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency:      1,
+			BreakerThreshold: 2,
+			BreakerCooldown:  cooldown,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	listener := &breakerStatusListener{state: TRIGGER_STATE_NEW, seen: map[BreakerState]bool{}}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, nil, listener)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	for _, j := range r.Jobs {
+		assert.Equal(t, STATE_DONE, j.State)
+	}
+
+	// Two failures open the breaker, the trial after the cooldown fails and opens it again,
+	// and the next trial succeeds and closes it
+	require.Len(t, calls, 8)
+	assert.Less(t, calls[1].Sub(calls[0]), cooldown)
+	assert.GreaterOrEqual(t, calls[2].Sub(calls[1]), cooldown)
+	assert.GreaterOrEqual(t, calls[3].Sub(calls[2]), cooldown)
+	assert.Less(t, calls[7].Sub(calls[3]), cooldown)
+	assert.True(t, listener.seen[BreakerOpen])
+}
+
+func TestNewProcessor_BreakerRequiresCooldown(t *testing.T) {
+	t.Parallel()
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency:      1,
+			BreakerThreshold: 3,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	_, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	assert.Error(t, err)
+}
+
+func TestProcessor_TimeoutKeepsPartialProgress(t *testing.T) {
+	t.Parallel()
+	oc := MyOverallContext{}
+	ac := MyAppContext{}
+	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
+	r.AddJob(MyJobContext{Name: "honors-context"})
+	r.AddJob(MyJobContext{Name: "ignores-context"})
+	r.AddJob(MyJobContext{Name: "fast"})
+
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				jc.Count++
+				switch jc.Name {
+				case "honors-context":
+					jc.StringList = append(jc.StringList, "partial")
+					<-ctx.Done()
+					return jc, TRIGGER_STATE_NEW, nil, ctx.Err()
+				case "ignores-context":
+					jc.StringList = append(jc.StringList, "saved")
+					SaveProgress(ctx, jc)
+					time.Sleep(time.Second)
+					jc.StringList = append(jc.StringList, "too late")
+					return jc, STATE_DONE, nil, nil
+				}
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency:  3,
+			Timeout:      50 * time.Millisecond,
+			MaxTimeouts:  1,
+			TimeoutState: STATE_FAILED,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+		{
+			TriggerState: STATE_FAILED,
+			Terminal:     true,
+		},
+	}
+
+	listener := &recordingStatusListener{}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, nil, listener)
+	require.NoError(t, err)
+
+	start := time.Now()
+	require.NoError(t, p.Exec(context.Background(), r))
+	assert.Less(t, time.Since(start), time.Second, "shouldn't wait for Exec that ignores the timeout")
+
+	for _, j := range r.Jobs {
+		switch j.C.Name {
+		case "honors-context":
+			assert.Equal(t, STATE_FAILED, j.State)
+			// One try and one retry, keeping what Exec returned from the last one
+			assert.Equal(t, 2, j.C.Count)
+			assert.Equal(t, []string{"partial", "partial"}, j.C.StringList)
+			assert.Len(t, j.StateErrors[TRIGGER_STATE_NEW], 2)
+		case "ignores-context":
+			assert.Equal(t, STATE_FAILED, j.State)
+			assert.Equal(t, 2, j.C.Count)
+			assert.Equal(t, []string{"saved", "saved"}, j.C.StringList)
+		default:
+			assert.Equal(t, STATE_DONE, j.State)
+			assert.Equal(t, 0, j.Timeouts)
+		}
+	}
+
+	updates := listener.Updates()
+	require.NotEmpty(t, updates)
+	final := updates[len(updates)-1]
+	for _, s := range final {
+		if s.State == TRIGGER_STATE_NEW {
+			assert.Equal(t, 2, s.TimedOut)
+		}
+	}
+}
+
+func TestProcessor_DelayState(t *testing.T) {
+	t.Parallel()
+	oc := MyOverallContext{}
+	ac := MyAppContext{}
+	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
+	for i := 0; i < 100; i++ {
+		r.AddJob(MyJobContext{})
+	}
+	delay := 50 * time.Millisecond
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			// Poll a few times, waiting in the delay state in between
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				jc.Count++
+				if jc.Count < 3 {
+					return jc, STATE_MIDDLE, nil, nil
+				}
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		DelayState[MyAppContext, MyOverallContext, MyJobContext](STATE_MIDDLE, delay, TRIGGER_STATE_NEW),
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, nil, nil)
+	require.NoError(t, err)
+
+	start := time.Now()
+	require.NoError(t, p.Exec(context.Background(), r))
+	elapsed := time.Since(start)
+
+	for _, j := range r.Jobs {
+		assert.Equal(t, STATE_DONE, j.State)
+		assert.Equal(t, 3, j.C.Count)
+	}
+	// Every job waits twice, but the jobs wait alongside each other rather than tying up the one worker
+	assert.GreaterOrEqual(t, elapsed, 2*delay)
+	assert.Less(t, elapsed, 20*delay)
+}
+
+func TestNewProcessor_DelayStateRequiresNextState(t *testing.T) {
+	t.Parallel()
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Delay:        time.Second,
+			NextState:    "missing",
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	_, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	assert.Error(t, err)
+}
+
+func TestProcessor_ExecC(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{Name: "overall"})
+	r.AddJob(MyJobContext{Count: 1})
+
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			ExecC: func(ec ExecContext[MyAppContext, MyOverallContext, MyJobContext]) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				jc := ec.Job
+				jc.Name = ec.Overall.Name
+				// It's the Exec's context too
+				Annotate(ec, "via", "execc")
+				return jc, STATE_MIDDLE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{
+			TriggerState: STATE_MIDDLE,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				jc.Count++
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	j := r.Jobs["0"]
+	assert.Equal(t, STATE_DONE, j.State)
+	assert.Equal(t, "overall", j.C.Name)
+	assert.Equal(t, 2, j.C.Count)
+	assert.Equal(t, map[string]string{"via": "execc"}, j.Annotations)
+	assert.Nil(t, states[0].Exec, "the states passed in are left alone")
+
+	// One or the other
+	states[0].Exec = states[1].Exec
+	_, err = NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	assert.ErrorIs(t, err, ErrConflictingExec)
+}
+
+func TestProcessor_JobIdAndAttempt(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	r.AddJob(MyJobContext{})
+
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				if Attempt(ctx) == 1 {
+					return jc, TRIGGER_STATE_NEW, nil, errors.New("flaked")
+				}
+				jc.Name = fmt.Sprintf("%s#%d", JobId(ctx), Attempt(ctx))
+				return jc, STATE_DONE, []KickRequest[MyJobContext]{{State: STATE_MIDDLE}}, nil
+			},
+			Concurrency: 1,
+			Timeout:     time.Minute,
+		},
+		{
+			TriggerState: STATE_MIDDLE,
+			ExecC: func(ec ExecContext[MyAppContext, MyOverallContext, MyJobContext]) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				jc := ec.Job
+				jc.Name = fmt.Sprintf("%s#%d", ec.JobId, ec.Attempt)
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	assert.Equal(t, "0#2", r.Jobs["0"].C.Name)
+	assert.Equal(t, "0->0#1", r.Jobs["0->0"].C.Name, "kicked jobs see their derived id")
+
+	assert.Empty(t, JobId(context.Background()))
+	assert.Zero(t, Attempt(context.Background()))
+}
+
+func TestProcessor_PreExecAndPostExec(t *testing.T) {
+	t.Parallel()
+	oc := MyOverallContext{}
+	ac := MyAppContext{}
+	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
+	for i := 0; i < 10; i++ {
+		r.AddJob(MyJobContext{Count: i})
+	}
+	errMalformed := errors.New("malformed job")
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				jc.Name += "-exec"
+				return jc, STATE_DONE, nil, nil
+			},
+			ErrorRouter: func(err error, jc MyJobContext) (string, bool) {
+				return STATE_FAILED, false
+			},
+			Concurrency: 5,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+		{
+			TriggerState: STATE_FAILED,
+			Terminal:     true,
+		},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, nil, nil)
+	require.NoError(t, err)
+	p.PreExec = func(ctx context.Context, ac MyAppContext, state string, jc MyJobContext) (MyJobContext, error) {
+		assert.Equal(t, TRIGGER_STATE_NEW, state)
+		if jc.Count%2 == 1 {
+			// Thrown away along with the error
+			return MyJobContext{Name: "clobbered"}, errMalformed
+		}
+		jc.Name = "pre"
+		return jc, nil
+	}
+	p.PostExec = func(ctx context.Context, ac MyAppContext, state string, jc MyJobContext, err error) (MyJobContext, error) {
+		assert.NoError(t, err)
+		jc.Name += "-post"
+		return jc, err
+	}
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	for _, j := range r.Jobs {
+		if j.C.Count%2 == 1 {
+			// Rejected jobs never reach Exec or PostExec, and keep the context they had
+			assert.Equal(t, STATE_FAILED, j.State)
+			assert.Equal(t, "", j.C.Name)
+			assert.Equal(t, []string{errMalformed.Error()}, j.StateErrors[TRIGGER_STATE_NEW])
+		} else {
+			assert.Equal(t, STATE_DONE, j.State)
+			assert.Equal(t, "pre-exec-post", j.C.Name)
+		}
+	}
+}
+
+type errRateLimited struct {
+	after time.Duration
+}
+
+func (e errRateLimited) Error() string {
+	return "rate limited"
+}
+
+func (e errRateLimited) RetryAfter() time.Duration {
+	return e.after
+}
+
+func TestProcessor_LoopIsNotRetry(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	r.AddJob(MyJobContext{})
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				// Poll a few times before moving on
+				jc.Count++
+				if jc.Count < 10 {
+					time.Sleep(time.Millisecond)
+					return jc, TRIGGER_STATE_NEW, nil, nil
+				}
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+			// Any of these would trip on the loop if it counted as retrying
+			RetryDelay:       time.Hour,
+			MaxStateAge:      time.Nanosecond,
+			BreakerThreshold: 1,
+			BreakerCooldown:  time.Hour,
+			FailureState:     STATE_FAILED,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+		{TriggerState: STATE_FAILED, Terminal: true},
+	}
+
+	listener := &slowStatusListener{}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, listener)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	j := r.Jobs["0"]
+	assert.Equal(t, STATE_DONE, j.State)
+	assert.Equal(t, 10, j.C.Count)
+	assert.Empty(t, j.StateErrors)
+
+	final := map[string]StatusCount{}
+	for _, status := range listener.latest {
+		final[status.State] = status
+	}
+	assert.Equal(t, 10, final[TRIGGER_STATE_NEW].Executed)
+	assert.Zero(t, final[TRIGGER_STATE_NEW].Errored)
+	assert.Equal(t, BreakerClosed, final[TRIGGER_STATE_NEW].Breaker)
+	assert.Equal(t, RetryHistogram{1}, final[TRIGGER_STATE_NEW].Retries, "looping isn't retrying")
+}
+
+func TestProcessor_MinInterval(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	r.AddJob(MyJobContext{Name: "a"})
+	r.AddJob(MyJobContext{Name: "b"})
+
+	const interval = 30 * time.Millisecond
+	var m sync.Mutex
+	execs := map[string][]time.Time{}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				m.Lock()
+				execs[jc.Name] = append(execs[jc.Name], time.Now())
+				m.Unlock()
+				// Loop three times, once by erroring and once through another state
+				jc.Count++
+				switch jc.Count {
+				case 1:
+					return jc, TRIGGER_STATE_NEW, nil, nil
+				case 2:
+					return jc, TRIGGER_STATE_NEW, nil, errors.New("flaky")
+				case 3:
+					return jc, STATE_MIDDLE, nil, nil
+				}
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 2,
+			MinInterval: interval,
+		},
+		{
+			TriggerState: STATE_MIDDLE,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, TRIGGER_STATE_NEW, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	// Each job is paced on its own, so the two jobs still run alongside each other
+	for _, name := range []string{"a", "b"} {
+		times := execs[name]
+		require.Len(t, times, 4, name)
+		for i := 1; i < len(times); i++ {
+			assert.GreaterOrEqual(t, times[i].Sub(times[i-1]), interval, "%s exec %d", name, i)
+		}
+	}
+	assert.Empty(t, p.lastExecs, "finished jobs are forgotten")
+
+	states[0].MinInterval = -time.Second
+	_, err = NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	assert.ErrorIs(t, err, ErrNegativeSetting)
+}
+
+func TestProcessor_RetryDelay(t *testing.T) {
+	t.Parallel()
+	oc := MyOverallContext{}
+	ac := MyAppContext{}
+	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
+	for i := 0; i < 4; i++ {
+		r.AddJob(MyJobContext{Count: i})
+	}
+	retryDelay := 50 * time.Millisecond
+	retryAfter := 150 * time.Millisecond
+
+	var m sync.Mutex
+	attempts := map[int][]time.Time{}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				m.Lock()
+				attempts[jc.Count] = append(attempts[jc.Count], time.Now())
+				first := len(attempts[jc.Count]) == 1
+				m.Unlock()
+
+				if !first {
+					return jc, STATE_DONE, nil, nil
+				}
+				// Even jobs get a hint from the "server", odd jobs fall back to the state's RetryDelay
+				if jc.Count%2 == 0 {
+					return jc, TRIGGER_STATE_NEW, nil, fmt.Errorf("calling api: %w", errRateLimited{after: retryAfter})
+				}
+				return jc, TRIGGER_STATE_NEW, nil, errors.New("flaky")
+			},
+			RetryDelay:  retryDelay,
+			Concurrency: 4,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	for _, j := range r.Jobs {
+		assert.Equal(t, STATE_DONE, j.State)
+		require.Len(t, attempts[j.C.Count], 2)
+		gap := attempts[j.C.Count][1].Sub(attempts[j.C.Count][0])
+		if j.C.Count%2 == 0 {
+			assert.GreaterOrEqual(t, gap, retryAfter)
+		} else {
+			assert.GreaterOrEqual(t, gap, retryDelay)
+			assert.Less(t, gap, retryAfter)
+		}
+	}
+}
+
+type rateLimitedStatusListener struct {
+	m     sync.Mutex
+	state string
+	max   int
+	last  int
+}
+
+func (l *rateLimitedStatusListener) StatusUpdate(status []StatusCount) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	for _, s := range status {
+		if s.State == l.state {
+			l.max = max(l.max, s.RateLimited)
+			l.last = s.RateLimited
+		}
+	}
+}
+
+func TestProcessor_RateLimitedCount(t *testing.T) {
+	t.Parallel()
+	oc := MyOverallContext{}
+	ac := MyAppContext{}
+	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
+	for i := 0; i < 6; i++ {
+		r.AddJob(MyJobContext{})
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 3,
+			RateLimit:   rate.NewLimiter(rate.Every(20*time.Millisecond), 1),
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	listener := &rateLimitedStatusListener{state: TRIGGER_STATE_NEW}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, nil, listener)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	for _, j := range r.Jobs {
+		assert.Equal(t, STATE_DONE, j.State)
+	}
+	// With 3 workers and a limiter letting one job through at a time, workers must have queued up on it
+	assert.Greater(t, listener.max, 0)
+	assert.LessOrEqual(t, listener.max, 3)
+	assert.Equal(t, 0, listener.last)
+}
+
+func TestProcessor_RequeueAfter(t *testing.T) {
+	t.Parallel()
+	oc := MyOverallContext{}
+	ac := MyAppContext{}
+	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
+	for i := 0; i < 10; i++ {
+		r.AddJob(MyJobContext{})
+	}
+	pollInterval := 50 * time.Millisecond
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			// Not ready until the third poll, so check back later rather than busy looping
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				jc.Count++
+				if jc.Count < 3 {
+					RequeueAfter(ctx, pollInterval)
+					return jc, TRIGGER_STATE_NEW, nil, nil
+				}
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, nil, nil)
+	require.NoError(t, err)
+
+	start := time.Now()
+	require.NoError(t, p.Exec(context.Background(), r))
+	elapsed := time.Since(start)
+
+	for _, j := range r.Jobs {
+		assert.Equal(t, STATE_DONE, j.State)
+		assert.Equal(t, 3, j.C.Count)
+		assert.Empty(t, j.StateErrors[TRIGGER_STATE_NEW])
+	}
+	// The jobs wait out their poll intervals together, not one after another on the single worker
+	assert.GreaterOrEqual(t, elapsed, 2*pollInterval)
+	assert.Less(t, elapsed, 10*pollInterval)
+}
+
+func TestProcessor_ErrorAndRetryMetrics(t *testing.T) {
+	t.Parallel()
+	oc := MyOverallContext{}
+	ac := MyAppContext{}
+	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
+	for i := 0; i < 6; i++ {
+		r.AddJob(MyJobContext{Count: i})
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			// Each job fails as many times as its count before succeeding
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				if jc.Count > 0 {
+					jc.Count--
+					return jc, TRIGGER_STATE_NEW, nil, errors.New("flaky")
+				}
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 2,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	listener := &slowStatusListener{}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, nil, listener)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	status := listener.latest[1]
+	require.Equal(t, TRIGGER_STATE_NEW, status.State)
+	assert.Equal(t, 21, status.Executed)
+	assert.Equal(t, 15, status.Errored)
+	assert.InDelta(t, 15.0/21.0, status.ErrorRate(), 0.0001)
+	// The job retried 5 times lands in the last bucket along with the one retried 4 times
+	assert.Equal(t, RetryHistogram{1, 1, 1, 1, 2}, status.Retries)
+	assert.InDelta(t, 14.0/6.0, status.Retries.Average(), 0.0001)
+}
+
+type slowSerializer struct {
+	m      sync.Mutex
+	delay  time.Duration
+	latest Run[MyOverallContext, MyJobContext]
+}
+
+func (s *slowSerializer) Serialize(r Run[MyOverallContext, MyJobContext]) error {
+	time.Sleep(s.delay)
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.latest = r
+	return nil
+}
+
+func (s *slowSerializer) Deserialize() (*Run[MyOverallContext, MyJobContext], error) {
+	return nil, errors.New("not implemented")
+}
+
+func TestProcessor_SlowSerializerDoesNotStall(t *testing.T) {
+	t.Parallel()
+	oc := MyOverallContext{}
+	ac := MyAppContext{}
+	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
+	for i := 0; i < 20; i++ {
+		r.AddJob(MyJobContext{})
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_MIDDLE, nil, nil
+			},
+			Concurrency: 2,
+		},
+		{
+			TriggerState: STATE_MIDDLE,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 2,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	serializer := &slowSerializer{delay: 100 * time.Millisecond}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, serializer, nil)
+	require.NoError(t, err)
+
+	start := time.Now()
+	require.NoError(t, p.Exec(context.Background(), r))
+	// 40 transitions each waiting on a 100ms save would take 4 seconds
+	assert.Less(t, time.Since(start), time.Second)
+
+	// The final state of the run is still saved before Exec returns
+	require.Len(t, serializer.latest.Jobs, 20)
+	for _, j := range serializer.latest.Jobs {
+		assert.Equal(t, STATE_DONE, j.State)
+	}
+}
+
+func TestProcessor_WaitingJobsAndDrainWaiting(t *testing.T) {
+	t.Parallel()
+	oc := MyOverallContext{}
+	ac := MyAppContext{}
+	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
+	for i := 0; i < 5; i++ {
+		r.AddJob(MyJobContext{Count: i})
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				started <- struct{}{}
+				<-release
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, nil, nil)
+	require.NoError(t, err)
+
+	execErr := make(chan error)
+	go func() {
+		execErr <- p.Exec(context.Background(), r)
+	}()
+
+	// One job is executing and holding up the rest
+	<-started
+	waiting, err := p.WaitingJobs(TRIGGER_STATE_NEW)
+	require.NoError(t, err)
+	assert.Len(t, waiting, 4)
+
+	_, err = p.WaitingJobs("missing")
+	assert.Error(t, err)
+
+	drained, err := p.DrainWaiting(TRIGGER_STATE_NEW)
+	require.NoError(t, err)
+	assert.Len(t, drained, 4)
+
+	waiting, err = p.WaitingJobs(TRIGGER_STATE_NEW)
+	require.NoError(t, err)
+	assert.Empty(t, waiting)
+
+	close(release)
+	require.NoError(t, <-execErr)
+
+	// Only the job that was executing is left in the run
+	require.Len(t, r.Jobs, 1)
+	for _, j := range r.Jobs {
+		assert.Equal(t, STATE_DONE, j.State)
+	}
+
+	_, err = p.WaitingJobs(TRIGGER_STATE_NEW)
+	assert.ErrorIs(t, err, ErrProcessorFinished)
+}
+
+func TestProcessor_ReRoute(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 5; i++ {
+		r.AddJob(MyJobContext{Count: i})
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				started <- struct{}{}
+				<-release
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{
+			TriggerState: STATE_MIDDLE,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE_TWO, nil, nil
+			},
+			Concurrency: 2,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+		{TriggerState: STATE_DONE_TWO, Terminal: true},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+
+	execErr := make(chan error)
+	go func() {
+		execErr <- p.Exec(context.Background(), r)
+	}()
+
+	// One job is executing and holding up the rest, which get sent down the other path
+	<-started
+	_, err = p.ReRoute(TRIGGER_STATE_NEW, "missing")
+	assert.ErrorIs(t, err, ErrUnknownState)
+	_, err = p.ReRoute(TRIGGER_STATE_NEW, TRIGGER_STATE_NEW)
+	assert.Error(t, err)
+
+	moved, err := p.ReRoute(TRIGGER_STATE_NEW, STATE_MIDDLE)
+	require.NoError(t, err)
+	assert.Equal(t, 4, moved)
+
+	close(release)
+	require.NoError(t, <-execErr)
+	assert.Equal(t, map[string]int{STATE_DONE: 1, STATE_DONE_TWO: 4}, r.TerminalCounts())
+
+	_, err = p.ReRoute(TRIGGER_STATE_NEW, STATE_MIDDLE)
+	assert.ErrorIs(t, err, ErrProcessorFinished)
+}
+
+func TestProcessor_OnStateDrained(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	r.AddJob(MyJobContext{})
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_MIDDLE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{
+			TriggerState: STATE_MIDDLE,
+			// Loops back through new once
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				jc.Count++
+				if jc.Count == 1 {
+					return jc, TRIGGER_STATE_NEW, nil, nil
+				}
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	drained := []string{}
+	p.OnStateDrained = func(state string) {
+		drained = append(drained, state)
+	}
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	// Each state drains again after the job comes back through it
+	assert.Equal(t, []string{TRIGGER_STATE_NEW, STATE_MIDDLE, TRIGGER_STATE_NEW, STATE_MIDDLE}, drained)
+}
+
+func TestProcessor_SequentialRuns(t *testing.T) {
+	t.Parallel()
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				jc.Name = oc.Name
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 2,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+	listener := &recordingStatusListener{}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, listener)
+	require.NoError(t, err)
+
+	for i, jobs := range []int{5, 3} {
+		name := fmt.Sprintf("run-%d", i)
+		r := NewRun[MyOverallContext, MyJobContext](name, MyOverallContext{Name: name})
+		for j := 0; j < jobs; j++ {
+			r.AddJob(MyJobContext{})
+		}
+		require.NoError(t, p.Exec(context.Background(), r))
+
+		for _, j := range r.Jobs {
+			assert.Equal(t, name, j.C.Name)
+		}
+		// Each run's counts start from zero rather than adding to the last run's
+		updates := listener.Updates()
+		require.NotEmpty(t, updates)
+		final := updates[len(updates)-1]
+		assert.Equal(t, StatusCount{State: STATE_DONE, Completed: jobs, Terminal: true}, final[0])
+		assert.Equal(t, jobs, final[1].Executed)
+	}
+}
+
+func TestProcessor_SubmitAndCloseSequentialRuns(t *testing.T) {
+	t.Parallel()
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+
+	// The Close of the first run doesn't carry over into the second
+	for i := 0; i < 2; i++ {
+		r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+		r.AddJob(MyJobContext{})
+		go func() {
+			assert.NoError(t, p.Submit(MyJobContext{Name: "submitted"}))
+			p.Close()
+		}()
+		require.NoError(t, p.Exec(context.Background(), r))
+
+		require.Len(t, r.Jobs, 2)
+		for _, j := range r.Jobs {
+			assert.Equal(t, STATE_DONE, j.State)
+		}
+	}
+}
+
+func TestProcessor_BatchAfterCancelledStreaming(t *testing.T) {
+	t.Parallel()
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				if jc.Name == "block" {
+					<-ctx.Done()
+					return jc, TRIGGER_STATE_NEW, nil, ctx.Err()
+				}
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 2,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+
+	// Submitting keeps the first Exec going until it's cancelled, as it's never closed
+	ctx, cancel := context.WithCancel(context.Background())
+	streaming := NewRun[MyOverallContext, MyJobContext]("streaming", MyOverallContext{})
+	streaming.AddJob(MyJobContext{Name: "block"})
+	go func() {
+		assert.NoError(t, p.Submit(MyJobContext{}))
+		cancel()
+	}()
+	require.NoError(t, p.Exec(ctx, streaming))
+
+	// A plain batch run finishes as soon as its jobs are done, rather than waiting for a Close
+	r := NewRun[MyOverallContext, MyJobContext]("batch", MyOverallContext{})
+	r.AddJob(MyJobContext{})
+	done := make(chan error)
+	go func() {
+		done <- p.Exec(context.Background(), r)
+	}()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch Exec didn't finish")
+	}
+	assert.Equal(t, STATE_DONE, r.Jobs["0"].State)
+}
+
+func TestProcessor_ConcurrentRuns(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	var started atomic.Int32
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				started.Add(1)
+				<-release
+				jc.Name = oc.Name
+				return jc, STATE_MIDDLE, []KickRequest[MyJobContext]{{C: jc, State: STATE_DONE_TWO}}, nil
+			},
+			Concurrency: 2,
+		},
+		{
+			TriggerState: STATE_MIDDLE,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				jc.Count++
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 2,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+		{TriggerState: STATE_DONE_TWO, Terminal: true},
+	}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+
+	runs := []*Run[MyOverallContext, MyJobContext]{}
+	errs := make(chan error)
+	for i := 0; i < 4; i++ {
+		name := fmt.Sprintf("run-%d", i)
+		r := NewRun[MyOverallContext, MyJobContext](name, MyOverallContext{Name: name})
+		for j := 0; j < 2+i; j++ {
+			r.AddJob(MyJobContext{})
+		}
+		runs = append(runs, r)
+		go func() {
+			errs <- p.Exec(context.Background(), r)
+		}()
+	}
+
+	// Every run has its own workers, so they all get going at once
+	require.Eventually(t, func() bool { return started.Load() == 4*2 }, time.Second, time.Millisecond)
+	close(release)
+	for range runs {
+		require.NoError(t, <-errs)
+	}
+
+	for i, r := range runs {
+		assert.Equal(t, map[string]int{STATE_DONE: 2 + i, STATE_DONE_TWO: 2 + i}, r.TerminalCounts(), r.Name)
+		for _, j := range r.Jobs {
+			assert.Equal(t, r.Name, j.C.Name)
+		}
+	}
+
+	// The processor is free again afterwards
+	r := NewRun[MyOverallContext, MyJobContext]("again", MyOverallContext{})
+	r.AddJob(MyJobContext{})
+	require.NoError(t, p.Exec(context.Background(), r))
+	assert.Equal(t, map[string]int{STATE_DONE: 1, STATE_DONE_TWO: 1}, r.TerminalCounts())
+}
+
+func TestProcessor_KeepAlive(t *testing.T) {
+	t.Parallel()
+	oc := MyOverallContext{}
+	ac := MyAppContext{}
+	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, nil, nil)
+	require.NoError(t, err)
+	p.KeepAlive = true
+
+	execErr := make(chan error)
+	go func() {
+		execErr <- p.Exec(context.Background(), r)
+	}()
+
+	// An empty run doesn't finish on its own
+	select {
+	case <-execErr:
+		t.Fatal("Exec finished without Close")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(t, p.Submit(MyJobContext{}))
+	require.Eventually(t, func() bool {
+		j, ok := r.JobByID("0")
+		return ok && j.State == STATE_DONE
+	}, time.Second, 10*time.Millisecond)
+
+	// Nor does it finish once the submitted work is done
+	select {
+	case <-execErr:
+		t.Fatal("Exec finished without Close")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	p.Close()
+	require.NoError(t, <-execErr)
+}
+
+func TestNewProcessor_ConfigErrors(t *testing.T) {
+	t.Parallel()
+	exec := func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+		return jc, STATE_DONE, nil, nil
+	}
+	done := State[MyAppContext, MyOverallContext, MyJobContext]{TriggerState: STATE_DONE, Terminal: true}
+
+	tests := []struct {
+		name     string
+		state    State[MyAppContext, MyOverallContext, MyJobContext]
+		expected error
+	}{
+		{
+			name:     "duplicate state",
+			state:    State[MyAppContext, MyOverallContext, MyJobContext]{TriggerState: STATE_DONE, Terminal: true},
+			expected: ErrDuplicateState,
+		},
+		{
+			name:     "missing exec",
+			state:    State[MyAppContext, MyOverallContext, MyJobContext]{TriggerState: TRIGGER_STATE_NEW, Concurrency: 1},
+			expected: ErrMissingExec,
+		},
+		{
+			name:     "no concurrency",
+			state:    State[MyAppContext, MyOverallContext, MyJobContext]{TriggerState: TRIGGER_STATE_NEW, Exec: exec},
+			expected: ErrNoConcurrency,
+		},
+		{
+			name:     "negative terminal concurrency",
+			state:    State[MyAppContext, MyOverallContext, MyJobContext]{TriggerState: TRIGGER_STATE_NEW, Terminal: true, Concurrency: -1},
+			expected: ErrNegativeConcurrency,
+		},
+		{
+			name:     "negative setting",
+			state:    State[MyAppContext, MyOverallContext, MyJobContext]{TriggerState: TRIGGER_STATE_NEW, Exec: exec, Concurrency: 1, HighWaterMark: -1},
+			expected: ErrNegativeSetting,
+		},
+		{
+			name:     "negative max waiting",
+			state:    State[MyAppContext, MyOverallContext, MyJobContext]{TriggerState: TRIGGER_STATE_NEW, Exec: exec, Concurrency: 1, MaxWaiting: -1},
+			expected: ErrNegativeSetting,
+		},
+		{
+			name:     "negative max state age",
+			state:    State[MyAppContext, MyOverallContext, MyJobContext]{TriggerState: TRIGGER_STATE_NEW, Exec: exec, Concurrency: 1, MaxStateAge: -1, FailureState: STATE_DONE},
+			expected: ErrNegativeSetting,
+		},
+		{
+			name:     "max state age without failure state",
+			state:    State[MyAppContext, MyOverallContext, MyJobContext]{TriggerState: TRIGGER_STATE_NEW, Exec: exec, Concurrency: 1, MaxStateAge: time.Second},
+			expected: ErrMissingFailureState,
+		},
+		{
+			name:     "unknown failure state",
+			state:    State[MyAppContext, MyOverallContext, MyJobContext]{TriggerState: TRIGGER_STATE_NEW, Exec: exec, Concurrency: 1, FailureState: "missing"},
+			expected: ErrUnknownState,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			states := []State[MyAppContext, MyOverallContext, MyJobContext]{done, tt.state}
+			_, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+			assert.ErrorIs(t, err, tt.expected)
+
+			var configErr *StateConfigError
+			require.ErrorAs(t, err, &configErr)
+			assert.Equal(t, tt.state.TriggerState, configErr.State)
+		})
+	}
+}
+
+type tokenAppContext struct {
+	Token int64
+}
+
+func TestProcessor_AppContextProvider(t *testing.T) {
+	t.Parallel()
+	oc := MyOverallContext{}
+	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
+	for i := 0; i < 10; i++ {
+		r.AddJob(MyJobContext{})
+	}
+	states := []State[tokenAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac tokenAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				jc.Count = int(ac.Token)
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 3,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	p, err := NewProcessor[tokenAppContext, MyOverallContext, MyJobContext](tokenAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	// Every job gets a freshly "refreshed" token
+	var token atomic.Int64
+	p.AppContextProvider = func() tokenAppContext {
+		return tokenAppContext{Token: token.Add(1)}
+	}
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	seen := map[int]bool{}
+	for _, j := range r.Jobs {
+		assert.Equal(t, STATE_DONE, j.State)
+		assert.Greater(t, j.C.Count, 0)
+		seen[j.C.Count] = true
+	}
+	assert.Len(t, seen, 10)
+}
+
+func TestProcessor_KickedJobIdsDontCollide(t *testing.T) {
+	t.Parallel()
+	oc := MyOverallContext{}
+	ac := MyAppContext{}
+	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
+	r.AddJob(MyJobContext{})
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			// Loops back through the same state, kicking a job each time
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				jc.Count++
+				kicks := []KickRequest[MyJobContext]{{C: MyJobContext{Count: jc.Count}, State: STATE_DONE_TWO}}
+				if jc.Count < 3 {
+					return jc, TRIGGER_STATE_NEW, kicks, nil
+				}
+				return jc, STATE_DONE, kicks, nil
+			},
+			Concurrency: 1,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+		{
+			TriggerState: STATE_DONE_TWO,
+			Terminal:     true,
+		},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	// Every kick is kept rather than overwriting the one before it
+	require.Len(t, r.Jobs, 4)
+	counts := map[string]int{}
+	for _, j := range r.Jobs {
+		counts[j.Id] = j.C.Count
+	}
+	assert.Equal(t, map[string]int{"0": 3, "0->0": 1, "0->0#1": 2, "0->0#2": 3}, counts)
+}
+
+func TestProcessor_ResourceKey(t *testing.T) {
+	t.Parallel()
+	for _, limit := range []int{0, 2} {
+		t.Run(fmt.Sprintf("limit %d", limit), func(t *testing.T) {
+			t.Parallel()
+			r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+			for i := 0; i < 12; i++ {
+				r.AddJob(MyJobContext{Name: fmt.Sprintf("customer-%d", i%3)})
+			}
+
+			m := sync.Mutex{}
+			inFlight := map[string]int{}
+			maxInFlight := map[string]int{}
+			total, maxTotal := 0, 0
+			exec := func(next string) func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+					m.Lock()
+					inFlight[jc.Name]++
+					total++
+					maxInFlight[jc.Name] = max(maxInFlight[jc.Name], inFlight[jc.Name])
+					maxTotal = max(maxTotal, total)
+					m.Unlock()
+
+					time.Sleep(10 * time.Millisecond)
+
+					m.Lock()
+					inFlight[jc.Name]--
+					total--
+					m.Unlock()
+					return jc, next, nil, nil
+				}
+			}
+			states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+				{TriggerState: TRIGGER_STATE_NEW, Exec: exec(STATE_MIDDLE), Concurrency: 10},
+				{TriggerState: STATE_MIDDLE, Exec: exec(STATE_DONE), Concurrency: 10},
+				{TriggerState: STATE_DONE, Terminal: true},
+			}
+
+			p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+			require.NoError(t, err)
+			p.ResourceKey = func(jc MyJobContext) string { return jc.Name }
+			p.ResourceLimit = limit
+			require.NoError(t, p.Exec(context.Background(), r))
+
+			for _, j := range r.Jobs {
+				assert.Equal(t, STATE_DONE, j.State)
+			}
+			// Each customer is held to the limit across both states, but different customers still run together
+			for name, n := range maxInFlight {
+				assert.Equal(t, max(limit, 1), n, name)
+			}
+			assert.Greater(t, maxTotal, max(limit, 1))
+			assert.Empty(t, p.stateStorage.resources)
+		})
+	}
+}
+
+func TestProcessor_AbortRun(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 10; i++ {
+		r.AddJob(MyJobContext{Count: i})
+	}
+	serializer := NewJsonSerializer[MyOverallContext, MyJobContext](filepath.Join(t.TempDir(), "state.json"))
+
+	var execs atomic.Int32
+	abort := true
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				execs.Add(1)
+				if abort && jc.Count == 3 {
+					jc.Name = "changed"
+					return jc, STATE_DONE, nil, fmt.Errorf("quota gone: %w", ErrAbortRun)
+				}
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency:  1,
+			FailureState: STATE_FAILED,
+			IsRetryable:  func(err error) bool { return false },
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+		{TriggerState: STATE_FAILED, Terminal: true},
+	}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, serializer, nil)
+	require.NoError(t, err)
+
+	err = p.Exec(context.Background(), r)
+	require.ErrorIs(t, err, ErrAbortRun)
+	assert.Equal(t, "job 3 in state new: quota gone: run aborted", err.Error())
+	assert.Equal(t, int32(4), execs.Load(), "nothing is started after the abort")
+
+	// The aborting job is left as it was rather than failed, and the rest haven't run
+	resumed, err := serializer.Deserialize()
+	require.NoError(t, err)
+	j := resumed.Jobs["3"]
+	assert.Equal(t, TRIGGER_STATE_NEW, j.State)
+	assert.Empty(t, j.C.Name)
+	assert.Equal(t, []string{"quota gone: run aborted"}, j.StateErrors[TRIGGER_STATE_NEW])
+	assert.Equal(t, map[string]int{STATE_DONE: 3, STATE_FAILED: 0}, resumed.TerminalCounts())
+
+	// Once whatever was wrong is fixed the run picks up where it stopped
+	abort = false
+	require.NoError(t, p.Exec(context.Background(), resumed))
+	assert.Equal(t, int32(11), execs.Load())
+	assert.Equal(t, map[string]int{STATE_DONE: 10, STATE_FAILED: 0}, resumed.TerminalCounts())
+}
+
+func TestProcessor_Source(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	r.AddJob(MyJobContext{Count: -1})
+
+	var maxInRun int32
+	var m sync.Mutex
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				jobs := int32(0)
+				r.ForEachJob(func(j Job[MyJobContext]) { jobs++ })
+				m.Lock()
+				maxInRun = max(maxInRun, jobs)
+				m.Unlock()
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 3,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+	sink := &recordingSink{}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	p.Sink = sink
+	p.EvictTerminal = true
+	p.SourceWindow = 5
+	next := 0
+	p.Source = func() (MyJobContext, bool) {
+		if next == 100 {
+			return MyJobContext{}, false
+		}
+		next++
+		return MyJobContext{Count: next}, true
+	}
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	// Every job made it through without the run ever holding more than the window
+	require.Len(t, sink.jobs, 101)
+	counts := map[int]bool{}
+	for _, j := range sink.jobs {
+		counts[j.C.Count] = true
+	}
+	assert.Len(t, counts, 101)
+	assert.LessOrEqual(t, maxInRun, int32(5))
+	assert.Empty(t, r.Jobs)
+	assert.Equal(t, 101, r.NextJobId)
+
+	// A source with nothing in it finishes straight away
+	p.Source = func() (MyJobContext, bool) {
+		return MyJobContext{}, false
+	}
+	r = NewRun[MyOverallContext, MyJobContext]("empty", MyOverallContext{})
+	require.NoError(t, p.Exec(context.Background(), r))
+	assert.Empty(t, r.Jobs)
+}
+
+func TestProcessor_MaxRuntime(t *testing.T) {
+	t.Parallel()
+	serializer := NewJsonSerializer[MyOverallContext, MyJobContext](filepath.Join(t.TempDir(), "state.json"))
+
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 20; i++ {
+		r.AddJob(MyJobContext{})
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				select {
+				case <-time.After(100 * time.Millisecond):
+					jc.Count++
+					return jc, STATE_DONE, nil, nil
+				case <-ctx.Done():
+					return jc, TRIGGER_STATE_NEW, nil, ctx.Err()
+				}
+			},
+			Concurrency: 2,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, serializer, nil)
+	require.NoError(t, err)
+	p.MaxRuntime = 350 * time.Millisecond
+
+	start := time.Now()
+	err = p.Exec(context.Background(), r)
+	require.ErrorIs(t, err, ErrMaxRuntimeExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	done := 0
+	for _, j := range r.Jobs {
+		// The Execs cut short by the deadline don't count against the job
+		assert.Empty(t, j.StateErrors)
+		if j.State == STATE_DONE {
+			done++
+		}
+	}
+	assert.Greater(t, done, 0)
+	assert.Less(t, done, 20)
+
+	// The final checkpoint has everything that got done, so a later Exec picks up where it stopped
+	resumed, err := serializer.Deserialize()
+	require.NoError(t, err)
+	assert.True(t, r.Equal(resumed))
+
+	p, err = NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, serializer, nil)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), resumed))
+	for _, j := range resumed.Jobs {
+		assert.Equal(t, STATE_DONE, j.State)
+		assert.Equal(t, 1, j.C.Count)
+	}
+}
+
+func TestProcessor_MaxKickDepth(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	r.AddJob(MyJobContext{})
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			// Every job kicks another just like it, forever
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, []KickRequest[MyJobContext]{{C: jc, State: TRIGGER_STATE_NEW}}, nil
+			},
+			Concurrency:  2,
+			MaxKickDepth: 3,
+			FailureState: STATE_FAILED,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+		{
+			TriggerState: STATE_FAILED,
+			Terminal:     true,
+		},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	depths := map[string]int{}
+	for _, j := range r.Jobs {
+		depths[j.Id] = j.Depth
+	}
+	assert.Equal(t, map[string]int{"0": 0, "0->0": 1, "0->0->0": 2, "0->0->0->0": 3}, depths)
+
+	deepest := r.Jobs["0->0->0->0"]
+	assert.Equal(t, STATE_FAILED, deepest.State)
+	assert.Len(t, deepest.StateErrors[TRIGGER_STATE_NEW], 1)
+	assert.Equal(t, STATE_DONE, r.Jobs["0->0->0"].State)
+}
+
+func TestNewProcessor_MaxKickDepthRequiresFailureState(t *testing.T) {
+	t.Parallel()
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency:  1,
+			MaxKickDepth: 3,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	_, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	assert.ErrorIs(t, err, ErrMissingFailureState)
+
+	states[0].MaxKickDepth = -1
+	_, err = NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	assert.ErrorIs(t, err, ErrNegativeSetting)
+}
+
+func TestProcessor_Gauges(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 1; i <= 5; i++ {
+		r.AddJob(MyJobContext{Count: i})
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				jc.Count *= 10
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 2,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	listener := &recordingStatusListener{}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, listener)
+	require.NoError(t, err)
+	p.Gauges = func(r *Run[MyOverallContext, MyJobContext]) map[string]float64 {
+		total := 0
+		r.ForEachJob(func(j Job[MyJobContext]) {
+			total += j.C.Count
+		})
+		return map[string]float64{"total": float64(total)}
+	}
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	updates := listener.Updates()
+	require.NotEmpty(t, updates)
+	assert.Equal(t, map[string]float64{"total": 15}, updates[0][0].Gauges)
+	for _, status := range updates[len(updates)-1] {
+		assert.Equal(t, map[string]float64{"total": 150}, status.Gauges)
+	}
+}
+
+func TestProcessor_StatusInDeclarationOrder(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	r.AddJob(MyJobContext{})
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	listener := &recordingStatusListener{}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, listener)
+	require.NoError(t, err)
+	p.StatusInDeclarationOrder = true
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	for _, status := range listener.Updates() {
+		require.Len(t, status, 2)
+		assert.Equal(t, TRIGGER_STATE_NEW, status[0].State)
+		assert.Equal(t, STATE_DONE, status[1].State)
+	}
+}
+
+func TestProcessor_CancelDuringSlowRateLimit(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 3; i++ {
+		r.AddJob(MyJobContext{})
+	}
+	execs := atomic.Int32{}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				execs.Add(1)
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 3,
+			// One job gets the burst, the others would wait 30 seconds apiece
+			RateLimit: rate.NewLimiter(rate.Every(30*time.Second), 1),
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	require.NoError(t, p.Exec(ctx, r))
+	assert.Less(t, time.Since(start), time.Second, "cancelling should stop the limiter waits straight away")
+
+	// The jobs that never got past the limiter weren't run or charged an error
+	assert.Equal(t, int32(1), execs.Load())
+	stateCount := map[string]int{}
+	for _, j := range r.Jobs {
+		stateCount[j.State]++
+		assert.Empty(t, j.StateErrors)
+	}
+	assert.Equal(t, map[string]int{STATE_DONE: 1, TRIGGER_STATE_NEW: 2}, stateCount)
+}
+
+func TestProcessor_MaxRuntimeClearsRateLimitedCount(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 3; i++ {
+		r.AddJob(MyJobContext{})
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 3,
+			// One job gets the burst, the others are still waiting when the run is cut short
+			RateLimit: rate.NewLimiter(rate.Every(30*time.Second), 1),
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	listener := &rateLimitedStatusListener{state: TRIGGER_STATE_NEW}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, listener)
+	require.NoError(t, err)
+	p.MaxRuntime = 200 * time.Millisecond
+	assert.ErrorIs(t, p.Exec(context.Background(), r), ErrMaxRuntimeExceeded)
+
+	// The waits were cut short too, so the final status no longer counts them
+	assert.Equal(t, 2, listener.max)
+	assert.Equal(t, 0, listener.last)
+}
+
+func TestProcessor_CancelDoesNotWaitForExec(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	r.AddJob(MyJobContext{})
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				// Ignores ctx, so only the test lets it go
+				close(started)
+				<-release
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	start := time.Now()
+	require.NoError(t, p.Exec(ctx, r))
+	assert.Less(t, time.Since(start), time.Second, "cancelling shouldn't wait for the Exec in progress")
+
+	// The job is left to run again when the run is resumed
+	assert.Equal(t, TRIGGER_STATE_NEW, r.Jobs["0"].State)
+}
+
+func TestStateStorage_UnreachableStates(t *testing.T) {
+	t.Parallel()
+	exec := func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+		return jc, STATE_DONE, nil, nil
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{TriggerState: TRIGGER_STATE_NEW, Exec: exec, Concurrency: 1, NextStates: []string{STATE_DONE}, FailureState: STATE_FAILED},
+		{TriggerState: STATE_MIDDLE, Exec: exec, Concurrency: 1, NextStates: []string{STATE_MIDDLE, STATE_DONE_TWO}},
+		{TriggerState: STATE_DONE, Terminal: true},
+		{TriggerState: STATE_DONE_TWO, Terminal: true},
+		{TriggerState: STATE_FAILED, Terminal: true},
+	}
+
+	// Nothing moves jobs into middle, and only middle moves them to done_two
+	stateS := newStateStorageFromStates(states)
+	assert.Equal(t, []string{STATE_MIDDLE}, stateS.unreachableStates(map[string]bool{}))
+	assert.Empty(t, stateS.unreachableStates(map[string]bool{STATE_MIDDLE: true}))
+
+	// Without NextStates on every Exec there's no telling where jobs go
+	states[1].NextStates = nil
+	stateS = newStateStorageFromStates(states)
+	assert.Nil(t, stateS.unreachableStates(map[string]bool{}))
+}
+
+func TestProcessor_WarnsIdleWorkers(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 10; i++ {
+		r.AddJob(MyJobContext{})
+	}
+	exec := func(next string) func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+		return func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+			return jc, next, nil, nil
+		}
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{TriggerState: TRIGGER_STATE_NEW, Exec: exec(STATE_MIDDLE), Concurrency: 100},
+		{TriggerState: STATE_MIDDLE, Exec: exec(STATE_DONE), Concurrency: 10},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	logs := &bytes.Buffer{}
+	p, err := NewProcessorWithOptions(MyAppContext{}, states,
+		WithLogger[MyAppContext, MyOverallContext, MyJobContext](slog.New(slog.NewTextHandler(logs, nil))))
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	assert.Contains(t, logs.String(), "msg=IdleWorkers run=job runId="+r.Id+" state=new concurrency=100 executed=10 suggestedConcurrency=10")
+	assert.NotContains(t, logs.String(), "msg=IdleWorkers run=job runId="+r.Id+" state=middle")
+}
+
+func TestProcessor_WarnsUnreachableStates(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	r.AddJob(MyJobContext{})
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+			NextStates:  []string{STATE_DONE},
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+		{TriggerState: STATE_FAILED, Terminal: true},
+	}
+
+	logs := &bytes.Buffer{}
+	p, err := NewProcessorWithOptions(MyAppContext{}, states,
+		WithLogger[MyAppContext, MyOverallContext, MyJobContext](slog.New(slog.NewTextHandler(logs, nil))))
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	assert.Contains(t, logs.String(), "msg=UnreachableState run=job runId="+r.Id+" state=failed")
+	assert.NotContains(t, logs.String(), "msg=UnreachableState run=job runId="+r.Id+" state=done")
+
+	// Typos in NextStates are caught up front
+	states[0].NextStates = []string{"dnoe"}
+	_, err = NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	assert.ErrorIs(t, err, ErrUnknownState)
+}
+
+func TestProcessor_MultipleEntryStates(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 3; i++ {
+		r.AddJobWithState(MyJobContext{Name: "fetch"}, "fetch")
+	}
+	for i := 0; i < 2; i++ {
+		r.AddJobWithState(MyJobContext{Name: "parse"}, "parse")
+	}
+	exec := func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+		jc.Count++
+		return jc, STATE_DONE, nil, nil
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		// Nothing is ever seeded into new
+		{TriggerState: TRIGGER_STATE_NEW, Exec: exec, Concurrency: 1},
+		{TriggerState: "fetch", Exec: exec, Concurrency: 1},
+		{TriggerState: "parse", Exec: exec, Concurrency: 1},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	listener := &recordingStatusListener{}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, listener)
+	require.NoError(t, err)
+	p.StatusInDeclarationOrder = true
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	updates := listener.Updates()
+	require.NotEmpty(t, updates)
+	assert.Equal(t, []StatusCount{
+		{State: TRIGGER_STATE_NEW},
+		{State: "fetch", Executing: 1, Waiting: 2},
+		{State: "parse", Executing: 1, Waiting: 1},
+		{State: STATE_DONE, Terminal: true},
+	}, updates[0])
+
+	final := updates[len(updates)-1]
+	assert.Equal(t, 5, final[3].Completed)
+	for _, j := range r.Jobs {
+		assert.Equal(t, STATE_DONE, j.State)
+		assert.Equal(t, 1, j.C.Count)
+	}
+}
+
+func TestProcessor_SeededIntoUnknownState(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	r.AddJobWithState(MyJobContext{}, "nope")
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{TriggerState: TRIGGER_STATE_NEW, Terminal: true},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	err = p.Exec(context.Background(), r)
+	assert.ErrorIs(t, err, ErrUnknownState)
+	assert.ErrorIs(t, p.Submit(MyJobContext{}), ErrProcessorFinished)
+}
+
+func TestProcessor_ValidateRun(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	r.AddJob(MyJobContext{})
+	for i := 0; i < 12; i++ {
+		r.AddJobWithState(MyJobContext{}, "nope")
+	}
+	r.AddJobWithState(MyJobContext{}, "also_nope")
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{TriggerState: TRIGGER_STATE_NEW, Terminal: true},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	err = p.ValidateRun(r)
+	assert.ErrorIs(t, err, ErrUnknownState)
+	assert.Equal(t, "jobs 13 are in unknown state also_nope: unknown state\n"+
+		"jobs 1, 2, 3, 4, 5, 6, 7, 8, 9, 10 and 2 more are in unknown state nope: unknown state", err.Error())
+
+	valid := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	valid.AddJob(MyJobContext{})
+	assert.NoError(t, p.ValidateRun(valid))
+}
+
+func TestProcessor_Metrics(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 10; i++ {
+		r.AddJob(MyJobContext{})
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 2,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	// A slow process goroutine leaves workers waiting to hand their jobs back
+	p.Gauges = func(r *Run[MyOverallContext, MyJobContext]) map[string]float64 {
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	}
+	assert.Equal(t, ProcessorMetrics{}, p.Metrics())
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	m := p.Metrics()
+	assert.Equal(t, int64(10), m.Dispatches)
+	assert.Equal(t, int64(10), m.Returns)
+	assert.LessOrEqual(t, m.DispatchesBlocked, m.Dispatches)
+	assert.Greater(t, m.ReturnsBlocked, int64(0))
+	assert.LessOrEqual(t, m.ReturnsBlocked, m.Returns)
+	assert.Greater(t, m.ReturnBlockedTime, time.Duration(0))
+}
+
+func TestProcessor_InlineState(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 10; i++ {
+		r.AddJob(MyJobContext{Count: i})
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, "double", nil, nil
+			},
+			Concurrency: 3,
+		},
+		{
+			TriggerState: "double",
+			// Errors the first time through and kicks a job into itself, to go round the inline state again
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				if jc.Name == "" {
+					jc.Name = "retried"
+					return jc, "double", nil, errors.New("first try")
+				}
+				if jc.Name == "kicked" {
+					return jc, STATE_DONE, nil, nil
+				}
+				jc.Count *= 2
+				return jc, STATE_DONE, []KickRequest[MyJobContext]{{C: MyJobContext{Name: "kicked"}, State: "double"}}, nil
+			},
+			Concurrency: 2,
+			Inline:      true,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	assert.Len(t, r.Jobs, 20)
+	for i := 0; i < 10; i++ {
+		j := r.Jobs[fmt.Sprintf("%d", i)]
+		assert.Equal(t, STATE_DONE, j.State)
+		assert.Equal(t, i*2, j.C.Count)
+		assert.Len(t, j.StateErrors["double"], 1)
+		assert.Equal(t, STATE_DONE, r.Jobs[fmt.Sprintf("%d->0", i)].State)
+	}
+	// Only the jobs in new went through a worker
+	assert.Equal(t, int64(10), p.Metrics().Dispatches)
+	assert.Equal(t, int64(10), p.Metrics().Returns)
+}
+
+func TestNewProcessor_InlineRateLimit(t *testing.T) {
+	t.Parallel()
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+			Inline:      true,
+			RateLimit:   rate.NewLimiter(rate.Every(time.Second), 1),
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	_, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	assert.ErrorIs(t, err, ErrInvalidInline)
+
+	// A timeout would hold up the scheduling goroutine just the same
+	states[0].RateLimit = nil
+	states[0].Timeout = time.Second
+	_, err = NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	assert.ErrorIs(t, err, ErrInvalidInline)
+}
+
+func TestProcessor_Weight(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 12; i++ {
+		// Every third job is big, and one is heavier than the whole budget
+		weight := 1
+		if i%3 == 0 {
+			weight = 3
+		}
+		if i == 6 {
+			weight = 10
+		}
+		r.AddJob(MyJobContext{Count: weight})
+	}
+
+	m := sync.Mutex{}
+	inFlight, maxInFlight, bigAlongside := 0, 0, 0
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				weight := min(jc.Count, 3)
+				m.Lock()
+				inFlight += weight
+				maxInFlight = max(maxInFlight, inFlight)
+				if weight == 3 && inFlight > 3 {
+					bigAlongside++
+				}
+				m.Unlock()
+
+				time.Sleep(20 * time.Millisecond)
+
+				m.Lock()
+				inFlight -= weight
+				m.Unlock()
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 3,
+			Weight: func(jc MyJobContext) int {
+				return jc.Count
+			},
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	assert.Equal(t, map[string]int{STATE_DONE: 12}, r.TerminalCounts())
+	assert.Equal(t, 3, maxInFlight, "small jobs should fill the budget")
+	assert.Zero(t, bigAlongside, "big jobs use the whole budget, so run alone")
+}
+
+func TestProcessor_MaxWaiting(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 4; i++ {
+		r.AddJob(MyJobContext{})
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				jc.Count++
+				kicks := []KickRequest[MyJobContext]{}
+				for i := 0; i < 5; i++ {
+					kicks = append(kicks, KickRequest[MyJobContext]{C: MyJobContext{}, State: "slow"})
+				}
+				return jc, STATE_DONE, kicks, nil
+			},
+			Concurrency: 4,
+			RetryDelay:  time.Millisecond,
+		},
+		{
+			TriggerState: "slow",
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				time.Sleep(2 * time.Millisecond)
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+			MaxWaiting:  3,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	listener := &recordingStatusListener{}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, listener)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	assert.Len(t, r.Jobs, 24)
+	refused := 0
+	for id, j := range r.Jobs {
+		assert.Equal(t, STATE_DONE, j.State, id)
+		refused += len(j.StateErrors[TRIGGER_STATE_NEW])
+		if j.ParentId() == "" {
+			// Refused Execs are thrown away, so the job is retried from where it was
+			assert.Equal(t, 1, j.C.Count, id)
+		}
+	}
+	assert.Greater(t, refused, 0)
+
+	for _, status := range listener.Updates() {
+		for _, count := range status {
+			if count.State == "slow" {
+				// A whole batch is let in when nothing is waiting, so it can go over by one batch
+				assert.LessOrEqual(t, count.Waiting, 5)
+			}
+		}
+	}
+}
+
+func TestProcessor_MaxWaitingSelfLoop(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	r.AddJob(MyJobContext{})
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			// Every job kicks two more into this state, four levels deep
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				if jc.Count == 3 {
+					return jc, STATE_DONE, nil, nil
+				}
+				kick := KickRequest[MyJobContext]{C: MyJobContext{Count: jc.Count + 1}, State: TRIGGER_STATE_NEW}
+				return jc, STATE_DONE, []KickRequest[MyJobContext]{kick, kick}, nil
+			},
+			Concurrency: 2,
+			MaxWaiting:  2,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, p.Exec(ctx, r))
+	require.NoError(t, ctx.Err(), "a state kicking into itself shouldn't get stuck")
+
+	assert.Len(t, r.Jobs, 15)
+	for id, j := range r.Jobs {
+		assert.Equal(t, STATE_DONE, j.State, id)
+	}
+}
+
+func TestProcessor_ExecutingJobs(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 3; i++ {
+		r.AddJob(MyJobContext{Count: i})
+	}
+
+	started := make(chan string)
+	release := make(chan struct{})
+	exec := func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+		started <- jc.Name
+		<-release
+		return jc, STATE_DONE, nil, nil
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{TriggerState: TRIGGER_STATE_NEW, Exec: exec, Concurrency: 2},
+		{TriggerState: STATE_DONE_TWO, Exec: exec, Concurrency: 1},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+	r.AddJobWithState(MyJobContext{}, STATE_DONE_TWO)
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+
+	execErr := make(chan error)
+	go func() {
+		execErr <- p.Exec(context.Background(), r)
+	}()
+
+	// Two jobs are hung in new and one in done_two
+	for i := 0; i < 3; i++ {
+		<-started
+	}
+	executing, err := p.ExecutingJobs()
+	require.NoError(t, err)
+	require.Len(t, executing, 2)
+	assert.Equal(t, []string{"3"}, executing[STATE_DONE_TWO])
+	require.Len(t, executing[TRIGGER_STATE_NEW], 2)
+	assert.True(t, slices.IsSorted(executing[TRIGGER_STATE_NEW]))
+	for _, id := range executing[TRIGGER_STATE_NEW] {
+		assert.Contains(t, []string{"0", "1", "2"}, id)
+	}
+
+	close(release)
+	// The job still waiting in new
+	<-started
+	require.NoError(t, <-execErr)
+	_, err = p.ExecutingJobs()
+	assert.ErrorIs(t, err, ErrProcessorFinished)
+}
+
+func TestProcessor_WaitForJob(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	r.AddJob(MyJobContext{Count: 0})
+	r.AddJob(MyJobContext{Count: 1})
+
+	release := make(chan struct{})
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				if jc.Count == 1 {
+					<-release
+				}
+				jc.Name = "finished"
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 2,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+
+	// Waiting can start before Exec does
+	waited := make(chan Job[MyJobContext])
+	go func() {
+		job, err := p.WaitForJob(context.Background(), "1")
+		assert.NoError(t, err)
+		waited <- job
+	}()
+
+	execErr := make(chan error)
+	go func() {
+		execErr <- p.Exec(context.Background(), r)
+	}()
+
+	job, err := p.WaitForJob(context.Background(), "0")
+	require.NoError(t, err)
+	assert.Equal(t, STATE_DONE, job.State)
+	assert.Equal(t, "finished", job.C.Name)
+
+	// Job 1 is still hung, so waiting on it gives up with ctx
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = p.WaitForJob(ctx, "1")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(release)
+	job = <-waited
+	assert.Equal(t, "1", job.Id)
+	assert.Equal(t, STATE_DONE, job.State)
+	require.NoError(t, <-execErr)
+
+	_, err = p.WaitForJob(context.Background(), "0")
+	assert.ErrorIs(t, err, ErrProcessorFinished)
+}
+
+func TestProcessor_WaitForJobDrained(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	r.AddJob(MyJobContext{Count: 0})
+	r.AddJob(MyJobContext{Count: 1})
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				close(started)
+				<-release
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	execErr := make(chan error)
+	go func() {
+		execErr <- p.Exec(context.Background(), r)
+	}()
+
+	// Job 0 is executing, so job 1 is the one waiting
+	<-started
+	waitErr := make(chan error)
+	go func() {
+		_, err := p.WaitForJob(context.Background(), "1")
+		waitErr <- err
+	}()
+	// Drain once the wait has been registered
+	require.Eventually(t, func() bool {
+		var waiting int
+		require.NoError(t, p.control(func(r *Run[MyOverallContext, MyJobContext]) {
+			waiting = len(p.jobWaiters["1"])
+		}))
+		return waiting == 1
+	}, time.Second, time.Millisecond)
+	_, err = p.DrainWaiting(TRIGGER_STATE_NEW)
+	require.NoError(t, err)
+	assert.ErrorIs(t, <-waitErr, ErrJobDrained)
+
+	close(release)
+	require.NoError(t, <-execErr)
+}
+
+func TestProcessor_MaxStateAge(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	r.AddJob(MyJobContext{})
+	attempts := atomic.Int32{}
+	var enteredFlaky []time.Time
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, "flaky", nil, nil
+			},
+			Concurrency: 1,
+		},
+		{
+			TriggerState: "flaky",
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				attempts.Add(1)
+				return jc, "flaky", nil, errors.New("still down")
+			},
+			Concurrency:  1,
+			RetryDelay:   5 * time.Millisecond,
+			MaxStateAge:  50 * time.Millisecond,
+			FailureState: STATE_FAILED,
+		},
+		{TriggerState: STATE_FAILED, Terminal: true},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	events := p.Events()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for event := range events {
+			// By the time we look the job may have moved on to the failure state
+			if j, _ := r.JobByID(event.JobId); event.ToState == "flaky" && j.State == "flaky" {
+				enteredFlaky = append(enteredFlaky, *j.StateEnteredAt)
+			}
+		}
+	}()
+	start := time.Now()
+	require.NoError(t, p.Exec(context.Background(), r))
+	<-done
+
+	j := r.Jobs["0"]
+	assert.Equal(t, STATE_FAILED, j.State)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Greater(t, attempts.Load(), int32(1))
+	errs := j.StateErrors["flaky"]
+	require.Len(t, errs, int(attempts.Load())+1)
+	assert.Contains(t, errs[len(errs)-1], ErrMaxStateAge.Error())
+	// Moving to the failure state resets it
+	assert.False(t, j.StateEnteredAt.Before(start.Add(50*time.Millisecond).Truncate(time.Millisecond)))
+	for _, entered := range enteredFlaky {
+		assert.Equal(t, enteredFlaky[0], entered, "retrying shouldn't change when the job entered the state")
+	}
+}
+
+func TestProcessor_SeedOrder(t *testing.T) {
+	t.Parallel()
+	execOrder := func(shuffleSeed int64) []int {
+		r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+		for i := 0; i < 20; i++ {
+			r.AddJob(MyJobContext{Count: i})
+		}
+		var order []int
+		states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+			{
+				TriggerState: TRIGGER_STATE_NEW,
+				Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+					order = append(order, jc.Count)
+					return jc, STATE_DONE, nil, nil
+				},
+				Concurrency: 1,
+			},
+			{TriggerState: STATE_DONE, Terminal: true},
+		}
+		p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+		require.NoError(t, err)
+		p.ShuffleSeed = shuffleSeed
+		require.NoError(t, p.Exec(context.Background(), r))
+		return order
+	}
+
+	inOrder := execOrder(0)
+	for i, count := range inOrder {
+		assert.Equal(t, i, count)
+	}
+
+	shuffled := execOrder(42)
+	assert.Equal(t, shuffled, execOrder(42))
+	assert.NotEqual(t, inOrder, shuffled)
+	assert.ElementsMatch(t, inOrder, shuffled)
+}
+
+func TestProcessor_Annotate(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	r.AddJob(MyJobContext{})
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				jc.Count++
+				Annotate(ctx, "attempt", fmt.Sprintf("%d", jc.Count))
+				if jc.Count == 1 {
+					Annotate(ctx, "first_error", "flaky")
+					return jc, TRIGGER_STATE_NEW, nil, errors.New("flaky")
+				}
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	serializer := NewJsonSerializer[MyOverallContext, MyJobContext](filepath.Join(t.TempDir(), "run.json"))
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, serializer, nil)
+	require.NoError(t, err)
+	events := p.Events()
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	expected := map[string]string{"attempt": "2", "first_error": "flaky"}
+	assert.Equal(t, expected, r.Jobs["0"].Annotations)
+	var last JobEvent[MyJobContext]
+	for event := range events {
+		last = event
+	}
+	assert.Equal(t, expected, last.Annotations)
+
+	saved, err := serializer.Deserialize()
+	require.NoError(t, err)
+	assert.Equal(t, expected, saved.Jobs["0"].Annotations)
+
+	// Outside of Exec it does nothing
+	Annotate(context.Background(), "ignored", "true")
+}
+
+func TestProcessor_SetupAndTeardown(t *testing.T) {
+	t.Parallel()
+	var calls []string
+	setup := func(name string, err error) func(ctx context.Context, ac MyAppContext, oc MyOverallContext) error {
+		return func(ctx context.Context, ac MyAppContext, oc MyOverallContext) error {
+			calls = append(calls, "setup "+name+" "+oc.Name)
+			return err
+		}
+	}
+	teardown := func(name string) func(ctx context.Context, ac MyAppContext, oc MyOverallContext) {
+		return func(ctx context.Context, ac MyAppContext, oc MyOverallContext) {
+			assert.NoError(t, ctx.Err())
+			calls = append(calls, "teardown "+name)
+		}
+	}
+	states := func(middleErr error) []State[MyAppContext, MyOverallContext, MyJobContext] {
+		return []State[MyAppContext, MyOverallContext, MyJobContext]{
+			{
+				TriggerState: TRIGGER_STATE_NEW,
+				Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+					calls = append(calls, "exec new")
+					return jc, "middle", nil, nil
+				},
+				Concurrency: 1,
+				Setup:       setup("new", nil),
+				Teardown:    teardown("new"),
+			},
+			{
+				TriggerState: "middle",
+				Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+					calls = append(calls, "exec middle")
+					return jc, STATE_DONE, nil, nil
+				},
+				Concurrency: 1,
+				Setup:       setup("middle", middleErr),
+				Teardown:    teardown("middle"),
+			},
+			{TriggerState: STATE_DONE, Terminal: true, Teardown: teardown("done")},
+		}
+	}
+
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{Name: "overall"})
+	r.AddJob(MyJobContext{})
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states(nil), nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+	assert.Equal(t, []string{
+		"setup new overall",
+		"setup middle overall",
+		"exec new",
+		"exec middle",
+		"teardown done",
+		"teardown middle",
+		"teardown new",
+	}, calls)
+
+	// A failed setup stops the run before it starts, and only what was set up is torn down
+	calls = nil
+	r = NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{Name: "overall"})
+	r.AddJob(MyJobContext{})
+	setupErr := errors.New("no connection")
+	p, err = NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states(setupErr), nil, nil)
+	require.NoError(t, err)
+	assert.ErrorIs(t, p.Exec(context.Background(), r), setupErr)
+	assert.Equal(t, []string{
+		"setup new overall",
+		"setup middle overall",
+		"teardown new",
+	}, calls)
+	assert.Equal(t, TRIGGER_STATE_NEW, r.Jobs["0"].State)
+	assert.ErrorIs(t, p.Submit(MyJobContext{}), ErrProcessorFinished)
+}
+
+func TestProcessor_ExecSeesDeadline(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	outer, _ := ctx.Deadline()
+
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 3; i++ {
+		r.AddJob(MyJobContext{Count: i})
+	}
+	deadlines := make(chan time.Time, 4)
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			// Hangs until the run's deadline, like a slow call that respects its context
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				deadline, ok := ctx.Deadline()
+				assert.True(t, ok)
+				deadlines <- deadline
+				<-ctx.Done()
+				return jc, STATE_DONE, nil, ctx.Err()
+			},
+			Concurrency: 3,
+		},
+		{
+			TriggerState: "timed",
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				deadline, _ := ctx.Deadline()
+				deadlines <- deadline
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+			// Longer than the run has left, so the run's deadline is the one that counts
+			Timeout: time.Hour,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+	r.AddJobWithState(MyJobContext{}, "timed")
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	start := time.Now()
+	require.NoError(t, p.Exec(ctx, r))
+	assert.GreaterOrEqual(t, time.Since(start), 2*time.Second-10*time.Millisecond)
+	assert.Less(t, time.Since(start), 3*time.Second, "in flight Execs should be cancelled at the deadline")
+
+	// Exec doesn't wait for the cancelled Execs to return, so take each deadline rather than closing the channel
+	// under them
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, outer, <-deadlines)
+	}
+	// The cancelled Execs are left to run again on resume
+	for i := 0; i < 3; i++ {
+		j := r.Jobs[fmt.Sprintf("%d", i)]
+		assert.Equal(t, TRIGGER_STATE_NEW, j.State)
+		assert.Empty(t, j.StateErrors)
+	}
+	assert.Equal(t, STATE_DONE, r.Jobs["3"].State)
+}
+
+func TestProcessor_TimeoutKeepsLateSuccess(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	r.AddJob(MyJobContext{})
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			// Finishes a little after its timeout, within the grace period, without looking at ctx
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				time.Sleep(70 * time.Millisecond)
+				jc.Name = "finished"
+				return jc, STATE_DONE, []KickRequest[MyJobContext]{{C: MyJobContext{Name: "kicked"}, State: STATE_DONE_TWO}}, nil
+			},
+			Concurrency:  1,
+			Timeout:      50 * time.Millisecond,
+			MaxTimeouts:  1,
+			TimeoutState: STATE_FAILED,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+		{TriggerState: STATE_DONE_TWO, Terminal: true},
+		{TriggerState: STATE_FAILED, Terminal: true},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	// The finished work is kept rather than thrown away as a timeout
+	require.Len(t, r.Jobs, 2)
+	j := r.Jobs["0"]
+	assert.Equal(t, STATE_DONE, j.State)
+	assert.Equal(t, "finished", j.C.Name)
+	assert.Equal(t, 0, j.Timeouts)
+	assert.Equal(t, STATE_DONE_TWO, r.Jobs["0->0"].State)
+}
+
+func TestProcessor_TimeoutShorterThanDeadline(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	outer, _ := ctx.Deadline()
+
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	r.AddJob(MyJobContext{})
+	var deadline time.Time
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				deadline, _ = ctx.Deadline()
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+			Timeout:     50 * time.Millisecond,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	start := time.Now()
+	require.NoError(t, p.Exec(ctx, r))
+	assert.True(t, deadline.Before(outer))
+	assert.WithinDuration(t, start.Add(50*time.Millisecond), deadline, 50*time.Millisecond)
+}
+
+func TestProcessor_StatusByTag(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	r.AddJobWithTags(MyJobContext{}, TRIGGER_STATE_NEW, "customer-a")
+	r.AddJobWithTags(MyJobContext{}, TRIGGER_STATE_NEW, "customer-b")
+	r.AddJobWithTags(MyJobContext{}, TRIGGER_STATE_NEW, "customer-a", "priority")
+	r.AddJobWithTags(MyJobContext{}, STATE_DONE, "customer-a")
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				started <- struct{}{}
+				<-release
+				return jc, STATE_DONE, []KickRequest[MyJobContext]{{C: jc, State: STATE_DONE}}, nil
+			},
+			Concurrency: 1,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	execErr := make(chan error)
+	go func() {
+		execErr <- p.Exec(context.Background(), r)
+	}()
+
+	// Job 0 is executing and the others are waiting behind it
+	<-started
+	status, err := p.StatusByTag("customer-a")
+	require.NoError(t, err)
+	assert.Equal(t, []StatusCount{
+		{State: STATE_DONE, Completed: 1, Terminal: true},
+		{State: TRIGGER_STATE_NEW, Executing: 1, Waiting: 1},
+	}, status)
+
+	status, err = p.StatusByTag("customer-b")
+	require.NoError(t, err)
+	assert.Equal(t, []StatusCount{
+		{State: STATE_DONE, Terminal: true},
+		{State: TRIGGER_STATE_NEW, Waiting: 1},
+	}, status)
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		<-started
+	}
+	require.NoError(t, <-execErr)
+
+	// Kicked jobs carry their parent's tags
+	assert.Equal(t, []string{"customer-a", "priority"}, r.Jobs["2->0"].Tags)
+	assert.True(t, r.Jobs["1->0"].HasTag("customer-b"))
+	assert.False(t, r.Jobs["1->0"].HasTag("customer-a"))
+}
+
+func TestProcessor_Split(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	r.AddJob(MyJobContext{Count: 1})
+	fetch := func(source string) func(context.Context, MyAppContext, MyOverallContext, MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+		return func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+			jc.Name = source
+			return jc, STATE_DONE, nil, nil
+		}
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE_TWO, Split(jc, "fetch_a", "fetch_b"), nil
+			},
+			Concurrency: 1,
+		},
+		{TriggerState: "fetch_a", Exec: fetch("a"), Concurrency: 1},
+		{TriggerState: "fetch_b", Exec: fetch("b"), Concurrency: 1},
+		{TriggerState: STATE_DONE, Terminal: true},
+		{TriggerState: STATE_DONE_TWO, Terminal: true},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	assert.Equal(t, STATE_DONE_TWO, r.Jobs["0"].State)
+	children := r.Children("0")
+	require.Len(t, children, 2)
+	for i, source := range []string{"a", "b"} {
+		assert.Equal(t, fmt.Sprintf("0->%d", i), children[i].Id)
+		assert.Equal(t, STATE_DONE, children[i].State)
+		assert.Equal(t, source, children[i].C.Name)
+		assert.Equal(t, 1, children[i].C.Count)
+	}
+	assert.Empty(t, r.Children("0->0"))
+}
+
+// noopStates is a pipeline of depth states that hand each job straight on to the next, ending in a terminal
+// state, so benchmarks measure the processor rather than Exec
+func noopStates(depth int, concurrency int) []State[MyAppContext, MyOverallContext, MyJobContext] {
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{}
+	for i := 0; i < depth; i++ {
+		next := fmt.Sprintf("step-%d", i+1)
+		if i == depth-1 {
+			next = STATE_DONE
+		}
+		trigger := fmt.Sprintf("step-%d", i)
+		if i == 0 {
+			trigger = TRIGGER_STATE_NEW
+		}
+		states = append(states, State[MyAppContext, MyOverallContext, MyJobContext]{
+			TriggerState: trigger,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, next, nil, nil
+			},
+			Concurrency: concurrency,
+		})
+	}
+	return append(states, State[MyAppContext, MyOverallContext, MyJobContext]{TriggerState: STATE_DONE, Terminal: true})
+}
+
+// benchmarkTransitions runs jobs through a pipeline of no-op states and reports the processor's throughput
+func benchmarkTransitions(b *testing.B, jobs int, depth int, concurrency int) {
+	// Logging every transition would swamp the scheduler
+	logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError}))
+	p, err := NewProcessorWithOptions(MyAppContext{}, noopStates(depth, concurrency),
+		WithLogger[MyAppContext, MyOverallContext, MyJobContext](logger))
+	require.NoError(b, err)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		r := NewRunWithCapacity[MyOverallContext, MyJobContext]("bench", MyOverallContext{}, jobs)
+		for j := 0; j < jobs; j++ {
+			r.AddJob(MyJobContext{})
+		}
+		b.StartTimer()
+
+		require.NoError(b, p.Exec(context.Background(), r))
+	}
+	b.StopTimer()
+
+	elapsed := b.Elapsed().Seconds()
+	b.ReportMetric(float64(jobs*b.N)/elapsed, "jobs/s")
+	b.ReportMetric(float64(jobs*depth*b.N)/elapsed, "transitions/s")
+	b.ReportMetric(b.Elapsed().Seconds()*1e9/float64(jobs*depth*b.N), "ns/transition")
+}
+
+func BenchmarkProcessor_Transitions(b *testing.B) {
+	benchmarkTransitions(b, 1_000, 1, 10)
+}
+
+func BenchmarkProcessor_Pipeline(b *testing.B) {
+	benchmarkTransitions(b, 1_000, 5, 10)
+}
+
+// BenchmarkProcessor_OneMillionJobs shows how the per transition cost holds up as the waiting queues grow,
+// compared to BenchmarkProcessor_Transitions. Run it on its own with -benchtime 1x.
+func BenchmarkProcessor_OneMillionJobs(b *testing.B) {
+	benchmarkTransitions(b, 1_000_000, 1, 10)
+}
+
+// BenchmarkProcessor_FanOut kicks a single seed job out into a large number of children, so the children's
+// state has a long waiting queue for the whole run
+func BenchmarkProcessor_FanOut(b *testing.B) {
+	const children = 20_000
+	logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError}))
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				kicks := make([]KickRequest[MyJobContext], children)
+				for i := range kicks {
+					kicks[i] = KickRequest[MyJobContext]{C: jc, State: STATE_MIDDLE}
+				}
+				return jc, STATE_DONE, kicks, nil
+			},
+			Concurrency: 1,
+		},
+		{
+			TriggerState: STATE_MIDDLE,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 10,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+	p, err := NewProcessorWithOptions(MyAppContext{}, states, WithLogger[MyAppContext, MyOverallContext, MyJobContext](logger))
+	require.NoError(b, err)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := NewRun[MyOverallContext, MyJobContext]("bench", MyOverallContext{})
+		r.AddJob(MyJobContext{})
+		require.NoError(b, p.Exec(context.Background(), r))
+	}
+	b.StopTimer()
+	b.ReportMetric(b.Elapsed().Seconds()*1e9/float64(children*b.N), "ns/child")
+}
+
+// BenchmarkProcessor_MostlyFinished loops the one unfinished job of a run that's otherwise finished, eg one
+// resumed near the end, so any per transition cost that grows with the size of the run stands out
+func BenchmarkProcessor_MostlyFinished(b *testing.B) {
+	const finished, loops = 100_000, 1_000
+	logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError}))
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				jc.Count++
+				if jc.Count < loops {
+					return jc, TRIGGER_STATE_NEW, nil, nil
+				}
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+	p, err := NewProcessorWithOptions(MyAppContext{}, states, WithLogger[MyAppContext, MyOverallContext, MyJobContext](logger))
+	require.NoError(b, err)
+
+	r := NewRunWithCapacity[MyOverallContext, MyJobContext]("bench", MyOverallContext{}, finished+1)
+	for j := 0; j < finished; j++ {
+		r.AddJobWithState(MyJobContext{}, STATE_DONE)
+	}
+	r.AddJob(MyJobContext{})
+	live := fmt.Sprint(finished)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		job, _ := r.JobByID(live)
+		job.State, job.C.Count = TRIGGER_STATE_NEW, 0
+		require.NoError(b, r.UpdateJob(job))
+		b.StartTimer()
+
+		require.NoError(b, p.Exec(context.Background(), r))
+	}
+	b.StopTimer()
+	b.ReportMetric(b.Elapsed().Seconds()*1e9/float64(loops*b.N), "ns/transition")
+}
+
+func TestProcessor_LogsRunId(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	r.AddJob(MyJobContext{})
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	logs := &bytes.Buffer{}
+	p, err := NewProcessorWithOptions(MyAppContext{}, states,
+		WithLogger[MyAppContext, MyOverallContext, MyJobContext](slog.New(slog.NewJSONHandler(logs, nil))))
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	// Every line, including the workers', says which run it's from
+	decoder := json.NewDecoder(logs)
+	lines := 0
+	for decoder.More() {
+		var line map[string]any
+		require.NoError(t, decoder.Decode(&line))
+		assert.Equal(t, "job", line["run"], line["msg"])
+		assert.Equal(t, r.Id, line["runId"], line["msg"])
+		lines++
+	}
+	assert.NotZero(t, lines)
+}
+
+func TestProcessor_RetryPlacement(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		placement RetryPlacement
+		want      []int
+	}{
+		{RetryBack, []int{0, 1, 2, 3, 0}},
+		{RetryFront, []int{0, 0, 1, 2, 3}},
+	} {
+		r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+		for i := 0; i < 4; i++ {
+			r.AddJob(MyJobContext{Count: i})
+		}
+
+		// One worker, so the jobs run one at a time in queue order and only job 0 fails, the first time
+		var order []int
+		states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+			{
+				TriggerState: TRIGGER_STATE_NEW,
+				Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+					order = append(order, jc.Count)
+					if jc.Count == 0 && len(order) == 1 {
+						return jc, TRIGGER_STATE_NEW, nil, errors.New("flaked")
+					}
+					return jc, STATE_DONE, nil, nil
+				},
+				Concurrency:    1,
+				RetryPlacement: tc.placement,
+			},
+			{TriggerState: STATE_DONE, Terminal: true},
+		}
+
+		p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+		require.NoError(t, err)
+		require.NoError(t, p.Exec(context.Background(), r))
+		assert.Equal(t, tc.want, order, tc.placement)
+		assert.Equal(t, 4, r.TerminalCounts()[STATE_DONE])
+	}
+}
+
+// recordingMetricsSink keeps everything it's told, for checking what the processor reports
+type recordingMetricsSink struct {
+	transitions []string
+	completed   []string
+}
+
+func (s *recordingMetricsSink) JobTransitioned(from string, to string, dur time.Duration, err error) {
+	s.transitions = append(s.transitions, fmt.Sprintf("%s->%s %v", from, to, err))
+}
+
+func (s *recordingMetricsSink) JobCompleted(state string) {
+	s.completed = append(s.completed, state)
+}
+
+func TestProcessor_MetricsSink(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	r.AddJob(MyJobContext{})
+
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				if Attempt(ctx) == 1 {
+					return jc, TRIGGER_STATE_NEW, nil, errors.New("flaked")
+				}
+				return jc, STATE_MIDDLE, []KickRequest[MyJobContext]{{State: STATE_DONE_TWO}}, nil
+			},
+			Concurrency: 1,
+		},
+		{
+			TriggerState: STATE_MIDDLE,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+		{TriggerState: STATE_DONE_TWO, Terminal: true},
+	}
+
+	sink := &recordingMetricsSink{}
+	p, err := NewProcessorWithOptions(MyAppContext{}, states,
+		WithMetricsSink[MyAppContext, MyOverallContext, MyJobContext](sink))
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	assert.Equal(t, []string{"new->new flaked", "new->middle <nil>", "middle->done <nil>"}, sink.transitions)
+	// The kicked job completes without an Exec of its own
+	assert.Equal(t, []string{STATE_DONE_TWO, STATE_DONE}, sink.completed)
+}
@@ -0,0 +1,80 @@
+package jorb
+
+import "slices"
+
+// jobQueue holds a state's waiting jobs, oldest first. Jobs join at the back and are normally taken from
+// the front, both in amortized constant time: taking from the front only moves head along, and the taken
+// slots are reclaimed once they make up half the slice, so a state with a huge fan out waiting on it
+// doesn't copy its whole queue for every job.
+type jobQueue[JC any] struct {
+	jobs []Job[JC]
+	head int
+}
+
+// len is how many jobs are waiting in the queue
+func (q *jobQueue[JC]) len() int {
+	return len(q.jobs) - q.head
+}
+
+// push adds a job to the back of the queue
+func (q *jobQueue[JC]) push(job Job[JC]) {
+	q.jobs = append(q.jobs, job)
+}
+
+// pushFront adds a job to the front of the queue, ahead of the jobs already in it
+func (q *jobQueue[JC]) pushFront(job Job[JC]) {
+	if q.head > 0 {
+		q.head--
+		q.jobs[q.head] = job
+		return
+	}
+	q.jobs = slices.Insert(q.jobs, 0, job)
+}
+
+// at returns the i'th oldest job in the queue
+func (q *jobQueue[JC]) at(i int) Job[JC] {
+	return q.jobs[q.head+i]
+}
+
+// remove takes the i'th oldest job out of the queue and returns it. Taking the oldest is cheap, taking any
+// other shifts the jobs behind it along, eg when the oldest are held up by their resource keys.
+func (q *jobQueue[JC]) remove(i int) Job[JC] {
+	job := q.jobs[q.head+i]
+	if i > 0 {
+		q.jobs = slices.Delete(q.jobs, q.head+i, q.head+i+1)
+		return job
+	}
+
+	// Don't keep the job's context alive from the unused part of the slice
+	q.jobs[q.head] = Job[JC]{}
+	q.head++
+	switch {
+	case q.head == len(q.jobs):
+		q.jobs, q.head = q.jobs[:0], 0
+	case q.head*2 >= len(q.jobs):
+		n := copy(q.jobs, q.jobs[q.head:])
+		clear(q.jobs[n:])
+		q.jobs, q.head = q.jobs[:n], 0
+	}
+	return job
+}
+
+// index returns where the job with the id is in the queue, counting from the oldest, or -1 if it isn't
+func (q *jobQueue[JC]) index(id string) int {
+	for i := q.head; i < len(q.jobs); i++ {
+		if q.jobs[i].Id == id {
+			return i - q.head
+		}
+	}
+	return -1
+}
+
+// all returns a copy of the jobs in the queue, oldest first
+func (q *jobQueue[JC]) all() []Job[JC] {
+	return slices.Clone(q.jobs[q.head:])
+}
+
+// replace empties the queue and refills it with jobs, which are oldest first
+func (q *jobQueue[JC]) replace(jobs []Job[JC]) {
+	q.jobs, q.head = jobs, 0
+}
@@ -0,0 +1,54 @@
+package jorb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobQueue(t *testing.T) {
+	t.Parallel()
+	ids := func(q *jobQueue[MyJobContext]) []string {
+		var ids []string
+		for _, job := range q.all() {
+			ids = append(ids, job.Id)
+		}
+		return ids
+	}
+
+	q := &jobQueue[MyJobContext]{}
+	for i := 0; i < 6; i++ {
+		q.push(Job[MyJobContext]{Id: fmt.Sprint(i)})
+	}
+	assert.Equal(t, 6, q.len())
+	assert.Equal(t, "0", q.at(0).Id)
+
+	// Jobs come out oldest first, and taking from the middle keeps the order of the rest
+	assert.Equal(t, "0", q.remove(0).Id)
+	assert.Equal(t, "3", q.remove(2).Id)
+	assert.Equal(t, []string{"1", "2", "4", "5"}, ids(q))
+
+	// Taking most of them reclaims the space at the front without losing any
+	assert.Equal(t, "1", q.remove(0).Id)
+	assert.Equal(t, "2", q.remove(0).Id)
+	assert.Zero(t, q.head)
+	q.push(Job[MyJobContext]{Id: "6"})
+	assert.Equal(t, []string{"4", "5", "6"}, ids(q))
+
+	for q.len() > 0 {
+		q.remove(0)
+	}
+	assert.Empty(t, q.all())
+
+	q.replace([]Job[MyJobContext]{{Id: "7"}, {Id: "8"}})
+	assert.Equal(t, []string{"7", "8"}, ids(q))
+
+	// Jobs can jump the queue, into the space left by taken jobs if there is some
+	q.pushFront(Job[MyJobContext]{Id: "9"})
+	assert.Equal(t, []string{"9", "7", "8"}, ids(q))
+	assert.Equal(t, "9", q.remove(0).Id)
+	q.pushFront(Job[MyJobContext]{Id: "10"})
+	assert.Equal(t, 0, q.head)
+	assert.Equal(t, []string{"10", "7", "8"}, ids(q))
+}
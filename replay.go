@@ -0,0 +1,127 @@
+package jorb
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ExecRecord is what went into and came out of a single Exec, so it can be replayed later with Replay, eg
+// to reproduce a bug that only happened once in production. The app context isn't recorded, as it's usually
+// clients and connections, so replaying needs one of its own.
+type ExecRecord[OC any, JC any] struct {
+	JobId   string
+	Attempt int    // Attempt is which attempt at the job in State the Exec was, see Attempt
+	State   string // State is the state the Exec ran in
+	Overall OC
+	Input   JC // Input is the job context Exec was called with, after PreExec
+
+	// Output, NextState, Kicks and Error are what Exec returned, before PostExec, Router or any of the
+	// processor's error handling
+	Output    JC
+	NextState string
+	Kicks     []KickRequest[JC]
+	Error     string
+	TimedOut  bool // TimedOut is whether Exec ran past the state's Timeout, so Output is what it had so far
+
+	Started  time.Time
+	Duration time.Duration
+}
+
+// SameOutcome reports whether the two records have the same outputs, eg to check whether a replayed Exec
+// did what the recorded one did
+func (r ExecRecord[OC, JC]) SameOutcome(other ExecRecord[OC, JC]) bool {
+	return r.NextState == other.NextState && r.Error == other.Error && reflect.DeepEqual(r.Output, other.Output) &&
+		reflect.DeepEqual(r.Kicks, other.Kicks)
+}
+
+// ExecRecorder receives a record of every Exec, see Processor.Recorder
+type ExecRecorder[OC any, JC any] interface {
+	// Record is called with each Exec's record as soon as Exec returns. It's called concurrently from the
+	// workers of every state, so it must be safe for concurrent use, and a slow Record holds up the worker.
+	// Errors are logged and otherwise ignored.
+	Record(rec ExecRecord[OC, JC]) error
+}
+
+// JsonLinesRecorder is an ExecRecorder that appends each record to File as a line of JSON, like
+// JsonLinesSink. ReadExecRecords reads them back. Only the exported fields of the contexts are recorded.
+type JsonLinesRecorder[OC any, JC any] struct {
+	File string
+
+	m sync.Mutex
+}
+
+// NewJsonLinesRecorder creates a JsonLinesRecorder appending to file, which is created if it doesn't exist
+func NewJsonLinesRecorder[OC any, JC any](file string) *JsonLinesRecorder[OC, JC] {
+	return &JsonLinesRecorder[OC, JC]{
+		File: file,
+	}
+}
+
+var _ ExecRecorder[any, any] = (*JsonLinesRecorder[any, any])(nil)
+
+// Record appends the record to the file as a single line of JSON
+func (r *JsonLinesRecorder[OC, JC]) Record(rec ExecRecord[OC, JC]) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(r.File), 0700); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(r.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return json.NewEncoder(file).Encode(rec)
+}
+
+// ReadExecRecords reads the records written to file by a JsonLinesRecorder, oldest first
+func ReadExecRecords[OC any, JC any](file string) ([]ExecRecord[OC, JC], error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []ExecRecord[OC, JC]
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for decoder.More() {
+		var rec ExecRecord[OC, JC]
+		if err := decoder.Decode(&rec); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// Replay runs the state's Exec, or ExecC, again with the recorded overall and job contexts and ac, and returns
+// a record of what it did this time. Compare it to the recorded one with SameOutcome. JobId and Attempt give
+// Exec the recorded job's. Only Exec is run: there's no PreExec, PostExec, Timeout or rate limiting, and
+// nothing is scheduled.
+func Replay[AC any, OC any, JC any](ctx context.Context, ac AC, state State[AC, OC, JC], rec ExecRecord[OC, JC]) ExecRecord[OC, JC] {
+	replayed := ExecRecord[OC, JC]{
+		JobId:   rec.JobId,
+		Attempt: rec.Attempt,
+		State:   state.TriggerState,
+		Overall: rec.Overall,
+		Input:   rec.Input,
+		Started: time.Now(),
+	}
+	var err error
+	ctx = context.WithValue(ctx, execJobKey{}, execJob{id: rec.JobId, attempt: rec.Attempt})
+	replayed.Output, replayed.NextState, replayed.Kicks, err = state.exec()(ctx, ac, rec.Overall, rec.Input)
+	replayed.Duration = time.Since(replayed.Started)
+	if err != nil {
+		replayed.Error = err.Error()
+	}
+	return replayed
+}
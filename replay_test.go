@@ -0,0 +1,75 @@
+package jorb
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{Name: "overall"})
+	for i := 0; i < 3; i++ {
+		r.AddJob(MyJobContext{Count: i})
+	}
+
+	// Stands in for something outside the job, eg an api, that changes between the run and the replay
+	var flaky atomic.Bool
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				if jc.Count == 1 && flaky.Load() {
+					return jc, STATE_FAILED, nil, errors.New("flaked")
+				}
+				jc.Name = oc.Name
+				jc.Count *= 10
+				return jc, STATE_DONE, []KickRequest[MyJobContext]{{C: jc, State: STATE_DONE_TWO}}, nil
+			},
+			Concurrency: 2,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+		{TriggerState: STATE_DONE_TWO, Terminal: true},
+		{TriggerState: STATE_FAILED, Terminal: true},
+	}
+
+	file := filepath.Join(t.TempDir(), "execs.jsonl")
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	p.Recorder = NewJsonLinesRecorder[MyOverallContext, MyJobContext](file)
+	flaky.Store(true)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	records, err := ReadExecRecords[MyOverallContext, MyJobContext](file)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	byJob := map[string]ExecRecord[MyOverallContext, MyJobContext]{}
+	for _, rec := range records {
+		assert.Equal(t, TRIGGER_STATE_NEW, rec.State)
+		assert.Equal(t, "overall", rec.Overall.Name)
+		assert.Equal(t, 1, rec.Attempt)
+		byJob[rec.JobId] = rec
+	}
+	assert.Equal(t, 2, byJob["2"].Input.Count)
+	assert.Equal(t, 20, byJob["2"].Output.Count)
+	assert.Equal(t, []KickRequest[MyJobContext]{{C: byJob["2"].Output, State: STATE_DONE_TWO}}, byJob["2"].Kicks)
+	assert.Equal(t, STATE_FAILED, byJob["1"].NextState)
+	assert.Equal(t, "flaked", byJob["1"].Error)
+
+	// Replaying under the same conditions does the same thing
+	for _, rec := range records {
+		assert.True(t, rec.SameOutcome(Replay(context.Background(), MyAppContext{}, states[0], rec)), rec.JobId)
+	}
+
+	// Once the flake is gone the failed job does something different
+	flaky.Store(false)
+	replayed := Replay(context.Background(), MyAppContext{}, states[0], byJob["1"])
+	assert.False(t, byJob["1"].SameOutcome(replayed))
+	assert.Equal(t, STATE_DONE, replayed.NextState)
+	assert.Empty(t, replayed.Error)
+}
@@ -1,9 +1,14 @@
 package jorb
 
 import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"reflect"
+	"slices"
 	"sync"
 	"time"
 )
@@ -12,10 +17,29 @@ import (
 // it's meant to be re-entrant, eg if you kill the processor and you have a serializaer, you can
 // restart using it at any time
 type Run[OC any, JC any] struct {
-	Name    string             // Name of the run
-	Jobs    map[string]Job[JC] // Map of jobs, where keys are job ids and values are Job states
-	Overall OC                 // Overall overall state that is usful to all jobs, basically context for the overall batch
-	m       sync.Mutex         // Mutex used for indexing operations
+	Id          string                    // Id uniquely identifies the run, a random UUID that's kept when it's serialized
+	Name        string                    // Name of the run, for people, which other runs can share
+	Jobs        map[string]Job[JC]        // Map of jobs, where keys are job ids and values are Job states
+	Overall     OC                        // Overall overall state that is usful to all jobs, basically context for the overall batch
+	Transitions map[string]Transition[JC] // Recorded outcomes of idempotent state transitions, keyed by state and idempotency key
+	NextJobId   int                       // NextJobId is the id the next added job gets, so ids aren't reused once jobs are evicted
+	m           *sync.RWMutex             // Mutex used for indexing operations, shared by copies of the run
+
+	// TerminalStates are the terminal states of the processor that last executed the run, in the order they
+	// were declared. Exec sets them, and they're serialized with the run, so TerminalCounts still works on a
+	// run loaded back off disk.
+	TerminalStates []string
+
+	// TerminalSummary counts, by state, the terminal jobs that were left out of Jobs when the run was saved
+	// by a JsonSerializer with OmitTerminal set. They count as completed when the run is resumed, and
+	// TerminalCounts includes them.
+	TerminalSummary map[string]int
+}
+
+// Transition is the recorded outcome of running a job through an idempotent state
+type Transition[JC any] struct {
+	C     JC     // C is the job context the state's Exec returned
+	State string // State is the state the job moved to
 }
 
 // NewRun creates a new Run instance with the given name and overall context
@@ -23,19 +47,32 @@ type Run[OC any, JC any] struct {
 // Use the overall context to store any state that all of the jobs will want access to instead of
 // storing it in the specific JobContexts
 func NewRun[OC any, JC any](name string, oc OC) *Run[OC, JC] {
+	return NewRunWithCapacity[OC, JC](name, oc, 0)
+}
+
+// NewRunWithCapacity creates a new Run like NewRun, but preallocates room for capacity jobs
+//
+// Use this when seeding very large runs to avoid repeatedly growing the job map while adding jobs
+func NewRunWithCapacity[OC any, JC any](name string, oc OC, capacity int) *Run[OC, JC] {
 	r := &Run[OC, JC]{
+		Id:      newRunId(),
 		Name:    name,
-		Jobs:    map[string]Job[JC]{},
+		Jobs:    make(map[string]Job[JC], capacity),
 		Overall: oc,
-		m:       sync.Mutex{},
+		m:       &sync.RWMutex{},
 	}
 	r.Init()
 	return r
 }
 
 func (r *Run[OC, JC]) Init() {
-	r.m.Lock()
-	defer r.m.Unlock()
+	r.mutex().Lock()
+	defer r.mutex().Unlock()
+
+	// Nor do runs saved before runs had ids
+	if r.Id == "" {
+		r.Id = newRunId()
+	}
 
 	for _, j := range r.Jobs {
 		// if it doesn't have a last event, give it one
@@ -45,28 +82,315 @@ func (r *Run[OC, JC]) Init() {
 	}
 }
 
-func (r *Run[OC, JC]) UpdateJob(j Job[JC]) {
-	r.m.Lock()
-	defer r.m.Unlock()
+// mutex returns the run's mutex, making it for runs that weren't created with NewRun, eg struct literals or
+// runs from a Serializer that doesn't call Init. Only the first use makes it, so a run built that way has to
+// be used once, eg by Exec, before it's shared between goroutines.
+func (r *Run[OC, JC]) mutex() *sync.RWMutex {
+	if r.m == nil {
+		r.m = &sync.RWMutex{}
+	}
+	return r.m
+}
+
+// newRunId returns a random (version 4) UUID
+func newRunId() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("generating run id: %v", err))
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+var (
+	// ErrJobNotFound is returned when updating a job that the run isn't tracking
+	ErrJobNotFound = errors.New("job not found in run")
+	// ErrDuplicateJobId is returned when adding a job with the same id as one the run already has
+	ErrDuplicateJobId = errors.New("duplicate job id")
+)
+
+// UpdateJob replaces the run's copy of a job with j. It returns ErrJobNotFound if the run doesn't have a
+// job with j's id, eg because the job was evicted, rather than quietly adding it.
+func (r *Run[OC, JC]) UpdateJob(j Job[JC]) error {
+	r.mutex().Lock()
+	defer r.mutex().Unlock()
 
+	if _, ok := r.Jobs[j.Id]; !ok {
+		return fmt.Errorf("updating job %s: %w", j.Id, ErrJobNotFound)
+	}
 	r.Jobs[j.Id] = j.UpdateLastEvent()
+	return nil
 }
 
+// insertJob adds a job with an id of its own, eg a kicked job. It returns ErrDuplicateJobId if the run
+// already has a job with that id, leaving the existing job alone.
+func (r *Run[OC, JC]) insertJob(j Job[JC]) error {
+	r.mutex().Lock()
+	defer r.mutex().Unlock()
+
+	if _, ok := r.Jobs[j.Id]; ok {
+		return fmt.Errorf("adding job %s: %w", j.Id, ErrDuplicateJobId)
+	}
+	r.Jobs[j.Id] = j.UpdateLastEvent()
+	return nil
+}
+
+// AddJobWithState adds a new job that starts in the given state rather than TRIGGER_STATE_NEW, so a run can
+// be seeded into several entry states at once. Exec returns an error wrapping ErrUnknownState if the state
+// isn't one of the processor's states.
 func (r *Run[OC, JC]) AddJobWithState(jc JC, state string) {
-	r.m.Lock()
-	defer r.m.Unlock()
+	r.addJob(jc, state)
+}
+
+// AddJobWithTags adds a new job that starts in the given state like AddJobWithState, tagged with the
+// given tags, eg the customer the job is for. The jobs it kicks are given the same tags, and
+// Processor.StatusByTag reports on the jobs with a tag.
+func (r *Run[OC, JC]) AddJobWithTags(jc JC, state string, tags ...string) {
+	r.addJob(jc, state, tags...)
+}
+
+// addJob adds a new job to the run and returns it
+func (r *Run[OC, JC]) addJob(jc JC, state string, tags ...string) Job[JC] {
+	r.mutex().Lock()
+	defer r.mutex().Unlock()
 
 	// TODO: Use a uuid for the jobs
-	id := fmt.Sprintf("%d", len(r.Jobs))
+	// Runs serialized before NextJobId existed have ids 0 to len(r.Jobs)-1
+	next := max(r.NextJobId, len(r.Jobs))
+	r.NextJobId = next + 1
+	id := fmt.Sprintf("%d", next)
 	j := Job[JC]{
 		Id:          id,
 		C:           jc,
 		State:       state,
 		StateErrors: map[string][]string{},
+		Tags:        tags,
 	}
 
-	slog.Info("AddJob", "run", r.Name, "job", j, "totalJobs", len(r.Jobs))
-	r.Jobs[id] = j.UpdateLastEvent()
+	slog.Info("AddJob", "run", r.Name, "runId", r.Id, "job", j, "totalJobs", len(r.Jobs))
+	j = j.UpdateLastEvent().enterState()
+	r.Jobs[id] = j
+	return j
+}
+
+// removeJob drops a job from the run, eg once a terminal job has been handed off to a TerminalSink
+func (r *Run[OC, JC]) removeJob(id string) {
+	r.mutex().Lock()
+	defer r.mutex().Unlock()
+
+	delete(r.Jobs, id)
+}
+
+// RecordTransition remembers the outcome of a job leaving an idempotent state with the given key
+func (r *Run[OC, JC]) RecordTransition(state string, key string, t Transition[JC]) {
+	r.mutex().Lock()
+	defer r.mutex().Unlock()
+
+	if r.Transitions == nil {
+		r.Transitions = map[string]Transition[JC]{}
+	}
+	r.Transitions[transitionKey(state, key)] = t
+}
+
+// RecordedTransition returns the recorded outcome of leaving the state with the given key, if there is one
+func (r *Run[OC, JC]) RecordedTransition(state string, key string) (Transition[JC], bool) {
+	r.mutex().RLock()
+	defer r.mutex().RUnlock()
+
+	t, ok := r.Transitions[transitionKey(state, key)]
+	return t, ok
+}
+
+func transitionKey(state string, key string) string {
+	return state + "/" + key
+}
+
+// JobByID returns the job with the given id, if the run has one. It is safe to call while the run is
+// being processed.
+func (r *Run[OC, JC]) JobByID(id string) (Job[JC], bool) {
+	r.mutex().RLock()
+	defer r.mutex().RUnlock()
+
+	j, ok := r.Jobs[id]
+	return j, ok
+}
+
+// Children returns the jobs that the job with the given id kicked, see Job.ParentId, sorted by id in the
+// order they were kicked. It is safe to call while the run is being processed.
+func (r *Run[OC, JC]) Children(id string) []Job[JC] {
+	var children []Job[JC]
+	r.ForEachJob(func(j Job[JC]) {
+		if j.ParentId() == id {
+			children = append(children, j)
+		}
+	})
+	slices.SortFunc(children, func(a, b Job[JC]) int {
+		return compareJobIds(a.Id, b.Id)
+	})
+	return children
+}
+
+// OverallContext returns a copy of the run's overall context. It is safe to call while the run is being
+// processed, and once Exec has returned it is the run's final overall context. The copy is shallow, so
+// any maps, slices or pointers in it are still shared with the run.
+//
+// Execs are given their own copy of the overall context when Exec starts, so nothing they do changes it.
+func (r *Run[OC, JC]) OverallContext() OC {
+	r.mutex().RLock()
+	defer r.mutex().RUnlock()
+
+	return r.Overall
+}
+
+// ForEachJob calls f with each of the run's jobs. It is safe to call while the run is being processed,
+// and is the intended way to inspect jobs from outside the processor.
+//
+// f is called with a snapshot of the jobs taken when ForEachJob was called, so it doesn't hold up
+// processing and may itself call methods on the run.
+func (r *Run[OC, JC]) ForEachJob(f func(Job[JC])) {
+	r.mutex().RLock()
+	jobs := make([]Job[JC], 0, len(r.Jobs))
+	for _, j := range r.Jobs {
+		jobs = append(jobs, j)
+	}
+	r.mutex().RUnlock()
+
+	for _, j := range jobs {
+		f(j)
+	}
+}
+
+// snapshot returns a copy of the run that can be serialized while processing carries on changing the run
+func (r *Run[OC, JC]) snapshot() Run[OC, JC] {
+	r.mutex().RLock()
+	defer r.mutex().RUnlock()
+
+	return Run[OC, JC]{
+		Id:          r.Id,
+		Name:        r.Name,
+		Jobs:        maps.Clone(r.Jobs),
+		Overall:     r.Overall,
+		Transitions: maps.Clone(r.Transitions),
+		NextJobId:   r.NextJobId,
+		m:           &sync.RWMutex{},
+
+		TerminalStates:  r.TerminalStates,
+		TerminalSummary: maps.Clone(r.TerminalSummary),
+	}
+}
+
+// terminalSummary returns a copy of the run's TerminalSummary
+func (r *Run[OC, JC]) terminalSummary() map[string]int {
+	r.mutex().RLock()
+	defer r.mutex().RUnlock()
+
+	return maps.Clone(r.TerminalSummary)
+}
+
+// withoutTerminalJobs returns a copy of the run without the jobs in its TerminalStates, counting them in its
+// TerminalSummary instead. The run itself isn't changed.
+func (r Run[OC, JC]) withoutTerminalJobs() Run[OC, JC] {
+	terminal := map[string]bool{}
+	for _, state := range r.TerminalStates {
+		terminal[state] = true
+	}
+
+	summary := maps.Clone(r.TerminalSummary)
+	jobs := make(map[string]Job[JC], len(r.Jobs))
+	for id, j := range r.Jobs {
+		if !terminal[j.State] {
+			jobs[id] = j
+			continue
+		}
+		if summary == nil {
+			summary = map[string]int{}
+		}
+		summary[j.State] += 1
+	}
+	r.Jobs = jobs
+	r.TerminalSummary = summary
+	return r
+}
+
+// Clone returns a deep copy of the run, eg to reprocess it with changed states to see what would happen
+// without touching the original. The copy is made by round tripping the run through JSON, the same as a
+// JsonSerializer would, so job and overall contexts are copied all the way down, but only their exported
+// fields survive. It is safe to call while the run is being processed.
+func (r *Run[OC, JC]) Clone() (*Run[OC, JC], error) {
+	snapshot := r.snapshot()
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("cloning run %s: %w", r.Name, err)
+	}
+
+	var clone Run[OC, JC]
+	if err := json.Unmarshal(data, &clone); err != nil {
+		return nil, fmt.Errorf("cloning run %s: %w", r.Name, err)
+	}
+	clone.Init()
+	return &clone, nil
+}
+
+// setTerminalStates records the terminal states of the processor executing the run
+func (r *Run[OC, JC]) setTerminalStates(states []string) {
+	r.mutex().Lock()
+	defer r.mutex().Unlock()
+
+	r.TerminalStates = states
+}
+
+// TerminalCounts returns how many jobs ended in each terminal state, including terminal states no job ended
+// in, eg to report a run's outcomes once Exec has returned. Jobs only counted in the TerminalSummary are
+// included. The counts match the Completed counts of the final status update, or the Skipped count for
+// STATE_SKIPPED, except for jobs removed by EvictTerminal, which are no longer in the run to count.
+//
+// Which states are terminal comes from the processor that last executed the run, see TerminalStates, so
+// it returns nil for a run that has never been executed. It is safe to call while the run is being processed.
+func (r *Run[OC, JC]) TerminalCounts() map[string]int {
+	r.mutex().RLock()
+	defer r.mutex().RUnlock()
+
+	if r.TerminalStates == nil {
+		return nil
+	}
+	counts := make(map[string]int, len(r.TerminalStates))
+	for _, state := range r.TerminalStates {
+		counts[state] = 0
+	}
+	for _, j := range r.Jobs {
+		if _, ok := counts[j.State]; ok {
+			counts[j.State] += 1
+		}
+	}
+	for state, count := range r.TerminalSummary {
+		if _, ok := counts[state]; ok {
+			counts[state] += count
+		}
+	}
+	return counts
+}
+
+// ErrorReport counts the errors recorded in every job's StateErrors, by state and then by error message, eg
+// to see what went wrong across a run once Exec has returned. A job that hit the same error several times,
+// eg while retrying, counts once for each time. States without errors are left out, so a run without any
+// errors gives an empty report. It is safe to call while the run is being processed.
+func (r *Run[OC, JC]) ErrorReport() map[string]map[string]int {
+	report := map[string]map[string]int{}
+	r.ForEachJob(func(j Job[JC]) {
+		for state, errs := range j.StateErrors {
+			if len(errs) == 0 {
+				continue
+			}
+			if report[state] == nil {
+				report[state] = map[string]int{}
+			}
+			for _, err := range errs {
+				report[state][err] += 1
+			}
+		}
+	})
+	return report
 }
 
 // Add a job to the pool, this shouldn't be called once it's running
@@ -74,6 +398,15 @@ func (r *Run[OC, JC]) AddJob(jc JC) {
 	r.AddJobWithState(jc, TRIGGER_STATE_NEW)
 }
 
+// Scatter seeds the run with a job for each job context fn makes from input, eg one per day of a date range,
+// in the order fn returns them. It's the seeding counterpart of kicking many jobs from an Exec. It's a
+// function rather than a method so the input can be any type.
+func Scatter[OC any, JC any, I any](r *Run[OC, JC], input I, fn func(I) []JC) {
+	for _, jc := range fn(input) {
+		r.AddJob(jc)
+	}
+}
+
 func (r *Run[OC, JC]) Equal(r2 *Run[OC, JC]) bool {
 	if r.Name != r2.Name {
 		return false
@@ -1,10 +1,13 @@
 package jorb
 
 import (
+	"context"
+	"errors"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_AddJobWithState(t *testing.T) {
@@ -16,13 +19,14 @@ func Test_AddJobWithState(t *testing.T) {
 	originalTime := r.Jobs["0"].LastUpdate
 	time.Sleep(1 * time.Second)
 
-	r.UpdateJob(Job[MyJobContext]{
+	err := r.UpdateJob(Job[MyJobContext]{
 		Id: "0",
 		C: MyJobContext{
 			Count: 1,
 		},
 		State: "other_state_2",
 	})
+	require.NoError(t, err)
 
 	time.Sleep(1 * time.Second)
 	// Number of jobs has not changed
@@ -32,3 +36,268 @@ func Test_AddJobWithState(t *testing.T) {
 	// Job's time has been updated
 	assert.NotEqual(t, originalTime, r.Jobs["0"].LastUpdate)
 }
+
+func Test_UpdateJobRequiresTrackedJob(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+
+	err := r.UpdateJob(Job[MyJobContext]{Id: "0", State: "other_state"})
+	assert.ErrorIs(t, err, ErrJobNotFound)
+	assert.Empty(t, r.Jobs)
+
+	r.AddJob(MyJobContext{})
+	err = r.insertJob(Job[MyJobContext]{Id: "0", State: "other_state"})
+	assert.ErrorIs(t, err, ErrDuplicateJobId)
+	assert.Equal(t, TRIGGER_STATE_NEW, r.Jobs["0"].State)
+}
+
+func Test_NewRunWithCapacity(t *testing.T) {
+	t.Parallel()
+	r := NewRunWithCapacity[MyOverallContext, MyJobContext]("job", MyOverallContext{Name: "overall"}, 100)
+	assert.Equal(t, "job", r.Name)
+	assert.Equal(t, "overall", r.Overall.Name)
+	assert.Empty(t, r.Jobs)
+
+	for i := 0; i < 100; i++ {
+		r.AddJob(MyJobContext{Count: i})
+	}
+	assert.Equal(t, 100, len(r.Jobs))
+	assert.Equal(t, 42, r.Jobs["42"].C.Count)
+}
+
+func Test_Scatter(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	start := time.Date(2024, 1, 30, 0, 0, 0, 0, time.UTC)
+	Scatter(r, start, func(from time.Time) []MyJobContext {
+		days := []MyJobContext{}
+		for i := 0; i < 3; i++ {
+			days = append(days, MyJobContext{Name: from.AddDate(0, 0, i).Format(time.DateOnly)})
+		}
+		return days
+	})
+
+	require.Len(t, r.Jobs, 3)
+	assert.Equal(t, "2024-01-30", r.Jobs["0"].C.Name)
+	assert.Equal(t, "2024-02-01", r.Jobs["2"].C.Name)
+	assert.Equal(t, TRIGGER_STATE_NEW, r.Jobs["2"].State)
+}
+
+func Test_JobByID(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	r.AddJob(MyJobContext{Count: 7})
+
+	j, ok := r.JobByID("0")
+	assert.True(t, ok)
+	assert.Equal(t, 7, j.C.Count)
+
+	_, ok = r.JobByID("missing")
+	assert.False(t, ok)
+}
+
+func Test_ForEachJobDuringExec(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 20; i++ {
+		r.AddJob(MyJobContext{})
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				time.Sleep(10 * time.Millisecond)
+				jc.Count++
+				if jc.Count < 3 {
+					return jc, TRIGGER_STATE_NEW, nil, errors.New("again")
+				}
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 5,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+
+	// Inspect the run while it's processing, the race detector will flag any unsafe access
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			count := 0
+			errorCount := 0
+			r.ForEachJob(func(j Job[MyJobContext]) {
+				count++
+				errorCount += len(j.StateErrors[TRIGGER_STATE_NEW])
+			})
+			assert.Equal(t, 20, count)
+
+			j, ok := r.JobByID("0")
+			assert.True(t, ok)
+			if j.State == STATE_DONE {
+				return
+			}
+		}
+	}()
+
+	require.NoError(t, p.Exec(context.Background(), r))
+	<-done
+
+	r.ForEachJob(func(j Job[MyJobContext]) {
+		assert.Equal(t, STATE_DONE, j.State)
+		assert.Len(t, j.StateErrors[TRIGGER_STATE_NEW], 2)
+	})
+}
+
+func Test_OverallContext(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{Name: "overall"})
+	r.AddJob(MyJobContext{})
+
+	oc := r.OverallContext()
+	assert.Equal(t, "overall", oc.Name)
+
+	// Changing the copy leaves the run alone
+	oc.Name = "changed"
+	assert.Equal(t, "overall", r.OverallContext().Name)
+
+	// Deserialized runs don't have a mutex until Init
+	deserialized := &Run[MyOverallContext, MyJobContext]{Overall: MyOverallContext{Name: "loaded"}}
+	deserialized.Init()
+	assert.Equal(t, "loaded", deserialized.OverallContext().Name)
+}
+
+func Test_Clone(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{Name: "overall"})
+	for i := 0; i < 3; i++ {
+		r.AddJob(MyJobContext{Count: i, StringList: []string{"a"}})
+	}
+	j := r.Jobs["0"]
+	j.recordError(TRIGGER_STATE_NEW, errors.New("boom"))
+	require.NoError(t, r.UpdateJob(j))
+
+	clone, err := r.Clone()
+	require.NoError(t, err)
+	assert.True(t, r.Equal(clone))
+	assert.Equal(t, r.NextJobId, clone.NextJobId)
+
+	// Mutate everything the two could share
+	cj := clone.Jobs["0"]
+	cj.C.StringList[0] = "changed"
+	cj.StateErrors[TRIGGER_STATE_NEW][0] = "changed"
+	cj.StateErrors["other"] = []string{"new"}
+	clone.Jobs["0"] = cj
+	clone.Overall.Name = "changed"
+	clone.AddJob(MyJobContext{})
+
+	// Reprocess the clone with a different state
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				jc.Count += 100
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), clone))
+
+	assert.Len(t, r.Jobs, 3)
+	assert.Equal(t, "overall", r.Overall.Name)
+	for id, j := range r.Jobs {
+		assert.Equal(t, TRIGGER_STATE_NEW, j.State, id)
+		assert.Less(t, j.C.Count, 100, id)
+		assert.Equal(t, []string{"a"}, j.C.StringList, id)
+	}
+	assert.Equal(t, map[string][]string{TRIGGER_STATE_NEW: {"boom"}}, r.Jobs["0"].StateErrors)
+	assert.Len(t, clone.Jobs, 4)
+	assert.Equal(t, 100, clone.Jobs["0"].C.Count)
+}
+
+func Test_ErrorReport(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	assert.Empty(t, r.ErrorReport())
+
+	for i := 0; i < 3; i++ {
+		r.AddJob(MyJobContext{Count: i})
+	}
+	for id, errs := range map[string][]error{
+		"0": {errors.New("timeout"), errors.New("timeout")},
+		"1": {errors.New("timeout"), errors.New("not found")},
+	} {
+		j := r.Jobs[id]
+		for _, err := range errs {
+			j.recordError(TRIGGER_STATE_NEW, err)
+		}
+		require.NoError(t, r.UpdateJob(j))
+	}
+	j := r.Jobs["2"]
+	j.recordError("fetch", errors.New("timeout"))
+	j.StateErrors["empty"] = []string{}
+	require.NoError(t, r.UpdateJob(j))
+
+	assert.Equal(t, map[string]map[string]int{
+		TRIGGER_STATE_NEW: {"timeout": 3, "not found": 1},
+		"fetch":           {"timeout": 1},
+	}, r.ErrorReport())
+}
+
+func Test_RunId(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	other := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	assert.Regexp(t, "^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$", r.Id)
+	assert.NotEqual(t, r.Id, other.Id)
+
+	clone, err := r.Clone()
+	require.NoError(t, err)
+	assert.Equal(t, r.Id, clone.Id)
+
+	// Runs saved before they had ids get one when they're loaded
+	old := Run[MyOverallContext, MyJobContext]{Name: "job"}
+	old.Init()
+	assert.NotEmpty(t, old.Id)
+}
+
+func TestProcessor_ExecRunLiteral(t *testing.T) {
+	t.Parallel()
+	// A run that wasn't made with NewRun, eg by a custom Serializer, has no mutex or id yet
+	r := &Run[MyOverallContext, MyJobContext]{
+		Name: "literal",
+		Jobs: map[string]Job[MyJobContext]{
+			"0": {Id: "0", State: TRIGGER_STATE_NEW, StateErrors: map[string][]string{}},
+		},
+		NextJobId: 1,
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+	assert.Equal(t, STATE_DONE, r.Jobs["0"].State)
+	assert.NotEmpty(t, r.Id)
+
+	// It can be added to directly too
+	added := &Run[MyOverallContext, MyJobContext]{Name: "literal", Jobs: map[string]Job[MyJobContext]{}}
+	added.AddJob(MyJobContext{})
+	assert.Len(t, added.Jobs, 1)
+}
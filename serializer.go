@@ -2,8 +2,12 @@ package jorb
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"log"
 	"log/slog"
 	"os"
 	"path/filepath"
@@ -16,10 +20,53 @@ type Serializer[OC any, JC any] interface {
 	Deserialize() (*Run[OC, JC], error)
 }
 
+// ContextSerializer is optionally implemented by a Serializer whose saves can be cancelled, eg one writing
+// over the network. The processor checkpoints with SerializeCtx when it's there, and with Serialize
+// otherwise, which can't be interrupted.
+type ContextSerializer[OC any, JC any] interface {
+	Serializer[OC, JC]
+	// SerializeCtx is Serialize, giving up with ctx's error once ctx is done. It should leave any earlier
+	// save intact if it gives up.
+	SerializeCtx(ctx context.Context, r Run[OC, JC]) error
+}
+
+// serialize saves the run with serializer, with ctx if it's a ContextSerializer
+func serialize[OC any, JC any](ctx context.Context, serializer Serializer[OC, JC], r Run[OC, JC]) error {
+	if cs, ok := serializer.(ContextSerializer[OC, JC]); ok {
+		return cs.SerializeCtx(ctx, r)
+	}
+	return serializer.Serialize(r)
+}
+
 // JsonSerializer is a struct that implements Serializer and stores and loads run from a file specified
 // in the File field, there  is a anonymous variable type check
 type JsonSerializer[OC any, JC any] struct {
 	File string
+
+	// OmitTerminal leaves the jobs in the run's TerminalStates out of the file, only counting how many ended
+	// in each state in Run.TerminalSummary, to shrink the checkpoints of runs that are mostly finished work.
+	// A resumed run counts them as completed but doesn't have the jobs, eg for reports or Run.Children.
+	OmitTerminal bool
+
+	// Version is the schema version of the job and overall contexts, written into the file alongside the
+	// run. Bump it when changing JC or OC in a way old files wouldn't decode into properly. Files written
+	// before versioning was used are version zero.
+	Version int
+
+	// Migrate optionally upgrades files written with an older Version, eg by decoding them into the old
+	// context types and converting them. It's called with the file's contents and the version it was written
+	// with. Without it, Deserialize returns ErrVersionMismatch for any file not written with Version.
+	Migrate func(data []byte, version int) (*Run[OC, JC], error)
+}
+
+// ErrVersionMismatch is returned when deserializing a file written with a different Version than the
+// JsonSerializer's, that it has no Migrate for
+var ErrVersionMismatch = errors.New("serialized version mismatch")
+
+// versionedRun is how a JsonSerializer lays out a run in its file, with the Version next to the run's fields
+type versionedRun[OC any, JC any] struct {
+	Version int `json:",omitempty"`
+	Run[OC, JC]
 }
 
 // NewJsonSerializer create a new instance of the JsonSerializer struct.
@@ -31,7 +78,7 @@ func NewJsonSerializer[OC any, JC any](file string) *JsonSerializer[OC, JC] {
 	}
 }
 
-var _ Serializer[any, any] = (*JsonSerializer[any, any])(nil)
+var _ ContextSerializer[any, any] = (*JsonSerializer[any, any])(nil)
 
 // Serialize takes a Run[OC, JC] instance and serializes it to JSON format,
 // writing the serialized data to the file specified when creating the JsonSerializer instance.
@@ -48,6 +95,15 @@ var _ Serializer[any, any] = (*JsonSerializer[any, any])(nil)
 //
 //	error: An error value if the serialization or file writing operation fails, otherwise nil.
 func (js JsonSerializer[OC, JC]) Serialize(run Run[OC, JC]) error {
+	return js.SerializeCtx(context.Background(), run)
+}
+
+// SerializeCtx is Serialize, but gives up with ctx's error if ctx is done before it starts writing the
+// file, so the last file written is left as it was. Once writing has started it's always finished.
+func (js JsonSerializer[OC, JC]) SerializeCtx(ctx context.Context, run Run[OC, JC]) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	start := time.Now()
 	// Create the parent directory if it doesn't exist
 	dir := filepath.Dir(js.File)
@@ -56,15 +112,24 @@ func (js JsonSerializer[OC, JC]) Serialize(run Run[OC, JC]) error {
 		return err
 	}
 
+	if js.OmitTerminal {
+		run = run.withoutTerminalJobs()
+	}
+
 	buf := &bytes.Buffer{}
 
 	encoder := json.NewEncoder(buf)
 	encoder.SetIndent("", "  ")
-	err = encoder.Encode(run)
+	err = encoder.Encode(versionedRun[OC, JC]{Version: js.Version, Run: run})
 	if err != nil {
 		return err
 	}
 
+	// Encoding a big run takes a while, so check again before touching the file
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	file, err := os.Create(js.File)
 	if err != nil {
 		return err
@@ -85,7 +150,8 @@ func (js JsonSerializer[OC, JC]) Serialize(run Run[OC, JC]) error {
 // deserializes the JSON data into a Run[OC, JC] instance, and returns the deserialized Run instance.
 //
 // If any error occurs during the process, such as opening the file or decoding the JSON data,
-// the function returns a zero-value Run[OC, JC] instance and the error.
+// the function returns a zero-value Run[OC, JC] instance and the error. Files written with an older Version
+// are upgraded with Migrate, and anything else not written with Version is an ErrVersionMismatch.
 //
 // Returns:
 //
@@ -93,23 +159,38 @@ func (js JsonSerializer[OC, JC]) Serialize(run Run[OC, JC]) error {
 //	error: An error value if the deserialization or file reading operation fails, otherwise nil.
 func (js JsonSerializer[OC, JC]) Deserialize() (*Run[OC, JC], error) {
 	start := time.Now()
-	file, err := os.Open(js.File)
+	data, err := os.ReadFile(js.File)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	decoder := json.NewDecoder(file)
-	var run Run[OC, JC]
-	err = decoder.Decode(&run)
-	if err != nil {
+	var header struct{ Version int }
+	if err := json.Unmarshal(data, &header); err != nil {
 		return nil, err
 	}
 
+	var run *Run[OC, JC]
+	switch {
+	case header.Version == js.Version:
+		var versioned versionedRun[OC, JC]
+		if err := json.Unmarshal(data, &versioned); err != nil {
+			return nil, err
+		}
+		run = &versioned.Run
+	case header.Version < js.Version && js.Migrate != nil:
+		run, err = js.Migrate(data, header.Version)
+		if err != nil {
+			return nil, fmt.Errorf("migrating %s from version %d: %w", js.File, header.Version, err)
+		}
+		slog.Info("Migrated", "file", js.File, "from", header.Version, "to", js.Version)
+	default:
+		return nil, fmt.Errorf("%s is version %d, expected %d: %w", js.File, header.Version, js.Version, ErrVersionMismatch)
+	}
+
 	slog.Info("Deserialized", "file", js.File, "delta", time.Since(start))
 
 	run.Init()
-	return &run, nil
+	return run, nil
 }
 
 // NilSerializer implements the Serializer interface with no-op implementations
@@ -130,3 +211,83 @@ func (n *NilSerializer[OC, JC]) Serialize(run Run[OC, JC]) error {
 func (n *NilSerializer[OC, JC]) Deserialize() (*Run[OC, JC], error) {
 	panic("not implemented, shouldn't be called")
 }
+
+// checkpointer serializes a run from its own goroutine, so a slow serializer doesn't hold up the processor
+//
+// Checkpoints are coalesced: if the run changes several times while a checkpoint is being written, only
+// one more checkpoint is written afterwards, with the latest state of the run
+type checkpointer[OC any, JC any] struct {
+	ctx        context.Context
+	timeout    time.Duration
+	logger     *slog.Logger
+	serializer Serializer[OC, JC]
+	run        *Run[OC, JC]
+	pending    chan struct{}
+	done       chan struct{}
+}
+
+// newCheckpointer starts checkpointing run with serializer. Checkpoints are given up on once ctx is done,
+// or once they've taken longer than timeout if it's set.
+func newCheckpointer[OC any, JC any](ctx context.Context, timeout time.Duration, logger *slog.Logger, serializer Serializer[OC, JC], run *Run[OC, JC]) *checkpointer[OC, JC] {
+	c := &checkpointer[OC, JC]{
+		ctx:        ctx,
+		timeout:    timeout,
+		logger:     logger,
+		serializer: serializer,
+		run:        run,
+		pending:    make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	go c.loop()
+	return c
+}
+
+// request asks for the run to be checkpointed without waiting for it
+func (c *checkpointer[OC, JC]) request() {
+	select {
+	case c.pending <- struct{}{}:
+	default:
+		// A checkpoint is already pending and will pick up this change too
+	}
+}
+
+// close waits for any checkpoint in progress and then writes a final one with the finished state of the run,
+// so the last save never depends on which transition happened to request it. The final one is written even
+// if ctx has been cancelled, as that's usually why the run is stopping, but it's still bounded by timeout.
+func (c *checkpointer[OC, JC]) close() {
+	// The final checkpoint covers anything still pending
+	select {
+	case <-c.pending:
+	default:
+	}
+	close(c.pending)
+	<-c.done
+
+	c.save(context.WithoutCancel(c.ctx))
+}
+
+func (c *checkpointer[OC, JC]) loop() {
+	defer close(c.done)
+	for range c.pending {
+		c.save(c.ctx)
+	}
+}
+
+// save writes a checkpoint with ctx. One that's given up on because ctx is done is logged and skipped, but
+// any other error stops the program rather than carrying on without being able to save.
+func (c *checkpointer[OC, JC]) save(ctx context.Context) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	err := serialize(ctx, c.serializer, c.run.snapshot())
+	if err == nil {
+		return
+	}
+	if ctx.Err() != nil {
+		c.logger.Warn("CheckpointAbandoned", "error", err)
+		return
+	}
+	log.Fatalf("Error serializing, aborting now to not lose work: %v", err)
+}
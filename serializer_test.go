@@ -1,10 +1,15 @@
 package jorb
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -38,6 +43,120 @@ func TestJsonSerializer_SaveLoad(t *testing.T) {
 	assert.True(t, run.Equal(actualRun))
 }
 
+func TestJsonSerializer_Version(t *testing.T) {
+	t.Parallel()
+
+	// Version zero of the job context called Count Total
+	type oldJobContext struct {
+		Name  string
+		Total int
+	}
+	file := filepath.Join(t.TempDir(), "run.json")
+	old := NewRun[MyOverallContext, oldJobContext]("test", MyOverallContext{Name: "overall"})
+	for i := 0; i < 3; i++ {
+		old.AddJob(oldJobContext{Name: fmt.Sprintf("job-%d", i), Total: i})
+	}
+	require.NoError(t, NewJsonSerializer[MyOverallContext, oldJobContext](file).Serialize(*old))
+
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "Version", "unversioned files don't change")
+
+	serializer := NewJsonSerializer[MyOverallContext, MyJobContext](file)
+	serializer.Version = 1
+	_, err = serializer.Deserialize()
+	require.ErrorIs(t, err, ErrVersionMismatch)
+
+	serializer.Migrate = func(data []byte, version int) (*Run[MyOverallContext, MyJobContext], error) {
+		assert.Equal(t, 0, version)
+		var old Run[MyOverallContext, oldJobContext]
+		if err := json.Unmarshal(data, &old); err != nil {
+			return nil, err
+		}
+		run := NewRun[MyOverallContext, MyJobContext](old.Name, old.Overall)
+		for id, j := range old.Jobs {
+			run.Jobs[id] = Job[MyJobContext]{Id: id, State: j.State, C: MyJobContext{Name: j.C.Name, Count: j.C.Total}}
+		}
+		run.NextJobId = old.NextJobId
+		return run, nil
+	}
+	migrated, err := serializer.Deserialize()
+	require.NoError(t, err)
+	assert.Equal(t, "overall", migrated.Overall.Name)
+	require.Len(t, migrated.Jobs, 3)
+	assert.Equal(t, MyJobContext{Name: "job-2", Count: 2}, migrated.Jobs["2"].C)
+
+	// Saving it again writes the current version, which loads without migrating
+	require.NoError(t, serializer.Serialize(*migrated))
+	serializer.Migrate = nil
+	loaded, err := serializer.Deserialize()
+	require.NoError(t, err)
+	assert.True(t, migrated.Equal(loaded))
+
+	// Files from a newer version can't be migrated down
+	serializer.Version = 2
+	require.NoError(t, serializer.Serialize(*migrated))
+	serializer.Version = 1
+	serializer.Migrate = func(data []byte, version int) (*Run[MyOverallContext, MyJobContext], error) {
+		t.Fatal("shouldn't migrate from a newer version")
+		return nil, nil
+	}
+	_, err = serializer.Deserialize()
+	require.ErrorIs(t, err, ErrVersionMismatch)
+	assert.Contains(t, err.Error(), "version 2, expected 1")
+}
+
+func TestJsonSerializer_OmitTerminal(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("test", MyOverallContext{})
+	for i := 0; i < 3; i++ {
+		r.AddJob(MyJobContext{Count: i})
+	}
+	for i := 0; i < 2; i++ {
+		r.AddJobWithState(MyJobContext{}, STATE_DONE)
+	}
+	r.TerminalStates = []string{STATE_DONE}
+
+	serializer := NewJsonSerializer[MyOverallContext, MyJobContext](filepath.Join(t.TempDir(), "run.json"))
+	serializer.OmitTerminal = true
+	require.NoError(t, serializer.Serialize(*r))
+	assert.Len(t, r.Jobs, 5, "the run being saved isn't changed")
+
+	resumed, err := serializer.Deserialize()
+	require.NoError(t, err)
+	assert.Len(t, resumed.Jobs, 3)
+	assert.Equal(t, map[string]int{STATE_DONE: 2}, resumed.TerminalSummary)
+	assert.Equal(t, map[string]int{STATE_DONE: 2}, resumed.TerminalCounts())
+
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+	listener := &recordingStatusListener{}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, serializer, listener)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), resumed))
+
+	// The summarised jobs count as completed alongside the ones that just finished
+	updates := listener.Updates()
+	require.NotEmpty(t, updates)
+	assert.Equal(t, 5, updates[len(updates)-1][0].Completed)
+	assert.Equal(t, map[string]int{STATE_DONE: 5}, resumed.TerminalCounts())
+
+	// Once everything is terminal the saved run is just the summary
+	final, err := serializer.Deserialize()
+	require.NoError(t, err)
+	assert.Empty(t, final.Jobs)
+	assert.Equal(t, map[string]int{STATE_DONE: 5}, final.TerminalSummary)
+	assert.Equal(t, 5, final.NextJobId)
+}
+
 func Test_SerializeWithError(t *testing.T) {
 	t.Parallel()
 	// Create a temporary directory for testing
@@ -48,14 +167,17 @@ func Test_SerializeWithError(t *testing.T) {
 	defer os.RemoveAll(tempDir)
 
 	r := NewRun[MyOverallContext, MyJobContext]("test", MyOverallContext{Name: "overall"})
-	r.UpdateJob(Job[MyJobContext]{
-		C: MyJobContext{Count: 0, Name: "job-0"},
+	r.AddJob(MyJobContext{Count: 0, Name: "job-0"})
+	err = r.UpdateJob(Job[MyJobContext]{
+		Id: "0",
+		C:  MyJobContext{Count: 0, Name: "job-0"},
 		StateErrors: map[string][]string{
 			"key": []string{
 				"e1", "e2",
 			},
 		},
 	})
+	require.NoError(t, err)
 
 	tempFile := filepath.Join(tempDir, "test.json")
 	serializer := &JsonSerializer[MyOverallContext, MyJobContext]{File: tempFile}
@@ -78,3 +200,207 @@ func Test_SerializeWithError(t *testing.T) {
 	}
 	assert.True(t, r.Equal(actualRun))
 }
+
+func TestCheckpointer_CloseSavesFinalRun(t *testing.T) {
+	t.Parallel()
+
+	r := NewRun[MyOverallContext, MyJobContext]("test", MyOverallContext{Name: "overall"})
+	r.AddJob(MyJobContext{Name: "job-0"})
+
+	serializer := &JsonSerializer[MyOverallContext, MyJobContext]{File: filepath.Join(t.TempDir(), "test.json")}
+	c := newCheckpointer[MyOverallContext, MyJobContext](context.Background(), 0, slog.Default(), serializer, r)
+
+	// Nothing asked for a checkpoint after this change, close should still save it
+	job := r.Jobs["0"]
+	job.State = "done"
+	job.StateErrors = map[string][]string{TRIGGER_STATE_NEW: {"errored"}}
+	require.NoError(t, r.UpdateJob(job))
+	c.close()
+
+	actualRun, err := serializer.Deserialize()
+	require.NoError(t, err)
+	assert.True(t, r.Equal(actualRun))
+}
+
+func TestJsonSerializer_SerializeCtx(t *testing.T) {
+	t.Parallel()
+
+	r := NewRun[MyOverallContext, MyJobContext]("test", MyOverallContext{Name: "overall"})
+	r.AddJob(MyJobContext{Name: "job-0"})
+	serializer := NewJsonSerializer[MyOverallContext, MyJobContext](filepath.Join(t.TempDir(), "test.json"))
+	require.NoError(t, serializer.SerializeCtx(context.Background(), *r))
+
+	// A cancelled save leaves the last one alone
+	r.AddJob(MyJobContext{Name: "job-1"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, serializer.SerializeCtx(ctx, *r), context.Canceled)
+
+	saved, err := serializer.Deserialize()
+	require.NoError(t, err)
+	assert.Len(t, saved.Jobs, 1)
+}
+
+// hangingSerializer never finishes a save until its context gives up on it
+type hangingSerializer struct {
+	NilSerializer[MyOverallContext, MyJobContext]
+	abandoned atomic.Int32
+}
+
+func (s *hangingSerializer) SerializeCtx(ctx context.Context, r Run[MyOverallContext, MyJobContext]) error {
+	<-ctx.Done()
+	s.abandoned.Add(1)
+	return ctx.Err()
+}
+
+func TestProcessor_CheckpointTimeout(t *testing.T) {
+	t.Parallel()
+
+	r := NewRun[MyOverallContext, MyJobContext]("test", MyOverallContext{Name: "overall"})
+	r.AddJob(MyJobContext{Name: "job-0"})
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	serializer := &hangingSerializer{}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, serializer, nil)
+	require.NoError(t, err)
+	p.CheckpointTimeout = 10 * time.Millisecond
+
+	start := time.Now()
+	require.NoError(t, p.Exec(context.Background(), r))
+	assert.Less(t, time.Since(start), 5*time.Second)
+	// At least the final save was given up on, rather than hanging Exec
+	assert.GreaterOrEqual(t, serializer.abandoned.Load(), int32(1))
+	assert.Equal(t, STATE_DONE, r.Jobs["0"].State)
+}
+
+// notifyingSerializer hands every run it's asked to save to saves
+type notifyingSerializer struct {
+	NilSerializer[MyOverallContext, MyJobContext]
+	saves chan Run[MyOverallContext, MyJobContext]
+}
+
+func (s *notifyingSerializer) Serialize(r Run[MyOverallContext, MyJobContext]) error {
+	s.saves <- r
+	return nil
+}
+
+func TestProcessor_PauseSerialization(t *testing.T) {
+	t.Parallel()
+
+	r := NewRun[MyOverallContext, MyJobContext]("test", MyOverallContext{})
+	for i := 0; i < 10; i++ {
+		r.AddJob(MyJobContext{Count: i})
+	}
+	serializer := &notifyingSerializer{saves: make(chan Run[MyOverallContext, MyJobContext], 100)}
+
+	var p *Processor[MyAppContext, MyOverallContext, MyJobContext]
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_MIDDLE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{
+			TriggerState: STATE_MIDDLE,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				if jc.Count == 5 {
+					// Nothing was saved while paused, but resuming saves what happened meanwhile
+					assert.Empty(t, serializer.saves)
+					p.ResumeSerialization()
+					select {
+					case saved := <-serializer.saves:
+						assert.Equal(t, STATE_MIDDLE, saved.Jobs["5"].State)
+					case <-time.After(5 * time.Second):
+						t.Error("no checkpoint after resuming")
+					}
+				}
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	var err error
+	p, err = NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, serializer, nil)
+	require.NoError(t, err)
+	p.PauseSerialization()
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	// Checkpoints carried on once resumed, and the final save has every job done
+	close(serializer.saves)
+	var last Run[MyOverallContext, MyJobContext]
+	saves := 0
+	for saved := range serializer.saves {
+		last = saved
+		saves++
+	}
+	assert.GreaterOrEqual(t, saves, 2)
+	assert.Equal(t, map[string]int{STATE_DONE: 10}, last.TerminalCounts())
+
+	// The final save happens even if serialization is never resumed
+	r = NewRun[MyOverallContext, MyJobContext]("test", MyOverallContext{})
+	r.AddJob(MyJobContext{})
+	serializer.saves = make(chan Run[MyOverallContext, MyJobContext], 100)
+	p, err = NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, serializer, nil)
+	require.NoError(t, err)
+	p.PauseSerialization()
+	require.NoError(t, p.Exec(context.Background(), r))
+	require.Len(t, serializer.saves, 1)
+	last = <-serializer.saves
+	assert.Equal(t, map[string]int{STATE_DONE: 1}, last.TerminalCounts())
+}
+
+func TestProcessor_CheckpointOnTerminal(t *testing.T) {
+	t.Parallel()
+
+	r := NewRun[MyOverallContext, MyJobContext]("test", MyOverallContext{})
+	for i := 0; i < 5; i++ {
+		r.AddJob(MyJobContext{})
+	}
+	// Every job loops ten times before it finishes, which is 50 transitions that would each ask for a save
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				// Gives each save time to finish, so they aren't coalesced
+				time.Sleep(time.Millisecond)
+				jc.Count++
+				if jc.Count < 10 {
+					return jc, TRIGGER_STATE_NEW, nil, nil
+				}
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+
+	serializer := &notifyingSerializer{saves: make(chan Run[MyOverallContext, MyJobContext], 100)}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, serializer, nil)
+	require.NoError(t, err)
+	p.CheckpointPolicy = CheckpointOnTerminal
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	// At most one save for each job finishing, and the final one
+	close(serializer.saves)
+	var last Run[MyOverallContext, MyJobContext]
+	saves := 0
+	for saved := range serializer.saves {
+		last = saved
+		saves++
+	}
+	assert.LessOrEqual(t, saves, 6)
+	assert.Equal(t, map[string]int{STATE_DONE: 5}, last.TerminalCounts())
+}
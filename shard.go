@@ -0,0 +1,112 @@
+package jorb
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"slices"
+)
+
+// ErrInvalidShard is returned when partitioning a run into less than one shard, or when a shard function
+// routes a job to a shard that doesn't exist
+var ErrInvalidShard = errors.New("invalid shard")
+
+// ShardForId returns which of shards shards the job with the given id belongs to, by a hash of the id.
+// It's stable across processes, so it can also be used to route jobs to the right machine. shards must be
+// at least 1, it panics otherwise.
+func ShardForId(id string, shards int) int {
+	if shards < 1 {
+		panic(fmt.Sprintf("sharding job %s into %d shards: %v", id, shards, ErrInvalidShard))
+	}
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// Partition splits the run into shards independent runs by a hash of each job's id, see ShardForId, eg to
+// spread a huge run over several machines. Each shard gets the run's name, overall context and recorded
+// transitions, and can be serialized, processed by its own Processor and recombined with MergeRuns.
+func (r *Run[OC, JC]) Partition(shards int) ([]*Run[OC, JC], error) {
+	// Checked here too, rather than left to PartitionFunc, as ShardForId can't take less than one shard
+	if shards < 1 {
+		return nil, fmt.Errorf("partitioning into %d shards: %w", shards, ErrInvalidShard)
+	}
+	return r.PartitionFunc(shards, func(j Job[JC]) int {
+		return ShardForId(j.Id, shards)
+	})
+}
+
+// PartitionFunc splits the run into shards independent runs like Partition, but routes each job to the
+// shard returned by shard, which must be between 0 and shards-1
+func (r *Run[OC, JC]) PartitionFunc(shards int, shard func(Job[JC]) int) ([]*Run[OC, JC], error) {
+	if shards < 1 {
+		return nil, fmt.Errorf("partitioning into %d shards: %w", shards, ErrInvalidShard)
+	}
+
+	r.mutex().RLock()
+	defer r.mutex().RUnlock()
+
+	runs := make([]*Run[OC, JC], shards)
+	for i := range runs {
+		runs[i] = NewRun[OC, JC](r.Name, r.Overall)
+		runs[i].Transitions = maps.Clone(r.Transitions)
+		runs[i].TerminalStates = slices.Clone(r.TerminalStates)
+		// Jobs added to a shard later carry on from the run's ids rather than starting over at 0
+		runs[i].NextJobId = max(r.NextJobId, len(r.Jobs))
+	}
+	// Summarised jobs have no ids to route by, so they all go with the first shard and MergeRuns adds them back up
+	runs[0].TerminalSummary = maps.Clone(r.TerminalSummary)
+
+	for id, j := range r.Jobs {
+		i := shard(j)
+		if i < 0 || i >= shards {
+			return nil, fmt.Errorf("job %s routed to shard %d of %d: %w", id, i, shards, ErrInvalidShard)
+		}
+		runs[i].Jobs[id] = j
+	}
+	return runs, nil
+}
+
+// MergeRuns recombines shards of a run, eg once each has been processed, into a single run with the name,
+// overall context and terminal states of the first. Their TerminalSummary counts are added up.
+//
+// A job id should only ever be in one shard, since Partition hands each job to exactly one and jobs kicked
+// in a shard get ids derived from their parent's. The exception is jobs added to more than one shard
+// after partitioning, which can be given the same id, so rather than pick one MergeRuns returns an error
+// wrapping ErrDuplicateJobId. Recorded transitions are combined, and if two shards recorded the outcome
+// for the same state and key the later shard's is kept.
+func MergeRuns[OC any, JC any](shards ...*Run[OC, JC]) (*Run[OC, JC], error) {
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("merging no runs: %w", ErrInvalidShard)
+	}
+
+	merged := NewRun[OC, JC](shards[0].Name, shards[0].Overall)
+	merged.TerminalStates = slices.Clone(shards[0].TerminalStates)
+	for _, shard := range shards {
+		shard.Init()
+		shard.mutex().RLock()
+		for id, j := range shard.Jobs {
+			if _, ok := merged.Jobs[id]; ok {
+				shard.mutex().RUnlock()
+				return nil, fmt.Errorf("merging job %s: %w", id, ErrDuplicateJobId)
+			}
+			merged.Jobs[id] = j
+		}
+		for key, t := range shard.Transitions {
+			if merged.Transitions == nil {
+				merged.Transitions = map[string]Transition[JC]{}
+			}
+			merged.Transitions[key] = t
+		}
+		for state, count := range shard.TerminalSummary {
+			if merged.TerminalSummary == nil {
+				merged.TerminalSummary = map[string]int{}
+			}
+			merged.TerminalSummary[state] += count
+		}
+		merged.NextJobId = max(merged.NextJobId, shard.NextJobId)
+		shard.mutex().RUnlock()
+	}
+	return merged, nil
+}
@@ -0,0 +1,120 @@
+package jorb
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun_PartitionAndMerge(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{Name: "overall"})
+	for i := 0; i < 100; i++ {
+		r.AddJob(MyJobContext{Count: i})
+	}
+
+	shards, err := r.Partition(4)
+	require.NoError(t, err)
+	require.Len(t, shards, 4)
+
+	total := 0
+	for i, shard := range shards {
+		assert.Equal(t, "job", shard.Name)
+		assert.Equal(t, "overall", shard.Overall.Name)
+		assert.NotEmpty(t, shard.Jobs, "100 jobs should land in every shard")
+		for id := range shard.Jobs {
+			assert.Equal(t, i, ShardForId(id, 4))
+		}
+		total += len(shard.Jobs)
+	}
+	assert.Equal(t, 100, total)
+
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, []KickRequest[MyJobContext]{{C: jc, State: STATE_DONE_TWO}}, nil
+			},
+			Concurrency: 5,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+		{TriggerState: STATE_DONE_TWO, Terminal: true},
+	}
+
+	// Process each shard on its own, shipping it out and back through a serializer like separate machines would
+	processed := []*Run[MyOverallContext, MyJobContext]{}
+	for i, shard := range shards {
+		serializer := NewJsonSerializer[MyOverallContext, MyJobContext](filepath.Join(t.TempDir(), fmt.Sprintf("shard-%d.json", i)))
+		require.NoError(t, serializer.Serialize(*shard))
+		shard, err := serializer.Deserialize()
+		require.NoError(t, err)
+
+		p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, serializer, nil)
+		require.NoError(t, err)
+		require.NoError(t, p.Exec(context.Background(), shard))
+
+		shard, err = serializer.Deserialize()
+		require.NoError(t, err)
+		processed = append(processed, shard)
+	}
+
+	merged, err := MergeRuns(processed...)
+	require.NoError(t, err)
+	assert.Equal(t, "job", merged.Name)
+	assert.Len(t, merged.Jobs, 200)
+	assert.Equal(t, 100, merged.NextJobId)
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("%d", i)
+		assert.Equal(t, STATE_DONE, merged.Jobs[id].State)
+		assert.Equal(t, i, merged.Jobs[id].C.Count)
+		assert.Equal(t, STATE_DONE_TWO, merged.Jobs[id+"->0"].State)
+	}
+}
+
+func TestRun_PartitionFunc(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 10; i++ {
+		r.AddJob(MyJobContext{Count: i})
+	}
+
+	shards, err := r.PartitionFunc(2, func(j Job[MyJobContext]) int {
+		return j.C.Count % 2
+	})
+	require.NoError(t, err)
+	for i, shard := range shards {
+		assert.Len(t, shard.Jobs, 5)
+		for _, j := range shard.Jobs {
+			assert.Equal(t, i, j.C.Count%2)
+		}
+	}
+
+	_, err = r.PartitionFunc(2, func(j Job[MyJobContext]) int { return 2 })
+	assert.ErrorIs(t, err, ErrInvalidShard)
+	_, err = r.Partition(0)
+	assert.ErrorIs(t, err, ErrInvalidShard)
+	_, err = r.Partition(-1)
+	assert.ErrorIs(t, err, ErrInvalidShard)
+	assert.Panics(t, func() { ShardForId("0", 0) })
+}
+
+func TestMergeRuns_DuplicateJobId(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	r.AddJob(MyJobContext{})
+	shards, err := r.Partition(2)
+	require.NoError(t, err)
+
+	// Adding jobs to shards separately gives them the same ids
+	shards[0].AddJob(MyJobContext{Name: "a"})
+	shards[1].AddJob(MyJobContext{Name: "b"})
+
+	_, err = MergeRuns(shards...)
+	assert.ErrorIs(t, err, ErrDuplicateJobId)
+	_, err = MergeRuns[MyOverallContext, MyJobContext]()
+	assert.ErrorIs(t, err, ErrInvalidShard)
+}
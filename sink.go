@@ -0,0 +1,73 @@
+package jorb
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// TerminalSink receives jobs as they reach a terminal state, eg to stream results out of a run that is too
+// big to keep every finished job in memory. See Processor.Sink.
+type TerminalSink[JC any] interface {
+	// Emit is called with each job that moves into a terminal state. It is called from the goroutine that
+	// schedules jobs, so a slow Emit holds up processing. If it returns an error the job is kept in the run,
+	// even if the processor evicts terminal jobs.
+	Emit(job Job[JC]) error
+}
+
+// JsonLinesSink is a TerminalSink that appends each job to File as a line of JSON. The file is opened by the
+// first Emit and kept open until Close, which the processor calls when Exec finishes. Emitting after Close
+// opens it again.
+type JsonLinesSink[JC any] struct {
+	File string
+
+	m       sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// NewJsonLinesSink creates a JsonLinesSink appending to file, which is created if it doesn't exist
+func NewJsonLinesSink[JC any](file string) *JsonLinesSink[JC] {
+	return &JsonLinesSink[JC]{
+		File: file,
+	}
+}
+
+var _ TerminalSink[any] = (*JsonLinesSink[any])(nil)
+var _ io.Closer = (*JsonLinesSink[any])(nil)
+
+// Emit appends the job to the file as a single line of JSON
+func (s *JsonLinesSink[JC]) Emit(job Job[JC]) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.file == nil {
+		if err := os.MkdirAll(filepath.Dir(s.File), 0700); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(s.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		s.file = file
+		s.encoder = json.NewEncoder(file)
+	}
+
+	return s.encoder.Encode(job)
+}
+
+// Close closes the file, if it's open
+func (s *JsonLinesSink[JC]) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	s.encoder = nil
+	return err
+}
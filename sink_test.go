@@ -0,0 +1,146 @@
+package jorb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingSink struct {
+	m    sync.Mutex
+	jobs []Job[MyJobContext]
+}
+
+func (s *recordingSink) Emit(job Job[MyJobContext]) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.jobs = append(s.jobs, job)
+	return nil
+}
+
+func TestProcessor_SinkEvictsTerminalJobs(t *testing.T) {
+	t.Parallel()
+	oc := MyOverallContext{}
+	ac := MyAppContext{}
+	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
+	for i := 0; i < 10; i++ {
+		r.AddJob(MyJobContext{})
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, []KickRequest[MyJobContext]{
+					{C: MyJobContext{Name: "kicked"}, State: STATE_MIDDLE},
+				}, nil
+			},
+			Concurrency: 3,
+		},
+		{
+			TriggerState: STATE_MIDDLE,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE_TWO, nil, nil
+			},
+			Concurrency: 3,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+		{
+			TriggerState: STATE_DONE_TWO,
+			Terminal:     true,
+		},
+	}
+
+	sink := &recordingSink{}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, nil, nil)
+	require.NoError(t, err)
+	p.Sink = sink
+	p.EvictTerminal = true
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	assert.Empty(t, r.Jobs)
+	require.Len(t, sink.jobs, 20)
+	for _, j := range sink.jobs {
+		if j.C.Name == "kicked" {
+			assert.Equal(t, STATE_DONE_TWO, j.State)
+		} else {
+			assert.Equal(t, STATE_DONE, j.State)
+		}
+	}
+
+	// Ids keep counting up rather than being reused now that the run is empty
+	r.AddJob(MyJobContext{})
+	_, ok := r.JobByID("10")
+	assert.True(t, ok)
+}
+
+func TestJsonLinesSink(t *testing.T) {
+	t.Parallel()
+	file := filepath.Join(t.TempDir(), "out", "jobs.jsonl")
+	sink := NewJsonLinesSink[MyJobContext](file)
+
+	require.NoError(t, sink.Emit(Job[MyJobContext]{Id: "0", C: MyJobContext{Name: "a"}, State: STATE_DONE}))
+	require.NoError(t, sink.Emit(Job[MyJobContext]{Id: "1", C: MyJobContext{Name: "b"}, State: STATE_DONE}))
+	require.NoError(t, sink.Close())
+	// Emitting after Close opens the file again and carries on appending
+	require.NoError(t, sink.Emit(Job[MyJobContext]{Id: "2", C: MyJobContext{Name: "c"}, State: STATE_DONE}))
+	require.NoError(t, sink.Close())
+	require.NoError(t, sink.Close())
+
+	f, err := os.Open(file)
+	require.NoError(t, err)
+	defer f.Close()
+
+	names := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var j Job[MyJobContext]
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &j))
+		names = append(names, j.C.Name)
+	}
+	require.NoError(t, scanner.Err())
+	assert.Equal(t, []string{"a", "b", "c"}, names)
+}
+
+func TestProcessor_ClosesSink(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 3; i++ {
+		r.AddJob(MyJobContext{})
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	sink := NewJsonLinesSink[MyJobContext](filepath.Join(t.TempDir(), "jobs.jsonl"))
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	p.Sink = sink
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	// The file stayed open for the run and was closed once Exec finished
+	assert.Nil(t, sink.file)
+	data, err := os.ReadFile(sink.File)
+	require.NoError(t, err)
+	assert.Equal(t, 3, bytes.Count(data, []byte("\n")))
+}
@@ -0,0 +1,142 @@
+package jorb
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// spillQueue is a FIFO queue of waiting jobs kept on disk as lines of JSON, used once a state has more
+// waiting jobs than Processor.SpillThreshold
+//
+// Jobs are appended to the end of the file and read back from the front, and the file is removed
+// whenever the queue empties so it doesn't grow forever
+type spillQueue[JC any] struct {
+	dir   string
+	state string
+	count int
+
+	file    *os.File
+	writer  *bufio.Writer
+	encoder *json.Encoder
+	reader  *os.File
+	decoder *json.Decoder
+}
+
+func newSpillQueue[JC any](dir string, state string) *spillQueue[JC] {
+	return &spillQueue[JC]{
+		dir:   dir,
+		state: state,
+	}
+}
+
+// push appends a job to the back of the queue
+func (q *spillQueue[JC]) push(job Job[JC]) error {
+	if q.file == nil {
+		if err := q.open(); err != nil {
+			return err
+		}
+	}
+	if err := q.encoder.Encode(job); err != nil {
+		return err
+	}
+	q.count++
+	return nil
+}
+
+// pop removes up to n jobs from the front of the queue, oldest first
+func (q *spillQueue[JC]) pop(n int) ([]Job[JC], error) {
+	if q.count == 0 {
+		return nil, nil
+	}
+	// Everything being read has to be on disk
+	if err := q.writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	jobs := make([]Job[JC], 0, min(n, q.count))
+	for len(jobs) < n && q.count > 0 {
+		var job Job[JC]
+		if err := q.decoder.Decode(&job); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+		q.count--
+	}
+
+	if q.count == 0 {
+		return jobs, q.close()
+	}
+	return jobs, nil
+}
+
+// peek returns all of the jobs in the queue, oldest first, without removing them
+func (q *spillQueue[JC]) peek() ([]Job[JC], error) {
+	if q.count == 0 {
+		return nil, nil
+	}
+	if err := q.writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	// Read from where the queue's own reader is up to, without moving it along
+	reader, err := os.Open(q.file.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	if _, err := reader.Seek(q.decoder.InputOffset(), io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(reader)
+	jobs := make([]Job[JC], 0, q.count)
+	for len(jobs) < q.count {
+		var job Job[JC]
+		if err := decoder.Decode(&job); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+func (q *spillQueue[JC]) open() error {
+	if err := os.MkdirAll(q.dir, 0700); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(q.dir, fmt.Sprintf("jorb-%s-*.jsonl", filepath.Base(q.state)))
+	if err != nil {
+		return err
+	}
+	reader, err := os.Open(file.Name())
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	q.file = file
+	q.writer = bufio.NewWriter(file)
+	q.encoder = json.NewEncoder(q.writer)
+	q.reader = reader
+	q.decoder = json.NewDecoder(reader)
+	return nil
+}
+
+// close removes the queue's file, dropping anything still in it
+func (q *spillQueue[JC]) close() error {
+	if q.file == nil {
+		return nil
+	}
+	name := q.file.Name()
+	q.file.Close()
+	q.reader.Close()
+
+	q.file, q.writer, q.encoder, q.reader, q.decoder = nil, nil, nil, nil, nil
+	q.count = 0
+	return os.Remove(name)
+}
@@ -0,0 +1,193 @@
+package jorb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpillQueue(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	q := newSpillQueue[MyJobContext](dir, TRIGGER_STATE_NEW)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, q.push(Job[MyJobContext]{Id: fmt.Sprintf("%d", i)}))
+	}
+	jobs, err := q.pop(3)
+	require.NoError(t, err)
+	require.Len(t, jobs, 3)
+	assert.Equal(t, "0", jobs[0].Id)
+	assert.Equal(t, "2", jobs[2].Id)
+
+	// Jobs pushed after a pop still come out after the ones already queued
+	require.NoError(t, q.push(Job[MyJobContext]{Id: "5"}))
+
+	// Peeking shows what's left without taking it
+	peeked, err := q.peek()
+	require.NoError(t, err)
+	require.Len(t, peeked, 3)
+	assert.Equal(t, "3", peeked[0].Id)
+
+	jobs, err = q.pop(10)
+	require.NoError(t, err)
+	ids := []string{}
+	for _, j := range jobs {
+		ids = append(ids, j.Id)
+	}
+	assert.Equal(t, []string{"3", "4", "5"}, ids)
+
+	// The file is cleaned up once the queue is empty
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestStateStorage_SpillKeepsFifoOrder(t *testing.T) {
+	stateS := newStateStorageFromStates([]State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	})
+	stateS.spillThreshold = 2
+	stateS.spillDir = t.TempDir()
+
+	started := make(chan string, 10)
+	go func() {
+		for job := range stateS.stateChan[TRIGGER_STATE_NEW] {
+			started <- job.Id
+		}
+	}()
+
+	for i := 0; i < 8; i++ {
+		job := createJob(TRIGGER_STATE_NEW)
+		job.Id = fmt.Sprintf("%d", i)
+		stateS.processJob(job)
+	}
+	// One job is running, two are waiting in memory and the rest went to disk
+	assert.Equal(t, 2, stateS.stateWaitingJobsMap[TRIGGER_STATE_NEW].len())
+	assert.Equal(t, 5, stateS.spilledJobCount(TRIGGER_STATE_NEW))
+	assert.Equal(t, 7, stateS.getStatusCounts()[1].Waiting)
+
+	for i := 0; i < 7; i++ {
+		stateS.runNextWaitingJob(TRIGGER_STATE_NEW)
+	}
+
+	for i := 0; i < 8; i++ {
+		assert.Equal(t, fmt.Sprintf("%d", i), <-started)
+	}
+	assert.Equal(t, 0, stateS.getStatusCounts()[1].Waiting)
+}
+
+func TestProcessor_SpillThreshold(t *testing.T) {
+	t.Parallel()
+	oc := MyOverallContext{}
+	ac := MyAppContext{}
+	r := NewRun[MyOverallContext, MyJobContext]("job", oc)
+	for i := 0; i < 5; i++ {
+		r.AddJob(MyJobContext{})
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				kicks := []KickRequest[MyJobContext]{}
+				for i := 0; i < 100; i++ {
+					kicks = append(kicks, KickRequest[MyJobContext]{C: MyJobContext{Count: i}, State: STATE_MIDDLE})
+				}
+				return jc, STATE_DONE, kicks, nil
+			},
+			Concurrency: 5,
+		},
+		{
+			TriggerState: STATE_MIDDLE,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				jc.Name = "ran"
+				return jc, STATE_DONE_TWO, nil, nil
+			},
+			Concurrency: 2,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+		{
+			TriggerState: STATE_DONE_TWO,
+			Terminal:     true,
+		},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](ac, states, nil, nil)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	p.SpillThreshold = 10
+	p.SpillDir = dir
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	require.Len(t, r.Jobs, 505)
+	for _, j := range r.Jobs {
+		if j.ParentId() == "" {
+			assert.Equal(t, STATE_DONE, j.State)
+		} else {
+			assert.Equal(t, STATE_DONE_TWO, j.State)
+			assert.Equal(t, "ran", j.C.Name)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestProcessor_SpillFailed(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 20; i++ {
+		r.AddJob(MyJobContext{})
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 1,
+		},
+		{
+			TriggerState: STATE_DONE,
+			Terminal:     true,
+		},
+	}
+
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	p.SpillThreshold = 5
+	// There's nowhere to write the spill file, as the spill dir is a file
+	notDir := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(notDir, nil, 0600))
+	p.SpillDir = notDir
+	err = p.Exec(context.Background(), r)
+	require.ErrorIs(t, err, ErrSpillFailed)
+
+	// Every job is still in the run, so it can be resumed somewhere that works
+	require.Len(t, r.Jobs, 20)
+	p, err = NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+	for _, j := range r.Jobs {
+		assert.Equal(t, STATE_DONE, j.State)
+	}
+}
@@ -1,5 +1,16 @@
 package jorb
 
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
 // StatusListener is an interface that defines a method for receiving status updates.
 // It is used by the processor to notify interested parties about the current status
 // of job processing.
@@ -8,10 +19,32 @@ type StatusListener interface {
 	// status of job processing. The `status` parameter is a slice of StatusCount
 	// instances, where each instance represents the count of jobs in a particular state.
 	//
-	// The status counts will be in the same order as the states passed to the processor
+	// The status counts are sorted by state name, or in the same order as the states passed to the
+	// processor if Processor.StatusInDeclarationOrder is set
 	StatusUpdate(status []StatusCount)
 }
 
+// RunStatusListener is optionally implemented by a StatusListener that wants the run along with each status
+// update, eg to show which jobs are in each state. The processor calls StatusUpdateWithRun instead of
+// StatusUpdate, from the same goroutine, so the run is being processed while the listener looks at it. Only
+// use its methods that are safe to call while the run is being processed, eg ForEachJob, JobByID and
+// TerminalCounts, and don't change it. The run may have moved on since the status was taken. Listeners
+// wrapped in a MultiStatusListener only get StatusUpdate.
+type RunStatusListener[OC any, JC any] interface {
+	StatusListener
+	StatusUpdateWithRun(status []StatusCount, r *Run[OC, JC])
+}
+
+// withRun adapts a RunStatusListener to a StatusListener that passes it the run
+type withRun[OC any, JC any] struct {
+	listener RunStatusListener[OC, JC]
+	run      *Run[OC, JC]
+}
+
+func (w withRun[OC, JC]) StatusUpdate(status []StatusCount) {
+	w.listener.StatusUpdateWithRun(status, w.run)
+}
+
 // NilStatusListener is a struct that implements the StatusListener interface with a no-op
 // implementation of the StatusUpdate method. It is useful when you don't need to receive
 // status updates or when you want to use a dummy status listener.
@@ -27,3 +60,182 @@ func (n NilStatusListener) StatusUpdate(status []StatusCount) {
 // It is a way to verify at compile-time that the NilStatusListener struct correctly implements
 // the required methods of the StatusListener interface.
 var _ StatusListener = &NilStatusListener{}
+
+// MultiStatusListener fans status updates out to several StatusListeners at once, eg a progress bar
+// and a metrics exporter.
+//
+// Each listener is fed by its own goroutine through a single slot buffer. If a listener is slow, the
+// updates it hasn't picked up yet are coalesced so it only ever sees the latest status, and it never
+// blocks the other listeners or the processor calling StatusUpdate.
+type MultiStatusListener struct {
+	listeners []*bufferedStatusListener
+}
+
+// NewMultiStatusListener creates a MultiStatusListener that forwards to each of the given listeners.
+// Call Close once processing is done to deliver any pending updates and stop the forwarding goroutines.
+func NewMultiStatusListener(listeners ...StatusListener) *MultiStatusListener {
+	m := &MultiStatusListener{}
+	for _, l := range listeners {
+		m.listeners = append(m.listeners, newBufferedStatusListener(l, 1))
+	}
+	return m
+}
+
+// StatusUpdate hands the status to every listener without waiting for any of them to handle it
+func (m *MultiStatusListener) StatusUpdate(status []StatusCount) {
+	for _, l := range m.listeners {
+		l.offer(status)
+	}
+}
+
+// Close waits for every listener to receive its latest pending update and then stops forwarding.
+// StatusUpdate must not be called after Close.
+func (m *MultiStatusListener) Close() {
+	for _, l := range m.listeners {
+		l.close()
+	}
+}
+
+var _ StatusListener = &MultiStatusListener{}
+
+// bufferedStatusListener delivers status updates to a listener from its own goroutine. Once size updates
+// are pending, the oldest are dropped so the listener catches up with the latest status.
+type bufferedStatusListener struct {
+	listener StatusListener
+	pending  chan []StatusCount
+	done     chan struct{}
+}
+
+func newBufferedStatusListener(listener StatusListener, size int) *bufferedStatusListener {
+	b := &bufferedStatusListener{
+		listener: listener,
+		pending:  make(chan []StatusCount, size),
+		done:     make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// close stops the delivery goroutine once the listener has seen the latest update. Any older updates
+// still pending are skipped so shutdown doesn't wait on a slow listener to work through a backlog.
+func (b *bufferedStatusListener) close() {
+	var latest []StatusCount
+	for drained := false; !drained; {
+		select {
+		case status := <-b.pending:
+			latest = status
+		default:
+			drained = true
+		}
+	}
+	if latest != nil {
+		b.pending <- latest
+	}
+
+	close(b.pending)
+	<-b.done
+}
+
+func (b *bufferedStatusListener) run() {
+	defer close(b.done)
+	for status := range b.pending {
+		b.listener.StatusUpdate(status)
+	}
+}
+
+// offer queues the update, dropping the oldest pending update if the buffer is full
+func (b *bufferedStatusListener) offer(status []StatusCount) {
+	for {
+		select {
+		case b.pending <- status:
+			return
+		default:
+		}
+
+		select {
+		case <-b.pending:
+		default:
+		}
+	}
+}
+
+// TableStatusListener renders each status update as an aligned table of the states and their counts, eg
+// for watching a run from the CLI. Every update after the first moves the cursor back up over the
+// previous table with ANSI escapes and redraws it in place, so point it at a terminal.
+type TableStatusListener struct {
+	m     sync.Mutex
+	w     io.Writer
+	lines int // lines drawn by the last update, to move back over on the next
+}
+
+// NewTableStatusListener creates a TableStatusListener that draws to w
+func NewTableStatusListener(w io.Writer) *TableStatusListener {
+	return &TableStatusListener{w: w}
+}
+
+// StatusUpdate redraws the table with the latest counts
+func (t *TableStatusListener) StatusUpdate(status []StatusCount) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	table := &bytes.Buffer{}
+	tw := tabwriter.NewWriter(table, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "State\tWaiting\tExecuting\tCompleted\tSkipped\tTerminal")
+	for _, s := range status {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%t\n", s.State, s.Waiting, s.Executing, s.Completed, s.Skipped, s.Terminal)
+	}
+	tw.Flush()
+
+	out := &bytes.Buffer{}
+	if t.lines > 0 {
+		// Back up to the start of the last table and clear everything below
+		fmt.Fprintf(out, "\x1b[%dA\r\x1b[J", t.lines)
+	}
+	out.Write(table.Bytes())
+	t.lines = strings.Count(table.String(), "\n")
+
+	// There's nowhere to report a failed write, the next update will just try again
+	_, _ = t.w.Write(out.Bytes())
+}
+
+var _ StatusListener = &TableStatusListener{}
+
+// StatusRecord is a status update as written by a JsonStatusListener
+type StatusRecord struct {
+	Time   time.Time     // Time is when the listener got the update
+	Status []StatusCount // Status is the update's counts, in the order the processor sent them
+}
+
+// JsonStatusListener writes each status update to w as a line of JSON, a StatusRecord, like JsonLinesSink
+// does for jobs, eg for a log pipeline to pick up the progress of a batch job. It's the structured
+// counterpart to TableStatusListener.
+type JsonStatusListener struct {
+	m sync.Mutex
+	w io.Writer
+}
+
+// NewJsonStatusListener creates a JsonStatusListener that writes to w
+func NewJsonStatusListener(w io.Writer) *JsonStatusListener {
+	return &JsonStatusListener{w: w}
+}
+
+// StatusUpdate writes the update as a single line of JSON
+func (j *JsonStatusListener) StatusUpdate(status []StatusCount) {
+	line, err := json.Marshal(StatusRecord{Time: time.Now(), Status: status})
+	if err != nil {
+		// Only the Gauges could fail to encode, eg with a NaN, so drop them rather than the update
+		counts := make([]StatusCount, len(status))
+		for i, c := range status {
+			c.Gauges = nil
+			counts[i] = c
+		}
+		line, _ = json.Marshal(StatusRecord{Time: time.Now(), Status: counts})
+	}
+
+	j.m.Lock()
+	defer j.m.Unlock()
+	// There's nowhere to report a failed write, the next update will just try again
+	_, _ = j.w.Write(append(line, '\n'))
+}
+
+var _ StatusListener = &JsonStatusListener{}
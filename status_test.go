@@ -0,0 +1,175 @@
+package jorb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingStatusListener struct {
+	m       sync.Mutex
+	block   chan struct{}
+	updates [][]StatusCount
+}
+
+func (r *recordingStatusListener) StatusUpdate(status []StatusCount) {
+	if r.block != nil {
+		<-r.block
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.updates = append(r.updates, status)
+}
+
+func (r *recordingStatusListener) Updates() [][]StatusCount {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.updates
+}
+
+func TestMultiStatusListener_SlowListenerDoesNotBlock(t *testing.T) {
+	t.Parallel()
+	fast := &recordingStatusListener{}
+	slow := &recordingStatusListener{block: make(chan struct{})}
+	m := NewMultiStatusListener(fast, slow)
+
+	statuses := [][]StatusCount{}
+	for i := 0; i < 10; i++ {
+		statuses = append(statuses, []StatusCount{{State: TRIGGER_STATE_NEW, Completed: i}})
+	}
+
+	start := time.Now()
+	for _, status := range statuses {
+		m.StatusUpdate(status)
+	}
+	assert.Less(t, time.Since(start), time.Second, "StatusUpdate shouldn't wait on the slow listener")
+
+	close(slow.block)
+	m.Close()
+
+	last := statuses[len(statuses)-1]
+	require.NotEmpty(t, fast.Updates())
+	assert.Equal(t, last, fast.Updates()[len(fast.Updates())-1])
+
+	// The slow listener was stuck on the first update, everything after that is coalesced into the last one
+	require.NotEmpty(t, slow.Updates())
+	assert.LessOrEqual(t, len(slow.Updates()), 2)
+	assert.Equal(t, last, slow.Updates()[len(slow.Updates())-1])
+}
+
+func TestTableStatusListener(t *testing.T) {
+	t.Parallel()
+	out := &bytes.Buffer{}
+	l := NewTableStatusListener(out)
+
+	l.StatusUpdate([]StatusCount{
+		{State: TRIGGER_STATE_NEW, Waiting: 12, Executing: 3, Completed: 140},
+		{State: STATE_DONE, Completed: 7, Terminal: true},
+		{State: STATE_SKIPPED, Skipped: 2, Terminal: true},
+	})
+	assert.Equal(t, ""+
+		"State    Waiting  Executing  Completed  Skipped  Terminal\n"+
+		"new      12       3          140        0        false\n"+
+		"done     0        0          7          0        true\n"+
+		"skipped  0        0          0          2        true\n",
+		out.String())
+
+	// The next update moves back up over the four lines and redraws them
+	out.Reset()
+	l.StatusUpdate([]StatusCount{
+		{State: TRIGGER_STATE_NEW, Completed: 155},
+		{State: STATE_DONE, Completed: 155, Terminal: true},
+	})
+	assert.Equal(t, "\x1b[4A\r\x1b[J"+
+		"State  Waiting  Executing  Completed  Skipped  Terminal\n"+
+		"new    0        0          155        0        false\n"+
+		"done   0        0          155        0        true\n",
+		out.String())
+}
+
+// jobsListener is a RunStatusListener that keeps which state each job was in at every update
+type jobsListener struct {
+	m       sync.Mutex
+	plain   int
+	updates []map[string]string
+}
+
+func (l *jobsListener) StatusUpdate(status []StatusCount) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.plain++
+}
+
+func (l *jobsListener) StatusUpdateWithRun(status []StatusCount, r *Run[MyOverallContext, MyJobContext]) {
+	states := map[string]string{}
+	r.ForEachJob(func(j Job[MyJobContext]) {
+		states[j.Id] = j.State
+	})
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.updates = append(l.updates, states)
+}
+
+func TestJsonStatusListener(t *testing.T) {
+	t.Parallel()
+	out := &bytes.Buffer{}
+	l := NewJsonStatusListener(out)
+
+	before := time.Now()
+	l.StatusUpdate([]StatusCount{
+		{State: TRIGGER_STATE_NEW, Waiting: 12, Executing: 3, Completed: 140, Gauges: map[string]float64{"queue": 4}},
+		{State: STATE_DONE, Completed: 7, Terminal: true},
+	})
+	// Gauges that can't be encoded are left out rather than losing the update
+	l.StatusUpdate([]StatusCount{{State: TRIGGER_STATE_NEW, Completed: 155, Gauges: map[string]float64{"bad": math.NaN()}}})
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	var first, second StatusRecord
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &first))
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &second))
+
+	assert.False(t, first.Time.Before(before.Truncate(time.Second)))
+	require.Len(t, first.Status, 2)
+	assert.Equal(t, 12, first.Status[0].Waiting)
+	assert.Equal(t, 4.0, first.Status[0].Gauges["queue"])
+	assert.True(t, first.Status[1].Terminal)
+	assert.Equal(t, []StatusCount{{State: TRIGGER_STATE_NEW, Completed: 155}}, second.Status)
+}
+
+func TestProcessor_RunStatusListener(t *testing.T) {
+	t.Parallel()
+	r := NewRun[MyOverallContext, MyJobContext]("job", MyOverallContext{})
+	for i := 0; i < 5; i++ {
+		r.AddJob(MyJobContext{})
+	}
+	states := []State[MyAppContext, MyOverallContext, MyJobContext]{
+		{
+			TriggerState: TRIGGER_STATE_NEW,
+			Exec: func(ctx context.Context, ac MyAppContext, oc MyOverallContext, jc MyJobContext) (MyJobContext, string, []KickRequest[MyJobContext], error) {
+				return jc, STATE_DONE, nil, nil
+			},
+			Concurrency: 2,
+		},
+		{TriggerState: STATE_DONE, Terminal: true},
+	}
+	listener := &jobsListener{}
+	p, err := NewProcessor[MyAppContext, MyOverallContext, MyJobContext](MyAppContext{}, states, nil, listener)
+	require.NoError(t, err)
+	require.NoError(t, p.Exec(context.Background(), r))
+
+	listener.m.Lock()
+	defer listener.m.Unlock()
+	assert.Zero(t, listener.plain, "StatusUpdateWithRun replaces StatusUpdate")
+	require.NotEmpty(t, listener.updates)
+	assert.Equal(t, map[string]string{"0": STATE_DONE, "1": STATE_DONE, "2": STATE_DONE, "3": STATE_DONE, "4": STATE_DONE},
+		listener.updates[len(listener.updates)-1])
+}